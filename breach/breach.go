@@ -0,0 +1,135 @@
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// prefixLen is how many hex digits of the SHA-1 hash name the bucket a
+// breached password is filed under, as in the Have I Been Pwned range API
+const prefixLen = 5
+
+//go:embed common.txt
+var commonList string
+
+// common holds the built-in passwords, lowercased
+var common = parseCommon(commonList)
+
+// List checks passwords against the built-in list of common passwords and,
+// if it has a directory, against the breached passwords filed there.
+//
+// The directory holds one file per 5 hex digit prefix of the SHA-1 hash,
+// named "<PREFIX>" or "<PREFIX>.txt", with a "<SUFFIX>:<count>" line for
+// every hash that starts with the prefix. That is the format of the Have I
+// Been Pwned range API, so the files can be fetched bucket by bucket
+// without sending any hash in full. A check reads one bucket and nothing
+// is kept in memory, so the files can be replaced at any time without
+// restarting the server. A List is safe for concurrent use.
+type List struct {
+	dir string
+}
+
+// Open returns a List backed by the buckets in dir. An empty dir gives a
+// list of the built-in common passwords only.
+func Open(dir string) (*List, error) {
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("breach: %s is not a directory", dir)
+		}
+	}
+	return &List{dir: dir}, nil
+}
+
+// Contains reports whether password is a common password or was seen in a
+// breach. A bucket that cannot be read is logged and treated as empty, so
+// a broken list does not stop anyone from choosing a password.
+func (l *List) Contains(password string) bool {
+	if isCommon(password) {
+		return true
+	}
+	if l.dir == "" {
+		return false
+	}
+
+	found, err := l.inBucket(password)
+	if err != nil {
+		log.Printf("breach: %v", err)
+		return false
+	}
+	return found
+}
+
+// inBucket looks for the hash of password in the bucket of its prefix
+func (l *List) inBucket(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:prefixLen], hash[prefixLen:]
+
+	f, err := l.openBucket(prefix)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Padding entries from the range API have a count of 0
+		if strings.EqualFold(entry, suffix) && strings.TrimSpace(count) != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// openBucket opens the file of a prefix, with or without an extension
+func (l *List) openBucket(prefix string) (*os.File, error) {
+	f, err := os.Open(filepath.Join(l.dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(l.dir, prefix+".txt"))
+	}
+	return f, err
+}
+
+// isCommon reports whether password, ignoring case and any digits and
+// symbols added at the end, is on the built-in list
+func isCommon(password string) bool {
+	lowered := strings.ToLower(password)
+	if common[lowered] {
+		return true
+	}
+	base := strings.TrimRightFunc(lowered, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	return base != "" && common[base]
+}
+
+// parseCommon reads one password per line, skipping blank lines and
+// comments
+func parseCommon(list string) map[string]bool {
+	passwords := make(map[string]bool)
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = true
+	}
+	return passwords
+}
@@ -0,0 +1,117 @@
+package breach
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeBucket files the given passwords under their prefixes in dir, in
+// the range API format, with a padding entry in each bucket
+func writeBucket(t *testing.T, dir, name string, passwords ...string) {
+	t.Helper()
+	for _, pw := range passwords {
+		sum := sha1.Sum([]byte(pw))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		lines := hash[prefixLen:] + ":42\r\n" + strings.Repeat("0", 35) + ":0\r\n"
+		path := filepath.Join(dir, strings.Replace(name, "PREFIX", hash[:prefixLen], 1))
+		if err := os.WriteFile(path, []byte(lines), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContainsCommon(t *testing.T) {
+	l, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password1", true},
+		{"Password1", true},
+		{"PASSWORD", true},
+		{"football2024!", true},
+		{"p@ssw0rd1", true},
+		{"12345678", true},
+		{"qwertyuiop", true},
+		{"correct horse battery staple", false},
+		{"football-is-my-thing", false},
+		{"1234567890123", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := l.Contains(tt.password); got != tt.want {
+			t.Errorf("Contains(%q) = %t, want %t", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestContainsBuckets(t *testing.T) {
+	for _, name := range []string{"PREFIX", "PREFIX.txt"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeBucket(t, dir, name, "hunter2hunter2", "Tr0ub4dor&3")
+
+			l, err := Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pw := range []string{"hunter2hunter2", "Tr0ub4dor&3"} {
+				if !l.Contains(pw) {
+					t.Errorf("Contains(%q) = false, want true", pw)
+				}
+			}
+			for _, pw := range []string{"Hunter2hunter2", "not in any bucket"} {
+				if l.Contains(pw) {
+					t.Errorf("Contains(%q) = true, want false", pw)
+				}
+			}
+		})
+	}
+}
+
+func TestContainsSkipsPadding(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("padded password"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	err := os.WriteFile(filepath.Join(dir, hash[:prefixLen]), []byte(hash[prefixLen:]+":0\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Contains("padded password") {
+		t.Error("Contains matched an entry with a count of 0")
+	}
+}
+
+func TestContainsSeesReplacedBuckets(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Contains("added later password") {
+		t.Fatal("Contains = true before the bucket exists")
+	}
+	writeBucket(t, dir, "PREFIX", "added later password")
+	if !l.Contains("added later password") {
+		t.Error("Contains = false after the bucket was added")
+	}
+}
+
+func TestOpenMissingDir(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Open of a missing directory succeeded")
+	}
+}
@@ -1,23 +1,181 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 var (
+	// PassPepper is mixed into every new password hash. Its version,
+	// PassPepperVersion, is stored with the hash, so the pepper can be
+	// rotated by giving the new one a higher version and moving the old
+	// one to PassPeppersPrevious.
 	PassPepper   string
 	ClientOrigin string
 	CertFile     string
 	KeyFile      string
 	ServerPort   string
 	ServerHost   string
-	HMACKey      string
+	// HMACKey is the token hashing key from before keys had IDs. Hashes
+	// made with it are still accepted after all of HMACKeys.
+	HMACKey string
+	// HMACKeys are the token hashing keys, as "<id>:<secret>" pairs with
+	// the current key first. A previous key stays listed for as long as
+	// hashes made with it should be accepted; they are replaced with
+	// hashes made with the current key as the tokens are used.
+	HMACKeys []HMACKeyConfig
+
+	// PassPepperVersion is the version of PassPepper
+	PassPepperVersion int
+	// PassPeppersPrevious are earlier peppers by version, as
+	// "<version>:<pepper>" pairs. Passwords hashed with one are rehashed
+	// with PassPepper the next time their owner logs in.
+	PassPeppersPrevious map[int]string
+	// BreachedPasswordsDir holds the SHA-1 hashes of breached passwords,
+	// which new passwords may not be, in one file per hash prefix as
+	// served by the Have I Been Pwned range API. Without it, passwords are
+	// only checked against a built-in list of common ones.
+	BreachedPasswordsDir string
+	// PasswordCost is the bcrypt cost of new password hashes. Hashes of a
+	// different cost are rehashed at the next login.
+	PasswordCost int
+
+	// SessionAbsoluteTimeout caps how long a session can live in total,
+	// no matter how often it is used.
+	SessionAbsoluteTimeout time.Duration
+	// SessionIdleTimeout ends a session that has not been used for this long.
+	SessionIdleTimeout time.Duration
+
+	// PasswordResetTimeout is how long a password reset link stays valid.
+	PasswordResetTimeout time.Duration
+
+	// AccountDeletionGracePeriod is how long a user has to change their
+	// mind after asking for their account to be deleted. After it, the
+	// account and everything in it is gone for good.
+	AccountDeletionGracePeriod time.Duration
+
+	// EmailVerificationTimeout is how long an email verification link
+	// stays valid.
+	EmailVerificationTimeout time.Duration
+	// VerificationResendInterval is the minimum time between two
+	// verification emails to the same user.
+	VerificationResendInterval time.Duration
+
+	// TOTPIssuer is the account issuer shown in authenticator apps.
+	TOTPIssuer string
+	// TwoFactorPendingTimeout is how long a user has to enter their
+	// two-factor code after the password check.
+	TwoFactorPendingTimeout time.Duration
+
+	// LockoutStore selects where login failure counters live: "memory"
+	// or "postgres" (shared between servers).
+	LockoutStore string
+	// LoginAccountThreshold and LoginIPThreshold are how many failed
+	// logins an account or an IP gets before it is locked out.
+	LoginAccountThreshold int
+	LoginIPThreshold      int
+	// LoginLockoutBase is the first lockout; it doubles with every
+	// further failure up to LoginLockoutMax.
+	LoginLockoutBase time.Duration
+	LoginLockoutMax  time.Duration
+	// LoginFailureWindow forgets failures after this long without one.
+	LoginFailureWindow time.Duration
+
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For header is believed.
+	TrustedProxies []*net.IPNet
+
+	// Rate limits as "<requests>/<duration>", e.g. "10/1m"
+	RateLimitDefault RateLimit
+	RateLimitLogin   RateLimit
+	RateLimitSignup  RateLimit
+	RateLimitUpload  RateLimit
+	// RateLimitShare covers requests made through share links, slowing
+	// down guessing of link passwords
+	RateLimitShare RateLimit
+
+	// StorageBackend selects where image files live: "local" (under
+	// ImageDir, served from LocalStorageURL) or "s3".
+	StorageBackend  string
+	ImageDir        string
+	LocalStorageURL string
+
+	// StorageSigningKey signs the URLs of locally stored files. Without
+	// one, a key for that alone is derived from the current HMAC key.
+	StorageSigningKey string
+
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool
+	// SignedURLTTL is how long links to image files stay valid.
+	SignedURLTTL time.Duration
+
+	// MaxImageBytes caps a single uploaded file and MaxUploadBytes a whole
+	// upload request.
+	MaxImageBytes  int64
+	MaxUploadBytes int64
+
+	// ResumableUploadDir holds the data of unfinished resumable uploads
+	// until they are complete. It must be shared by every server.
+	ResumableUploadDir string
+	// ResumableUploadExpiry is how long an unfinished resumable upload is
+	// kept after its last chunk.
+	ResumableUploadExpiry time.Duration
+
+	// DerivativeSizes are the resized copies generated for every image,
+	// as "<name>:<width>" pairs, e.g. "thumbnail:320,medium:1024".
+	DerivativeSizes []DerivativeSize
+	// DerivativeQuality is the JPEG quality (1-100) of resized copies.
+	DerivativeQuality int
+	// DerivativeWorkers is how many images are resized at the same time.
+	DerivativeWorkers int
+	// DerivativeMaxPixels caps the size of images that are decoded for
+	// resizing, since a decoded image takes 4 bytes per pixel.
+	DerivativeMaxPixels int
+
+	// MailBackend selects how email is delivered: "smtp", or "capture" to
+	// keep messages locally (in MailCaptureDir when it is set).
+	MailBackend    string
+	MailFrom       string
+	MailCaptureDir string
+	SMTPHost       string
+	SMTPPort       string
+	SMTPUsername   string
+	SMTPPassword   string
 )
 
+// RateLimit allows Requests per Per
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// HMACKeyConfig is a token hashing key and its ID
+type HMACKeyConfig struct {
+	ID     string
+	Secret string
+}
+
+// DerivativeSize is a named resized copy of an image, at most Width
+// pixels wide
+type DerivativeSize struct {
+	Name  string
+	Width int
+}
+
 // LoadEnv loads the environment variables from a .env file and sets up global variables.
 func LoadEnv() {
 	err := godotenv.Load()
@@ -33,6 +191,59 @@ func LoadEnv() {
 	ServerPort = os.Getenv("SERVER_PORT")
 	ServerHost = os.Getenv("SERVER_HOST")
 	HMACKey = os.Getenv("HMAC_KEY")
+	HMACKeys = getHMACKeys("HMAC_KEYS")
+	PassPepperVersion = getInt("PASS_PEPPER_VERSION", 1)
+	PassPeppersPrevious = getPeppers("PASS_PEPPERS_PREVIOUS")
+	PasswordCost = getInt("PASSWORD_COST", 10)
+	BreachedPasswordsDir = os.Getenv("BREACHED_PASSWORDS_DIR")
+	SessionAbsoluteTimeout = getDuration("SESSION_ABSOLUTE_TIMEOUT", 30*24*time.Hour)
+	SessionIdleTimeout = getDuration("SESSION_IDLE_TIMEOUT", 7*24*time.Hour)
+	PasswordResetTimeout = getDuration("PASSWORD_RESET_TIMEOUT", time.Hour)
+	AccountDeletionGracePeriod = getDuration("ACCOUNT_DELETION_GRACE_PERIOD", 14*24*time.Hour)
+	EmailVerificationTimeout = getDuration("EMAIL_VERIFICATION_TIMEOUT", 48*time.Hour)
+	VerificationResendInterval = getDuration("VERIFICATION_RESEND_INTERVAL", 2*time.Minute)
+	TOTPIssuer = getString("TOTP_ISSUER", "LensLocked")
+	TwoFactorPendingTimeout = getDuration("TWO_FACTOR_PENDING_TIMEOUT", 5*time.Minute)
+	LockoutStore = getString("LOCKOUT_STORE", "memory")
+	LoginAccountThreshold = getInt("LOGIN_ACCOUNT_THRESHOLD", 5)
+	LoginIPThreshold = getInt("LOGIN_IP_THRESHOLD", 20)
+	LoginLockoutBase = getDuration("LOGIN_LOCKOUT_BASE", 30*time.Second)
+	LoginLockoutMax = getDuration("LOGIN_LOCKOUT_MAX", time.Hour)
+	LoginFailureWindow = getDuration("LOGIN_FAILURE_WINDOW", 24*time.Hour)
+	TrustedProxies = getNetworks("TRUSTED_PROXIES")
+	RateLimitDefault = getRateLimit("RATE_LIMIT_DEFAULT", RateLimit{300, time.Minute})
+	RateLimitLogin = getRateLimit("RATE_LIMIT_LOGIN", RateLimit{10, time.Minute})
+	RateLimitSignup = getRateLimit("RATE_LIMIT_SIGNUP", RateLimit{5, time.Hour})
+	RateLimitUpload = getRateLimit("RATE_LIMIT_UPLOAD", RateLimit{120, time.Minute})
+	RateLimitShare = getRateLimit("RATE_LIMIT_SHARE", RateLimit{60, time.Minute})
+	StorageBackend = getString("STORAGE_BACKEND", "local")
+	ImageDir = getString("IMAGE_DIR", "images")
+	LocalStorageURL = getString("LOCAL_STORAGE_URL", "https://"+ServerHost+":"+ServerPort+"/files")
+	StorageSigningKey = getString("STORAGE_SIGNING_KEY", deriveKey(currentHMACSecret(), "storage-url"))
+	S3Endpoint = os.Getenv("S3_ENDPOINT")
+	S3Region = getString("S3_REGION", "us-east-1")
+	S3Bucket = os.Getenv("S3_BUCKET")
+	S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+	S3SecretKey = os.Getenv("S3_SECRET_KEY")
+	S3PathStyle = getBool("S3_PATH_STYLE", false)
+	SignedURLTTL = getDuration("SIGNED_URL_TTL", time.Hour)
+	MaxImageBytes = getInt64("MAX_IMAGE_BYTES", 100<<20)
+	MaxUploadBytes = getInt64("MAX_UPLOAD_BYTES", 2<<30)
+	ResumableUploadDir = getString("RESUMABLE_UPLOAD_DIR", "uploads")
+	ResumableUploadExpiry = getDuration("RESUMABLE_UPLOAD_EXPIRY", 24*time.Hour)
+	DerivativeSizes = getDerivativeSizes("DERIVATIVE_SIZES", []DerivativeSize{
+		{"thumbnail", 320}, {"medium", 1024}, {"large", 2048},
+	})
+	DerivativeQuality = getInt("DERIVATIVE_QUALITY", 85)
+	DerivativeWorkers = getInt("DERIVATIVE_WORKERS", 2)
+	DerivativeMaxPixels = getInt("DERIVATIVE_MAX_PIXELS", 100_000_000)
+	MailBackend = getString("MAIL_BACKEND", "capture")
+	MailFrom = getString("MAIL_FROM", "LensLocked <noreply@lenslocked.com>")
+	MailCaptureDir = os.Getenv("MAIL_CAPTURE_DIR")
+	SMTPHost = os.Getenv("SMTP_HOST")
+	SMTPPort = getString("SMTP_PORT", "587")
+	SMTPUsername = os.Getenv("SMTP_USERNAME")
+	SMTPPassword = os.Getenv("SMTP_PASSWORD")
 }
 
 // GetDSN constructs the database connection string from environment variables.
@@ -49,3 +260,202 @@ func GetDSN() string {
 		host, port, user, password, dbname, sslmode,
 	)
 }
+
+// getString reads a string from the environment, falling back to def when
+// it is missing.
+func getString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// getBool reads a boolean such as "true" or "0" from the environment,
+// falling back to def when it is missing or malformed.
+func getBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %t", key, v, def)
+		return def
+	}
+	return b
+}
+
+// getInt reads a positive integer from the environment, falling back to
+// def when it is missing or malformed.
+func getInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// getInt64 reads a positive 64-bit integer, such as a size in bytes, from
+// the environment, falling back to def when it is missing or malformed.
+func getInt64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// getDuration reads a duration such as "720h" from the environment,
+// falling back to def when it is missing or malformed.
+func getDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// getRateLimit reads a rate limit such as "10/1m" from the environment,
+// falling back to def when it is missing or malformed.
+func getRateLimit(key string, def RateLimit) RateLimit {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, per, ok := strings.Cut(v, "/")
+	requests, err := strconv.Atoi(strings.TrimSpace(n))
+	if !ok || err != nil || requests <= 0 {
+		log.Printf("Invalid %s %q, using %d/%s", key, v, def.Requests, def.Per)
+		return def
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %d/%s", key, v, def.Requests, def.Per)
+		return def
+	}
+	return RateLimit{Requests: requests, Per: d}
+}
+
+// getDerivativeSizes reads a comma separated list of sizes such as
+// "thumbnail:320,medium:1024" from the environment, falling back to def
+// when it is missing or malformed.
+func getDerivativeSizes(key string, def []DerivativeSize) []DerivativeSize {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var sizes []DerivativeSize
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(v, ",") {
+		name, w, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		name = strings.TrimSpace(name)
+		width, err := strconv.Atoi(strings.TrimSpace(w))
+		if !ok || name == "" || seen[name] || err != nil || width <= 0 {
+			log.Printf("Invalid %s %q, using the defaults", key, v)
+			return def
+		}
+		seen[name] = true
+		sizes = append(sizes, DerivativeSize{Name: name, Width: width})
+	}
+	return sizes
+}
+
+// getHMACKeys reads a comma separated list of keys such as
+// "2024b:secret,2024a:oldsecret" from the environment. A malformed list
+// stops the server, since tokens hashed with a wrong key would never
+// match again.
+func getHMACKeys(key string) []HMACKeyConfig {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var keys []HMACKeyConfig
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(v, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || secret == "" || seen[id] {
+			log.Fatalf("Invalid %s: entries must be unique <id>:<secret> pairs", key)
+		}
+		seen[id] = true
+		keys = append(keys, HMACKeyConfig{ID: id, Secret: secret})
+	}
+	return keys
+}
+
+// getPeppers reads comma separated "<version>:<pepper>" pairs from the
+// environment. As with HMAC keys, a malformed list stops the server.
+func getPeppers(key string) map[int]string {
+	peppers := make(map[int]string)
+	v := os.Getenv(key)
+	if v == "" {
+		return peppers
+	}
+	for _, entry := range strings.Split(v, ",") {
+		version, pepper, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		n, err := strconv.Atoi(version)
+		_, seen := peppers[n]
+		if !ok || err != nil || n <= 0 || seen {
+			log.Fatalf("Invalid %s: entries must be unique <version>:<pepper> pairs", key)
+		}
+		peppers[n] = pepper
+	}
+	return peppers
+}
+
+// currentHMACSecret returns the secret of the key new token hashes are
+// made with
+func currentHMACSecret() string {
+	if len(HMACKeys) > 0 {
+		return HMACKeys[0].Secret
+	}
+	return HMACKey
+}
+
+// deriveKey derives a key for one purpose from a secret, so that a value
+// signed for that purpose cannot be passed off as one signed for another
+func deriveKey(secret, purpose string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getNetworks reads a comma separated list of CIDRs or plain IPs from the
+// environment. Malformed entries are logged and skipped.
+func getNetworks(key string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Invalid %s entry %q, skipping", key, entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
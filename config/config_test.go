@@ -0,0 +1,19 @@
+package config
+
+import "testing"
+
+func TestDeriveKey(t *testing.T) {
+	key := deriveKey("Jefe", "storage-url")
+	if len(key) != 64 {
+		t.Fatalf("deriveKey returned %d hex digits, want 64", len(key))
+	}
+	if key == "Jefe" || key != deriveKey("Jefe", "storage-url") {
+		t.Error("deriveKey is not a stable function of the secret")
+	}
+	if key == deriveKey("Jefe", "other-purpose") {
+		t.Error("different purposes derived the same key")
+	}
+	if key == deriveKey("Jeff", "storage-url") {
+		t.Error("different secrets derived the same key")
+	}
+}
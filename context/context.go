@@ -0,0 +1,42 @@
+package context
+
+import (
+	"context"
+
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+// privateKey keeps our context keys from colliding with other packages
+type privateKey string
+
+const (
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
+)
+
+// WithUser returns a copy of ctx carrying the signed-in user
+func WithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// User returns the signed-in user, or nil if there is none
+func User(ctx context.Context) *models.User {
+	if user, ok := ctx.Value(userKey).(*models.User); ok {
+		return user
+	}
+	return nil
+}
+
+// WithSession returns a copy of ctx carrying the session the request
+// was authenticated with
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session returns the current session, or nil if there is none
+func Session(ctx context.Context) *models.Session {
+	if session, ok := ctx.Value(sessionKey).(*models.Session); ok {
+		return session
+	}
+	return nil
+}
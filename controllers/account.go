@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Account Settings
+///////////////////////////////////////////////////////////////////////////////
+
+// ChangePasswordForm defines the expected JSON structure for changing the
+// password of the current user
+type ChangePasswordForm struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword sets a new password for the current user after checking
+// their current one. Every other session is revoked and this one gets a
+// fresh token. It must be wrapped in RequireUser.
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+	session := appctx.Session(r.Context())
+
+	var form ChangePasswordForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	err := u.UserService.ChangePassword(user, form.CurrentPassword, form.NewPassword, session.ID)
+	if err != nil {
+		writeAccountError(w, user, err)
+		return
+	}
+
+	if err := u.rotateSession(w, session); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The password is already changed, so a failure here is only logged
+	err = u.sendEmail(r.Context(), user.Email, "password_changed", map[string]string{
+		"Name":     user.Name,
+		"ResetURL": clientURL("/forgot-password", nil),
+	})
+	if err != nil {
+		log.Printf("Could not send password change notice to user %d: %v", user.ID, err)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Password changed successfully!"})
+}
+
+// ChangeEmailForm defines the expected JSON structure for changing the
+// email of the current user
+type ChangeEmailForm struct {
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// ChangeEmail starts moving the current user to a new email address. A
+// confirmation link is sent to the new address and a notice to the old
+// one; the account keeps the old address until the link is opened. It
+// must be wrapped in RequireUser.
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	var form ChangeEmailForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	newEmail, token, err := u.UserService.StartEmailChange(user, form.Password, form.Email)
+	if err != nil {
+		writeAccountError(w, user, err)
+		return
+	}
+
+	err = u.sendEmail(r.Context(), newEmail, "verify_email", map[string]string{
+		"Name":      user.Name,
+		"Email":     newEmail,
+		"URL":       clientURL("/verify-email", url.Values{"token": {token}}),
+		"ExpiresIn": humanDuration(config.EmailVerificationTimeout),
+	})
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The request stands without it, so a failure here is only logged
+	err = u.sendEmail(r.Context(), user.Email, "email_change_requested", map[string]string{
+		"Name":     user.Name,
+		"NewEmail": newEmail,
+		"ResetURL": clientURL("/forgot-password", nil),
+	})
+	if err != nil {
+		log.Printf("Could not send email change notice to user %d: %v", user.ID, err)
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Check " + newEmail + " for a link to confirm the change",
+	})
+}
+
+// writeAccountError responds to an error from changing the current user's
+// password or email. Rejected input is described to the client; anything
+// else is logged and reported as a server error.
+func writeAccountError(w http.ResponseWriter, user *models.User, err error) {
+	if writeInvalidInput(w, err) {
+		return
+	}
+	var throttled *models.ThrottledError
+	switch {
+	case err == models.ErrorIncorrectPassword:
+		writeJSONError(w, http.StatusUnauthorized, "Incorrect password")
+	case errors.Is(err, models.ErrorEmailTaken):
+		writeJSONError(w, http.StatusConflict, "Email address is already in use")
+	case errors.As(err, &throttled):
+		setRetryAfter(w, throttled.RetryAfter)
+		writeJSONError(w, http.StatusTooManyRequests, "Please wait before requesting another verification email")
+	default:
+		log.Printf("Could not update account of user %d: %v", user.ID, err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	}
+}
+
+// DeleteAccountForm defines the expected JSON structure for asking for the
+// current user's account to be deleted
+type DeleteAccountForm struct {
+	Password string `json:"password"`
+}
+
+// ScheduleDeletion schedules the current user's account for deletion
+// after a grace period, during which they can still sign in and cancel.
+// It must be wrapped in RequireUser.
+func (u *Users) ScheduleDeletion(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	var form DeleteAccountForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := u.UserService.ScheduleDeletion(user, form.Password); err != nil {
+		if err == models.ErrorIncorrectPassword {
+			writeJSONError(w, http.StatusUnauthorized, "Incorrect password")
+			return
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The deletion is scheduled either way, so a failure here is only logged
+	err := u.sendEmail(r.Context(), user.Email, "account_deletion_scheduled", map[string]string{
+		"Name":        user.Name,
+		"DeleteAfter": user.DeleteAfter.UTC().Format("January 2, 2006 at 15:04 MST"),
+		"URL":         clientURL("/account", nil),
+	})
+	if err != nil {
+		log.Printf("Could not send deletion notice to user %d: %v", user.ID, err)
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"message":      "Account scheduled for deletion",
+		"delete_after": user.DeleteAfter,
+	})
+}
+
+// CancelDeletion keeps the current user's account after they asked for it
+// to be deleted. It must be wrapped in RequireUser.
+func (u *Users) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	switch err := u.UserService.CancelDeletion(user); err {
+	case nil:
+	case models.ErrorDeletionNotPending:
+		writeJSONError(w, http.StatusConflict, "Account is not scheduled for deletion")
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Account deletion cancelled"})
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Gallery Downloads
+///////////////////////////////////////////////////////////////////////////////
+
+// DownloadEventResponse is the JSON representation of a gallery download
+type DownloadEventResponse struct {
+	ID          int64     `json:"id"`
+	UserID      *int64    `json:"user_id"`
+	ShareLinkID *int64    `json:"share_link_id"`
+	Size        string    `json:"size"`
+	Files       int       `json:"files"`
+	Bytes       int64     `json:"bytes"`
+	Completed   bool      `json:"completed"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newDownloadEventResponse(event *models.DownloadEvent) DownloadEventResponse {
+	return DownloadEventResponse{
+		ID:          event.ID,
+		UserID:      event.UserID,
+		ShareLinkID: event.ShareLinkID,
+		Size:        event.Size,
+		Files:       event.Files,
+		Bytes:       event.Bytes,
+		Completed:   event.Completed,
+		CreatedAt:   event.CreatedAt,
+	}
+}
+
+// Download streams every image of a gallery as a ZIP archive, built while
+// the files are read from storage. The size query parameter picks the
+// originals (the default) or a derivative size. Owners may always
+// download; other visitors need a share link that allows it.
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, v, ok := g.authorize(w, r, models.PermDownload)
+	if !ok {
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = models.DownloadOriginal
+	}
+	files, err := g.ImageService.DownloadFiles(gallery, size)
+	switch err {
+	case nil:
+	case models.ErrorDownloadSize:
+		writeJSONError(w, http.StatusBadRequest, "Unknown size")
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	event := models.DownloadEvent{
+		GalleryID: gallery.ID,
+		Size:      size,
+		Files:     len(files),
+		IP:        clientIP(r),
+	}
+	if user := appctx.User(r.Context()); user != nil {
+		event.UserID = &user.ID
+	}
+	if v.Link != nil {
+		event.ShareLinkID = &v.Link.ID
+	}
+	if err := g.ImageService.RecordDownload(&event); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, archiveName(gallery, size)))
+	w.WriteHeader(http.StatusOK)
+
+	// From here on the status is sent, so failures can only cut the
+	// archive short. A truncated ZIP has no central directory, which
+	// clients report as a broken download.
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		n, err := g.writeArchiveFile(r, zw, file)
+		event.Bytes += n
+		if err != nil {
+			log.Printf("Download of gallery %d stopped at %q: %v", gallery.ID, file.Name, err)
+			g.finishDownload(&event)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Download of gallery %d could not be finished: %v", gallery.ID, err)
+		g.finishDownload(&event)
+		return
+	}
+
+	event.Completed = true
+	g.finishDownload(&event)
+}
+
+// Downloads lists the downloads of a gallery for its owner
+func (g *Galleries) Downloads(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+
+	events, err := g.ImageService.Downloads(gallery)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]DownloadEventResponse, 0, len(events))
+	for i := range events {
+		response = append(response, newDownloadEventResponse(&events[i]))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// writeArchiveFile copies one file from storage into the archive and
+// returns how many bytes it wrote. Images are already compressed, so
+// files are stored rather than deflated.
+func (g *Galleries) writeArchiveFile(r *http.Request, zw *zip.Writer, file models.DownloadFile) (int64, error) {
+	rc, err := g.ImageService.OpenDownloadFile(r.Context(), file)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     file.Name,
+		Method:   zip.Store,
+		Modified: file.Modified,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(fw, rc)
+}
+
+// finishDownload records how a download ended
+func (g *Galleries) finishDownload(event *models.DownloadEvent) {
+	if err := g.ImageService.FinishDownload(event); err != nil {
+		log.Printf("Could not record download %d: %v", event.ID, err)
+	}
+}
+
+// archiveName builds the file name of a gallery download from its title,
+// keeping only characters that are safe in a Content-Disposition header
+func archiveName(gallery *models.Gallery, size string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == ' ' || r == '.':
+			return '-'
+		}
+		return -1
+	}, gallery.Title)
+	name = strings.Trim(name, "-")
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	if size != models.DownloadOriginal {
+		name += "-" + size
+	}
+	return name
+}
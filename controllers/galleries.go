@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/mailer"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Galleries Controller
+///////////////////////////////////////////////////////////////////////////////
+
+// Galleries controller struct to handle gallery-related routes. Handlers
+// that only view galleries are wrapped in MaybeUser, the rest in
+// RequireUser; each one checks access through authorizedGallery.
+type Galleries struct {
+	GalleryService   *models.GalleryService
+	ImageService     *models.ImageService
+	ShareLinkService *models.ShareLinkService
+	UploadService    *models.UploadService
+	UserService      *models.UserService
+	// Mailer tells photographers when a client submits a selection
+	Mailer mailer.Mailer
+}
+
+// Constructor for Galleries controller
+func NewGalleries(gs *models.GalleryService, is *models.ImageService, sls *models.ShareLinkService,
+	ups *models.UploadService, us *models.UserService, m mailer.Mailer) *Galleries {
+	return &Galleries{
+		GalleryService:   gs,
+		ImageService:     is,
+		ShareLinkService: sls,
+		UploadService:    ups,
+		UserService:      us,
+		Mailer:           m,
+	}
+}
+
+// GalleryForm defines the expected JSON structure for creating or
+// updating a gallery
+type GalleryForm struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Visibility is private, unlisted or public; left out, it stays as
+	// it was
+	Visibility string `json:"visibility"`
+	// ExifPolicy is keep, strip_location or strip_all; left out, it
+	// stays as it was
+	ExifPolicy string `json:"exif_policy"`
+}
+
+// GalleryResponse is the JSON representation of a gallery
+type GalleryResponse struct {
+	ID          int64  `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Visibility  string `json:"visibility"`
+	// Slug is only shown to the owner, who shares it to give access to
+	// an unlisted gallery
+	Slug       string    `json:"slug,omitempty"`
+	ExifPolicy string    `json:"exif_policy"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func newGalleryResponse(v models.Visitor, gallery *models.Gallery) GalleryResponse {
+	response := GalleryResponse{
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Description: gallery.Description,
+		Visibility:  gallery.Visibility,
+		ExifPolicy:  gallery.ExifPolicy,
+		CreatedAt:   gallery.CreatedAt,
+		UpdatedAt:   gallery.UpdatedAt,
+	}
+	if v.IsOwner(gallery) {
+		response.Slug = gallery.Slug
+	}
+	return response
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Gallery CRUD
+///////////////////////////////////////////////////////////////////////////////
+
+// Create makes a new gallery owned by the current user
+func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	var form GalleryForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	gallery := models.Gallery{
+		UserID:      user.ID,
+		Title:       form.Title,
+		Description: form.Description,
+		Visibility:  form.Visibility,
+		ExifPolicy:  form.ExifPolicy,
+	}
+	if !canPublish(w, user, &gallery) {
+		return
+	}
+	if err := g.GalleryService.DB.Create(&gallery); err != nil {
+		if writeInvalidInput(w, err) {
+			return
+		}
+		log.Printf("Could not create gallery for user %d: %v", user.ID, err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newGalleryResponse(visitor(r), &gallery))
+}
+
+// Index lists the galleries of the current user
+func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	galleries, err := g.GalleryService.DB.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, galleryResponses(visitor(r), galleries))
+}
+
+// Profile lists the public galleries of the user named by the {id} route
+// variable
+func (g *Galleries) Profile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		writeJSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	galleries, err := g.GalleryService.DB.PublicByUserID(id)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, galleryResponses(visitor(r), galleries))
+}
+
+// Show returns a single gallery the visitor may view
+func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermView)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newGalleryResponse(visitor(r), gallery))
+}
+
+// Update replaces the title and description of a gallery, and its
+// visibility and EXIF policy when they are given. Changing the policy
+// reprocesses the gallery's images in the background.
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+
+	var form GalleryForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	policy := gallery.ExifPolicy
+	gallery.Title = form.Title
+	gallery.Description = form.Description
+	if form.Visibility != "" {
+		gallery.Visibility = form.Visibility
+	}
+	if form.ExifPolicy != "" {
+		gallery.ExifPolicy = form.ExifPolicy
+	}
+	if !canPublish(w, appctx.User(r.Context()), gallery) {
+		return
+	}
+	if err := g.GalleryService.DB.Update(gallery); err != nil {
+		if writeInvalidInput(w, err) {
+			return
+		}
+		log.Printf("Could not update gallery %d: %v", gallery.ID, err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if gallery.ExifPolicy != policy {
+		if err := g.ImageService.ApplyExifPolicy(gallery); err != nil {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, newGalleryResponse(visitor(r), gallery))
+}
+
+// Delete soft-deletes a gallery
+func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+
+	if err := g.GalleryService.DB.Delete(gallery.ID); err != nil && err != models.ErrorNotFound {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Helper functions
+///////////////////////////////////////////////////////////////////////////////
+
+// galleryResponses converts a list of galleries for the API
+func galleryResponses(v models.Visitor, galleries []models.Gallery) []GalleryResponse {
+	response := make([]GalleryResponse, 0, len(galleries))
+	for i := range galleries {
+		response = append(response, newGalleryResponse(v, &galleries[i]))
+	}
+	return response
+}
+
+// canPublish checks that the user may give the gallery its visibility.
+// Only users with a verified email address may make galleries visible to
+// others. It writes the error response and returns false when they may
+// not.
+func canPublish(w http.ResponseWriter, user *models.User, gallery *models.Gallery) bool {
+	if gallery.Visibility == "" || gallery.Visibility == models.VisibilityPrivate {
+		return true
+	}
+	if err := user.RequireVerifiedEmail(); err != nil {
+		writeJSONError(w, http.StatusForbidden, "Email verification required")
+		return false
+	}
+	return true
+}
+
+// visitor describes who is making the request for Authorize
+func visitor(r *http.Request) models.Visitor {
+	_, bySlug := mux.Vars(r)["slug"]
+	return models.Visitor{
+		User:   appctx.User(r.Context()),
+		BySlug: bySlug,
+	}
+}
+
+// authorizedGallery loads the gallery named by the {id}, {slug} or
+// {token} route variable and checks that the visitor may do perm with it.
+// It writes the error response and returns false when the handler should
+// stop. Galleries the visitor cannot see are reported as not found so
+// their existence does not leak.
+func (g *Galleries) authorizedGallery(w http.ResponseWriter, r *http.Request, perm models.Permission) (*models.Gallery, bool) {
+	gallery, _, ok := g.authorize(w, r, perm)
+	return gallery, ok
+}
+
+// authorize is authorizedGallery that also returns the visitor, with the
+// share link they came by
+func (g *Galleries) authorize(w http.ResponseWriter, r *http.Request, perm models.Permission) (*models.Gallery, models.Visitor, bool) {
+	v := visitor(r)
+	vars := mux.Vars(r)
+
+	var gallery *models.Gallery
+	var err error
+	if token, ok := vars["token"]; ok {
+		v.Link, err = g.ShareLinkService.Open(token, r.Header.Get(sharePasswordHeader))
+		if err == nil {
+			gallery, err = g.GalleryService.DB.ByID(v.Link.GalleryID)
+		}
+	} else if v.BySlug {
+		gallery, err = g.GalleryService.DB.BySlug(vars["slug"])
+	} else {
+		id, perr := strconv.ParseInt(vars["id"], 10, 64)
+		if perr != nil || id <= 0 {
+			writeJSONError(w, http.StatusNotFound, "Gallery not found")
+			return nil, v, false
+		}
+		gallery, err = g.GalleryService.DB.ByID(id)
+	}
+	if err == nil {
+		err = models.Authorize(v, gallery, perm)
+	}
+
+	switch err {
+	case nil:
+		return gallery, v, true
+	case models.ErrorNotFound:
+		writeJSONError(w, http.StatusNotFound, "Gallery not found")
+	case models.ErrorPasswordRequired:
+		writeJSONError(w, http.StatusUnauthorized, "Password required")
+	case models.ErrorIncorrectPassword:
+		writeJSONError(w, http.StatusUnauthorized, "Incorrect password")
+	case models.ErrorForbidden:
+		writeJSONError(w, http.StatusForbidden, "You do not have permission for this gallery")
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	}
+	return nil, v, false
+}
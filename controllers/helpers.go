@@ -2,11 +2,93 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/models"
+	"github.com/pranav244872/lenslocked.com/realip"
 )
 
+// errNoSession is returned when a request carries no usable session
+var errNoSession = errors.New("controllers: no valid session")
+
 // parseJSON decodes the JSON body of a request into the
 // provided destination interface
 func parseJSON(r *http.Request, dst any) error {
 	return json.NewDecoder(r.Body).Decode(dst)
 }
+
+// clientIP returns the IP address of the client, looking through trusted
+// proxies
+func clientIP(r *http.Request) string {
+	return realip.FromRequest(r)
+}
+
+// writeJSON encodes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError responds with {"error": msg} and the given status
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// writeInvalidInput answers 400 with a message for errors caused by input
+// the models rejected, and reports whether err was one. Other errors are
+// left to the caller, which must not show them to the client.
+func writeInvalidInput(w http.ResponseWriter, err error) bool {
+	var invalid *models.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		writeJSONError(w, http.StatusBadRequest, invalid.Message)
+	case err == models.ErrorPasswordBreached:
+		writeJSONError(w, http.StatusBadRequest, "Password is too common or has appeared in a data breach")
+	default:
+		return false
+	}
+	return true
+}
+
+// clientURL builds a link into the client app, such as the page a
+// password reset email points to
+func clientURL(path string, query url.Values) string {
+	u := config.ClientOrigin + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// humanDuration formats d for emails, e.g. "1 hour" or "30 minutes"
+func humanDuration(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d >= 48*time.Hour && d%(24*time.Hour) == 0:
+		return plural(int64(d/(24*time.Hour)), "day")
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int64(d/time.Hour), "hour")
+	case d >= time.Minute:
+		return plural(int64(d/time.Minute), "minute")
+	default:
+		return plural(int64(d/time.Second), "second")
+	}
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounding up
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := int((d + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
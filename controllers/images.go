@@ -0,0 +1,387 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Gallery Images
+///////////////////////////////////////////////////////////////////////////////
+
+// ImageResponse is the JSON representation of an image
+type ImageResponse struct {
+	ID          int64     `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// URL links to the original file. It is empty while the file is
+	// still being stripped of metadata, which Processing reports, and for
+	// visitors who may not download originals.
+	URL        string `json:"url,omitempty"`
+	Processing bool   `json:"processing,omitempty"`
+
+	Metadata *MetadataResponse `json:"metadata,omitempty"`
+
+	// Derivatives are the resized copies of the image and SrcSet lists
+	// the ready ones, plus the original, in the format of the HTML srcset
+	// attribute
+	Derivatives []DerivativeResponse `json:"derivatives"`
+	SrcSet      string               `json:"srcset,omitempty"`
+}
+
+// DerivativeResponse is the JSON representation of a resized copy of an
+// image. URL, Width and Height are only set once it is ready.
+type DerivativeResponse struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// MetadataResponse is the JSON representation of an image's EXIF data
+type MetadataResponse struct {
+	CameraMake   string     `json:"camera_make,omitempty"`
+	CameraModel  string     `json:"camera_model,omitempty"`
+	LensModel    string     `json:"lens_model,omitempty"`
+	ExposureTime string     `json:"exposure_time,omitempty"`
+	FNumber      float64    `json:"f_number,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focal_length,omitempty"`
+	CapturedAt   *time.Time `json:"captured_at,omitempty"`
+	Location     *Location  `json:"location,omitempty"`
+}
+
+// Location is where a photo was taken
+type Location struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// newMetadataResponse converts image metadata for the API. The location
+// is left out unless the gallery keeps it in its files, and everything is
+// left out when the gallery strips all metadata.
+func newMetadataResponse(gallery *models.Gallery, md *models.ImageMetadata) *MetadataResponse {
+	if md == nil || gallery.ExifPolicy == models.ExifStripAll {
+		return nil
+	}
+	response := &MetadataResponse{
+		CameraMake:   md.CameraMake,
+		CameraModel:  md.CameraModel,
+		LensModel:    md.LensModel,
+		ExposureTime: md.ExposureTime,
+		FNumber:      md.FNumber,
+		ISO:          md.ISO,
+		FocalLength:  md.FocalLength,
+		CapturedAt:   md.CapturedAt,
+	}
+	if md.HasLocation() && gallery.ExifPolicy == models.ExifKeep {
+		response.Location = &Location{
+			Latitude:  *md.Latitude,
+			Longitude: *md.Longitude,
+			Altitude:  md.Altitude,
+		}
+	}
+	return response
+}
+
+// imageResponse builds the JSON representation of an image, including
+// signed links to its ready derivatives and, if original is set, to its
+// file
+func (g *Galleries) imageResponse(ctx context.Context, gallery *models.Gallery, image *models.Image,
+	derivatives []models.Derivative, metadata *models.ImageMetadata, original bool) (ImageResponse, error) {
+	response := ImageResponse{
+		ID:          image.ID,
+		Filename:    image.Filename,
+		ContentType: image.ContentType,
+		Size:        image.Size,
+		Width:       image.Width,
+		Height:      image.Height,
+		CreatedAt:   image.CreatedAt,
+		Metadata:    newMetadataResponse(gallery, metadata),
+		Derivatives: make([]DerivativeResponse, 0, len(derivatives)),
+	}
+
+	var u string
+	var err error
+	if original {
+		u, err = g.ImageService.URL(ctx, gallery, image)
+		switch err {
+		case nil:
+			response.URL = u
+		case models.ErrorImageProcessing:
+			response.Processing = true
+		case models.ErrorNotFound:
+			// Withheld because its metadata could not be stripped
+		default:
+			return ImageResponse{}, err
+		}
+	}
+
+	var srcset []string
+	widths := make(map[int]bool)
+	for i := range derivatives {
+		d := &derivatives[i]
+		dr := DerivativeResponse{Name: d.Name, Status: d.Status}
+		switch d.Status {
+		case models.DerivativeReady:
+			dr.URL, err = g.ImageService.DerivativeURL(ctx, d)
+			if err != nil {
+				return ImageResponse{}, err
+			}
+			dr.Width, dr.Height = d.Width, d.Height
+			dr.ContentType, dr.Size = d.ContentType, d.Size
+			if !widths[d.Width] {
+				widths[d.Width] = true
+				srcset = append(srcset, fmt.Sprintf("%s %dw", dr.URL, d.Width))
+			}
+		case models.DerivativeFailed:
+			dr.Error = d.Error
+		}
+		response.Derivatives = append(response.Derivatives, dr)
+	}
+	if len(srcset) > 0 && u != "" && image.Width > 0 && !widths[image.Width] {
+		srcset = append(srcset, fmt.Sprintf("%s %dw", u, image.Width))
+	}
+	response.SrcSet = strings.Join(srcset, ", ")
+	return response, nil
+}
+
+// loadImageResponse looks up the derivatives and metadata of a single
+// image and builds its JSON representation for the gallery's owner
+func (g *Galleries) loadImageResponse(ctx context.Context, gallery *models.Gallery, image *models.Image) (ImageResponse, error) {
+	derivatives, err := g.ImageService.Derivatives(image.ID)
+	if err != nil {
+		return ImageResponse{}, err
+	}
+	metadata, err := g.ImageService.Metadata(image.ID)
+	if err != nil {
+		return ImageResponse{}, err
+	}
+	return g.imageResponse(ctx, gallery, image, derivatives[image.ID], metadata[image.ID], true)
+}
+
+// UploadError explains why a single uploaded file was rejected
+type UploadError struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// UploadResponse lists the stored images and the rejected files of an
+// upload request
+type UploadResponse struct {
+	Images []ImageResponse `json:"images"`
+	Errors []UploadError   `json:"errors,omitempty"`
+}
+
+// UploadImages adds the files of a multipart/form-data request to a
+// gallery. Files are streamed to storage one part at a time, so they are
+// never held in memory whole. Rejected files do not stop the others; the
+// response is 201 when every file was stored and 422 otherwise.
+func (g *Galleries) UploadImages(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Expected a multipart/form-data upload")
+		return
+	}
+
+	response := UploadResponse{Images: []ImageResponse{}}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeUploadBodyError(w, err)
+			return
+		}
+		if part.FileName() == "" {
+			// Ignore ordinary form fields
+			part.Close()
+			continue
+		}
+
+		image, err := g.ImageService.Upload(r.Context(), gallery.ID, part.FileName(), part)
+		part.Close()
+		switch {
+		case err == nil:
+			ir, err := g.loadImageResponse(r.Context(), gallery, image)
+			if err != nil {
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			response.Images = append(response.Images, ir)
+		case err == models.ErrorNotAnImage:
+			response.Errors = append(response.Errors, UploadError{
+				Filename: part.FileName(),
+				Error:    "File is not a JPEG, PNG or GIF image",
+			})
+		case err == models.ErrorImageTooLarge:
+			response.Errors = append(response.Errors, UploadError{
+				Filename: part.FileName(),
+				Error:    fmt.Sprintf("File is larger than %d MB", config.MaxImageBytes>>20),
+			})
+		default:
+			writeUploadBodyError(w, err)
+			return
+		}
+	}
+
+	switch {
+	case len(response.Images) == 0 && len(response.Errors) == 0:
+		writeJSONError(w, http.StatusBadRequest, "No files were uploaded")
+	case len(response.Errors) > 0:
+		writeJSON(w, http.StatusUnprocessableEntity, response)
+	default:
+		writeJSON(w, http.StatusCreated, response)
+	}
+}
+
+// Images lists the images of a gallery. Links to the originals are only
+// included for visitors allowed to download them.
+func (g *Galleries) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, v, ok := g.authorize(w, r, models.PermView)
+	if !ok {
+		return
+	}
+	// Visitors who may not download only get the resized copies
+	original := models.Authorize(v, gallery, models.PermDownload) == nil
+
+	images, err := g.ImageService.DB.ByGalleryID(gallery.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]int64, len(images))
+	for i := range images {
+		ids[i] = images[i].ID
+	}
+	derivatives, err := g.ImageService.Derivatives(ids...)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	metadata, err := g.ImageService.Metadata(ids...)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]ImageResponse, 0, len(images))
+	for i := range images {
+		id := images[i].ID
+		ir, err := g.imageResponse(r.Context(), gallery, &images[i], derivatives[id], metadata[id], original)
+		if err != nil {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		response = append(response, ir)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// RetryDerivatives queues the failed and missing resized copies of an
+// image for generation again
+func (g *Galleries) RetryDerivatives(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+	image, ok := g.galleryImage(w, r, gallery)
+	if !ok {
+		return
+	}
+
+	if err := g.ImageService.RetryDerivatives(image); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := g.loadImageResponse(r.Context(), gallery, image)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+// DeleteImage removes an image and its file from a gallery
+func (g *Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+	image, ok := g.galleryImage(w, r, gallery)
+	if !ok {
+		return
+	}
+
+	if err := g.ImageService.Delete(r.Context(), image); err != nil && err != models.ErrorNotFound {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// galleryImage loads the image named by the {imageID} route variable and
+// checks that it belongs to gallery. It writes the error response and
+// returns false when the handler should stop.
+func (g *Galleries) galleryImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["imageID"], 10, 64)
+	if err != nil || id <= 0 {
+		writeJSONError(w, http.StatusNotFound, "Image not found")
+		return nil, false
+	}
+
+	image, err := g.ImageService.DB.ByID(id)
+	switch {
+	case err == models.ErrorNotFound || (err == nil && image.GalleryID != gallery.ID):
+		writeJSONError(w, http.StatusNotFound, "Image not found")
+		return nil, false
+	case err != nil:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+	return image, true
+}
+
+// writeUploadBodyError reports a failure to read the upload request itself
+func writeUploadBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeJSONError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Upload is larger than %d MB", config.MaxUploadBytes>>20))
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		writeJSONError(w, http.StatusBadRequest, "Malformed multipart body")
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"net/http"
+
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Authentication Middleware
+///////////////////////////////////////////////////////////////////////////////
+
+// Auth resolves the remember token cookie into the current session and
+// user and stores both in the request context.
+type Auth struct {
+	UserService    *models.UserService
+	SessionService *models.SessionService
+}
+
+// Constructor for Auth middleware
+func NewAuth(us *models.UserService, ss *models.SessionService) *Auth {
+	return &Auth{
+		UserService:    us,
+		SessionService: ss,
+	}
+}
+
+// MaybeUser adds the user to the request context when a valid session
+// cookie is present and otherwise lets the request through untouched.
+func (a *Auth) MaybeUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := a.authenticate(w, r)
+		if err != nil && err != errNoSession {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireUser only lets the request through when it carries a valid
+// session and responds with a 401 JSON error otherwise.
+func (a *Auth) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := a.authenticate(w, r)
+		switch err {
+		case nil:
+			next.ServeHTTP(w, r)
+		case errNoSession:
+			writeJSONError(w, http.StatusUnauthorized, "Authentication required")
+		default:
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+	})
+}
+
+// RequireVerifiedUser is RequireUser for actions that also need a
+// verified email address, such as publishing galleries. Unverified users
+// get a 403 JSON error.
+func (a *Auth) RequireVerifiedUser(next http.Handler) http.Handler {
+	return a.RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := appctx.User(r.Context())
+		if err := user.RequireVerifiedEmail(); err != nil {
+			writeJSONError(w, http.StatusForbidden, "Email verification required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// MaybeUserFn is MaybeUser for a plain handler function
+func (a *Auth) MaybeUserFn(next http.HandlerFunc) http.Handler {
+	return a.MaybeUser(next)
+}
+
+// RequireUserFn is RequireUser for a plain handler function
+func (a *Auth) RequireUserFn(next http.HandlerFunc) http.Handler {
+	return a.RequireUser(next)
+}
+
+// RequireVerifiedUserFn is RequireVerifiedUser for a plain handler function
+func (a *Auth) RequireVerifiedUserFn(next http.HandlerFunc) http.Handler {
+	return a.RequireVerifiedUser(next)
+}
+
+// authenticate looks up the session and user for the request. Invalid or
+// expired cookies are cleared and reported as errNoSession.
+func (a *Auth) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	cookie, err := r.Cookie(rememberCookie)
+	if err != nil || cookie.Value == "" {
+		return r, errNoSession
+	}
+
+	session, err := a.SessionService.DB.ByToken(cookie.Value)
+	switch err {
+	case nil:
+	case models.ErrorNotFound, models.ErrorSessionExpired:
+		clearRememberCookie(w)
+		return r, errNoSession
+	default:
+		return r, err
+	}
+
+	user, err := a.UserService.DB.ByID(session.UserID)
+	switch err {
+	case nil:
+	case models.ErrorNotFound:
+		clearRememberCookie(w)
+		return r, errNoSession
+	default:
+		return r, err
+	}
+
+	ctx := appctx.WithSession(r.Context(), session)
+	ctx = appctx.WithUser(ctx, user)
+	return r.WithContext(ctx), nil
+}
@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pranav244872/lenslocked.com/mailer"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Client Proofing
+///////////////////////////////////////////////////////////////////////////////
+
+// SelectionForm defines the expected JSON structure for changing the
+// selection of one image. Fields left out stay as they were.
+type SelectionForm struct {
+	Picked *bool   `json:"picked"`
+	Note   *string `json:"note"`
+}
+
+// SelectionItemResponse is the JSON representation of what a client made
+// of one image
+type SelectionItemResponse struct {
+	ImageID   int64     `json:"image_id"`
+	Picked    bool      `json:"picked"`
+	Note      string    `json:"note"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newSelectionItemResponse(selection *models.Selection) SelectionItemResponse {
+	return SelectionItemResponse{
+		ImageID:   selection.ImageID,
+		Picked:    selection.Picked,
+		Note:      selection.Note,
+		UpdatedAt: selection.UpdatedAt,
+	}
+}
+
+// SelectionResponse is the JSON representation of the selection made
+// through a share link
+type SelectionResponse struct {
+	// MaxPicks is 0 when there is no limit
+	MaxPicks    int                     `json:"max_picks"`
+	Picks       int                     `json:"picks"`
+	SubmittedAt *time.Time              `json:"submitted_at"`
+	Items       []SelectionItemResponse `json:"items"`
+}
+
+// Selection returns the selection made through the share link named by
+// the {token} route variable
+func (g *Galleries) Selection(w http.ResponseWriter, r *http.Request) {
+	_, v, ok := g.authorize(w, r, models.PermView)
+	if !ok {
+		return
+	}
+	g.writeSelection(w, v.Link)
+}
+
+// Select changes the selection of the image named by the {imageID} route
+// variable. It fails with 409 once the selection has been submitted and
+// with 422 when the link's maximum number of picks is reached.
+func (g *Galleries) Select(w http.ResponseWriter, r *http.Request) {
+	_, v, ok := g.authorize(w, r, models.PermView)
+	if !ok {
+		return
+	}
+
+	imageID, err := strconv.ParseInt(mux.Vars(r)["imageID"], 10, 64)
+	if err != nil || imageID <= 0 {
+		writeJSONError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+
+	var form SelectionForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	selection, err := g.ShareLinkService.Select(v.Link, imageID, models.SelectionChange{
+		Picked: form.Picked,
+		Note:   form.Note,
+	})
+	switch err {
+	case nil:
+	case models.ErrorNotFound:
+		writeJSONError(w, http.StatusNotFound, "Image not found")
+		return
+	case models.ErrorSelectionSubmitted:
+		writeJSONError(w, http.StatusConflict, "Selection has already been submitted")
+		return
+	case models.ErrorTooManyPicks:
+		writeJSONError(w, http.StatusUnprocessableEntity,
+			fmt.Sprintf("You can pick at most %d images", v.Link.MaxPicks))
+		return
+	default:
+		if writeInvalidInput(w, err) {
+			return
+		}
+		log.Printf("Could not save selection of image %d through share link %d: %v", imageID, v.Link.ID, err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newSelectionItemResponse(selection))
+}
+
+// SubmitSelection locks the selection made through a share link and lets
+// the photographer know by email
+func (g *Galleries) SubmitSelection(w http.ResponseWriter, r *http.Request) {
+	gallery, v, ok := g.authorize(w, r, models.PermView)
+	if !ok {
+		return
+	}
+
+	switch err := g.ShareLinkService.Submit(v.Link); err {
+	case nil:
+	case models.ErrorSelectionSubmitted:
+		writeJSONError(w, http.StatusConflict, "Selection has already been submitted")
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The selection is saved either way, so a failure here is only logged
+	if err := g.notifySubmitted(r.Context(), gallery, v.Link); err != nil {
+		log.Printf("Could not send selection email for share link %d: %v", v.Link.ID, err)
+	}
+
+	g.writeSelection(w, v.Link)
+}
+
+// LinkSelection shows the owner the selection made through one of their
+// share links
+func (g *Galleries) LinkSelection(w http.ResponseWriter, r *http.Request) {
+	link, ok := g.ownedShareLink(w, r)
+	if !ok {
+		return
+	}
+	g.writeSelection(w, link)
+}
+
+// ExportSelection sends the owner the filenames of the images picked
+// through a share link as a CSV file, with the client's notes
+func (g *Galleries) ExportSelection(w http.ResponseWriter, r *http.Request) {
+	link, ok := g.ownedShareLink(w, r)
+	if !ok {
+		return
+	}
+
+	picked, err := g.ShareLinkService.Picked(link)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="selection-%d.csv"`, link.ID))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"filename", "note"})
+	for _, p := range picked {
+		cw.Write([]string{csvSafe(p.Filename), csvSafe(p.Note)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Could not write selection export for share link %d: %v", link.ID, err)
+	}
+}
+
+// ReopenSelection lifts the submission lock of a share link so the client
+// can change their selection again
+func (g *Galleries) ReopenSelection(w http.ResponseWriter, r *http.Request) {
+	link, ok := g.ownedShareLink(w, r)
+	if !ok {
+		return
+	}
+
+	if err := g.ShareLinkService.Reopen(link); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.writeSelection(w, link)
+}
+
+// writeSelection responds with the selection made through a share link
+func (g *Galleries) writeSelection(w http.ResponseWriter, link *models.ShareLink) {
+	selections, err := g.ShareLinkService.Selections(link)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response := SelectionResponse{
+		MaxPicks:    link.MaxPicks,
+		SubmittedAt: link.SubmittedAt,
+		Items:       make([]SelectionItemResponse, 0, len(selections)),
+	}
+	for i := range selections {
+		if selections[i].Picked {
+			response.Picks++
+		}
+		response.Items = append(response.Items, newSelectionItemResponse(&selections[i]))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// notifySubmitted emails the owner of a gallery that a client submitted
+// their selection
+func (g *Galleries) notifySubmitted(ctx context.Context, gallery *models.Gallery, link *models.ShareLink) error {
+	owner, err := g.UserService.DB.ByID(gallery.UserID)
+	if err != nil {
+		return err
+	}
+	picked, err := g.ShareLinkService.Picked(link)
+	if err != nil {
+		return err
+	}
+
+	msg, err := mailer.NewMessage(owner.Email, "selection_submitted", map[string]any{
+		"Name":    owner.Name,
+		"Gallery": gallery.Title,
+		"Label":   link.Label,
+		"Picks":   len(picked),
+		"URL":     clientURL(fmt.Sprintf("/galleries/%d/links/%d/selection", gallery.ID, link.ID), nil),
+	})
+	if err != nil {
+		return err
+	}
+	return g.Mailer.Send(ctx, msg)
+}
+
+// ownedShareLink loads the share link named by the {linkID} route
+// variable, checking that it belongs to a gallery the current user owns.
+// It writes the error response and returns false when the handler should
+// stop.
+func (g *Galleries) ownedShareLink(w http.ResponseWriter, r *http.Request) (*models.ShareLink, bool) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return nil, false
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["linkID"], 10, 64)
+	if err != nil || id <= 0 {
+		writeJSONError(w, http.StatusNotFound, "Share link not found")
+		return nil, false
+	}
+	link, err := g.ShareLinkService.DB.ByID(id)
+	if err == models.ErrorNotFound || (err == nil && link.GalleryID != gallery.ID) {
+		writeJSONError(w, http.StatusNotFound, "Share link not found")
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+	return link, true
+}
+
+// csvSafe stops spreadsheet apps from running a cell as a formula.
+// Filenames and notes come from clients, so they cannot be trusted.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+// sharePasswordHeader carries the password of a password-protected share
+// link on every request made through it
+const sharePasswordHeader = "X-Share-Password"
+
+///////////////////////////////////////////////////////////////////////////////
+// Share Links
+///////////////////////////////////////////////////////////////////////////////
+
+// ShareLinkForm defines the expected JSON structure for creating a share
+// link
+type ShareLinkForm struct {
+	Label string `json:"label"`
+	// ExpiresAt is left out for links that never expire
+	ExpiresAt     *time.Time `json:"expires_at"`
+	AllowDownload bool       `json:"allow_download"`
+	// MaxPicks caps how many images the client may pick; 0 or left out is
+	// no limit
+	MaxPicks int `json:"max_picks"`
+	// Password is left out for links anyone holding them can open
+	Password string `json:"password"`
+}
+
+// ShareLinkResponse is the JSON representation of a share link. The token
+// and the URL built from it are only known when the link is created.
+type ShareLinkResponse struct {
+	ID            int64      `json:"id"`
+	Token         string     `json:"token,omitempty"`
+	URL           string     `json:"url,omitempty"`
+	Label         string     `json:"label"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	Expired       bool       `json:"expired"`
+	AllowDownload bool       `json:"allow_download"`
+	HasPassword   bool       `json:"has_password"`
+	MaxPicks      int        `json:"max_picks"`
+	SubmittedAt   *time.Time `json:"submitted_at"`
+	Views         int64      `json:"views"`
+	LastViewedAt  *time.Time `json:"last_viewed_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func newShareLinkResponse(link *models.ShareLink) ShareLinkResponse {
+	response := ShareLinkResponse{
+		ID:            link.ID,
+		Token:         link.Token,
+		Label:         link.Label,
+		ExpiresAt:     link.ExpiresAt,
+		Expired:       link.Expired(time.Now()),
+		AllowDownload: link.AllowDownload,
+		HasPassword:   link.HasPassword(),
+		MaxPicks:      link.MaxPicks,
+		SubmittedAt:   link.SubmittedAt,
+		Views:         link.Views,
+		LastViewedAt:  link.LastViewedAt,
+		CreatedAt:     link.CreatedAt,
+	}
+	if link.Token != "" {
+		response.URL = clientURL("/share/"+link.Token, nil)
+	}
+	return response
+}
+
+// SharedGalleryResponse is a gallery as seen through a share link
+type SharedGalleryResponse struct {
+	GalleryResponse
+	AllowDownload bool `json:"allow_download"`
+	// MaxPicks and SubmittedAt describe the client's selection
+	MaxPicks    int        `json:"max_picks"`
+	SubmittedAt *time.Time `json:"submitted_at"`
+}
+
+// CreateShareLink makes a new share link for a gallery. The response is
+// the only place its token is shown.
+func (g *Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+
+	var form ShareLinkForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	link := models.ShareLink{
+		GalleryID:     gallery.ID,
+		Label:         form.Label,
+		ExpiresAt:     form.ExpiresAt,
+		AllowDownload: form.AllowDownload,
+		MaxPicks:      form.MaxPicks,
+		Password:      form.Password,
+	}
+	if err := g.ShareLinkService.DB.Create(&link); err != nil {
+		if writeInvalidInput(w, err) {
+			return
+		}
+		log.Printf("Could not create share link for gallery %d: %v", gallery.ID, err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newShareLinkResponse(&link))
+}
+
+// ShareLinks lists the share links of a gallery, expired ones included
+func (g *Galleries) ShareLinks(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+
+	links, err := g.ShareLinkService.DB.ByGalleryID(gallery.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]ShareLinkResponse, 0, len(links))
+	for i := range links {
+		response = append(response, newShareLinkResponse(&links[i]))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// RevokeShareLink deletes a share link and the selection made through
+// it, so its token stops working at once
+func (g *Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := g.ownedShareLink(w, r)
+	if !ok {
+		return
+	}
+
+	if err := g.ShareLinkService.Revoke(link); err != nil && err != models.ErrorNotFound {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SharedGallery shows a gallery to a visitor holding a share link and
+// counts the visit. The images are listed by Images on the same link.
+func (g *Galleries) SharedGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, v, ok := g.authorize(w, r, models.PermView)
+	if !ok {
+		return
+	}
+
+	if err := g.ShareLinkService.DB.RecordView(v.Link.ID); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SharedGalleryResponse{
+		GalleryResponse: newGalleryResponse(v, gallery),
+		AllowDownload:   v.Link.AllowDownload,
+		MaxPicks:        v.Link.MaxPicks,
+		SubmittedAt:     v.Link.SubmittedAt,
+	})
+}
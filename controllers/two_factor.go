@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/models"
+	"github.com/pranav244872/lenslocked.com/totp"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Two-Factor Login
+///////////////////////////////////////////////////////////////////////////////
+
+// TwoFactorLoginForm defines the expected JSON structure for the second
+// step of a two-factor login. Code may be a TOTP or a recovery code.
+type TwoFactorLoginForm struct {
+	PendingToken string `json:"pending_token"`
+	Code         string `json:"code"`
+}
+
+// LoginTwoFactor finishes a login started by Login for a user with
+// two-factor authentication enabled. Wrong codes count as failed logins,
+// so the account and IP lockouts cover the second factor too.
+func (u *Users) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorLoginForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	pending, err := u.UserService.TwoFactorUser(form.PendingToken)
+	switch err {
+	case nil:
+	case models.ErrorNotFound:
+		http.Error(w, "Login expired, please sign in again", http.StatusUnauthorized)
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := u.loginLockedFor(pending.Email, ip)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many failed login attempts, please try again later")
+		return
+	}
+
+	user, err := u.UserService.CompleteTwoFactor(form.PendingToken, form.Code)
+	if err != nil {
+		switch err {
+		case models.ErrorIncorrectCode:
+			if err := u.recordLoginFailure(r.Context(), pending.Email, ip); err != nil {
+				log.Printf("Could not record failed login: %v", err)
+			}
+			http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		case models.ErrorNotFound:
+			http.Error(w, "Login expired, please sign in again", http.StatusUnauthorized)
+		default:
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := u.AccountLimiter.Reset(user.Email); err != nil {
+		log.Printf("Could not reset failed logins for user %d: %v", user.ID, err)
+	}
+
+	if err := u.signIn(w, r, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful!"})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Two-Factor Enrollment
+///////////////////////////////////////////////////////////////////////////////
+
+// TwoFactorSetupResponse carries what an authenticator app needs
+type TwoFactorSetupResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// SetupTwoFactor generates a TOTP secret for the current user. It must be
+// wrapped in RequireUser.
+func (u *Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	secret, err := u.UserService.SetupTOTP(user)
+	if err != nil {
+		if err == models.ErrorTwoFactorEnabled {
+			writeJSONError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+			return
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TwoFactorSetupResponse{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(config.TOTPIssuer, user.Email, secret),
+	})
+}
+
+// TwoFactorCodeForm defines the expected JSON structure for confirming or
+// disabling two-factor authentication
+type TwoFactorCodeForm struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// ConfirmTwoFactor enables two-factor authentication once the user enters
+// a valid code and returns their recovery codes. It must be wrapped in
+// RequireUser.
+func (u *Users) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	var form TwoFactorCodeForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := u.UserService.ConfirmTOTP(user, form.Code)
+	if err != nil {
+		switch err {
+		case models.ErrorIncorrectCode:
+			writeJSONError(w, http.StatusUnprocessableEntity, "Invalid two-factor code")
+		case models.ErrorTwoFactorEnabled:
+			writeJSONError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		case models.ErrorTwoFactorNotSetUp:
+			writeJSONError(w, http.StatusConflict, "Two-factor authentication has not been set up")
+		default:
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := u.rotateSession(w, appctx.Session(r.Context())); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"message":        "Two-factor authentication enabled!",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor turns two-factor authentication off. It must be
+// wrapped in RequireUser.
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	var form TwoFactorCodeForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := u.UserService.DisableTOTP(user, form.Password, form.Code); err != nil {
+		switch err {
+		case models.ErrorIncorrectPassword:
+			writeJSONError(w, http.StatusUnauthorized, "Incorrect password")
+		case models.ErrorIncorrectCode:
+			writeJSONError(w, http.StatusUnauthorized, "Invalid two-factor code")
+		case models.ErrorTwoFactorNotSetUp:
+			writeJSONError(w, http.StatusConflict, "Two-factor authentication is not enabled")
+		default:
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := u.rotateSession(w, appctx.Session(r.Context())); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pranav244872/lenslocked.com/config"
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+// tus protocol constants
+const (
+	tusVersion      = "1.0.0"
+	tusExtensions   = "creation,termination,expiration"
+	tusContentType  = "application/offset+octet-stream"
+	tusResumableHdr = "Tus-Resumable"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Resumable Uploads (tus 1.0)
+///////////////////////////////////////////////////////////////////////////////
+
+// UploadOptions describes the server's tus support
+func (g *Galleries) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(tusResumableHdr, tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxImageBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload of one image into a gallery. The
+// file's size comes in the Upload-Length header and its name in the
+// filename entry of Upload-Metadata.
+func (g *Galleries) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Upload-Length is required")
+		return
+	}
+	if length <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "Upload-Length must be positive")
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid Upload-Metadata")
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	upload := models.ResumableUpload{
+		GalleryID: gallery.ID,
+		UserID:    appctx.User(r.Context()).ID,
+		Filename:  filename,
+		Length:    length,
+	}
+	switch err := g.UploadService.Create(&upload); err {
+	case nil:
+	case models.ErrorImageTooLarge:
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Image is too large")
+		return
+	default:
+		log.Printf("Could not create upload in gallery %d: %v", gallery.ID, err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/galleries/%d/uploads/%s", gallery.ID, upload.ID))
+	setUploadExpires(w, &upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadStatus reports how much of an upload has been received, so the
+// client knows where to resume
+func (g *Galleries) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	upload, ok := g.galleryUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// WriteUpload appends the request body to an upload at the offset given
+// in Upload-Offset. The request that completes the upload also stores the
+// image.
+func (g *Galleries) WriteUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeJSONError(w, http.StatusBadRequest, "Upload-Offset is required")
+		return
+	}
+	upload, ok := g.galleryUpload(w, r)
+	if !ok {
+		return
+	}
+	if r.ContentLength > 0 && offset+r.ContentLength > upload.Length {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Data goes past Upload-Length")
+		return
+	}
+
+	err = g.UploadService.Write(r.Context(), upload, offset, r.Body)
+	switch {
+	case err == nil:
+	case err == models.ErrorNotFound:
+		writeJSONError(w, http.StatusNotFound, "Upload not found")
+		return
+	case err == models.ErrorUploadOffset:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+		writeJSONError(w, http.StatusConflict, "Upload-Offset does not match the upload")
+		return
+	case err == models.ErrorUploadBusy:
+		writeJSONError(w, http.StatusLocked, "Upload is busy")
+		return
+	case errors.Is(err, models.ErrorNotAnImage):
+		writeJSONError(w, http.StatusUnsupportedMediaType, "File is not a supported image")
+		return
+	case errors.Is(err, models.ErrorImageTooLarge):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Image is too large")
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TerminateUpload stops an upload and deletes what was received
+func (g *Galleries) TerminateUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	upload, ok := g.galleryUpload(w, r)
+	if !ok {
+		return
+	}
+
+	switch err := g.UploadService.Terminate(upload); err {
+	case nil:
+	case models.ErrorUploadBusy:
+		writeJSONError(w, http.StatusLocked, "Upload is busy")
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// galleryUpload loads the upload named by the {uploadID} route variable,
+// checking that the current user started it in a gallery they may edit.
+// It writes the error response and returns false when the handler should
+// stop.
+func (g *Galleries) galleryUpload(w http.ResponseWriter, r *http.Request) (*models.ResumableUpload, bool) {
+	gallery, ok := g.authorizedGallery(w, r, models.PermEdit)
+	if !ok {
+		return nil, false
+	}
+
+	upload, err := g.UploadService.DB.ByID(mux.Vars(r)["uploadID"])
+	user := appctx.User(r.Context())
+	if err == models.ErrorNotFound || (err == nil && (upload.GalleryID != gallery.ID || upload.UserID != user.ID)) {
+		writeJSONError(w, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+	return upload, true
+}
+
+// checkTusVersion sets the Tus-Resumable response header and checks that
+// the client speaks the same protocol version. It writes the error
+// response and returns false when it does not.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set(tusResumableHdr, tusVersion)
+	if r.Header.Get(tusResumableHdr) != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return false
+	}
+	return true
+}
+
+// setUploadExpires tells the client until when an upload can be resumed
+func setUploadExpires(w http.ResponseWriter, upload *models.ResumableUpload) {
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma-separated
+// pairs of a key and an optional base64-encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
@@ -1,10 +1,19 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/pranav244872/lenslocked.com/config"
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/lockout"
+	"github.com/pranav244872/lenslocked.com/mailer"
 	"github.com/pranav244872/lenslocked.com/models"
 )
 
@@ -12,15 +21,47 @@ import (
 // Users Controller
 ///////////////////////////////////////////////////////////////////////////////
 
+// rememberCookie is the name of the cookie holding the session token
+const rememberCookie = "remember_token"
+
 // Users controller struct to handle user-related routes
 type Users struct {
-	UserService *models.UserService
+	UserService    *models.UserService
+	SessionService *models.SessionService
+	Mailer         mailer.Mailer
+
+	// Failed logins are counted per account and per IP
+	AccountLimiter *lockout.Limiter
+	IPLimiter      *lockout.Limiter
 }
 
-// Constructor for Users controller
-func NewUsers(us *models.UserService) *Users {
+// Constructor for Users controller. attempts stores the login failure
+// counters.
+func NewUsers(us *models.UserService, ss *models.SessionService, m mailer.Mailer, attempts lockout.Store) *Users {
 	return &Users{
-		UserService: us,
+		UserService:    us,
+		SessionService: ss,
+		Mailer:         m,
+		AccountLimiter: &lockout.Limiter{
+			Store:  attempts,
+			Prefix: "account:",
+			Policy: lockout.Policy{
+				Threshold:  config.LoginAccountThreshold,
+				BaseDelay:  config.LoginLockoutBase,
+				MaxDelay:   config.LoginLockoutMax,
+				ResetAfter: config.LoginFailureWindow,
+			},
+		},
+		IPLimiter: &lockout.Limiter{
+			Store:  attempts,
+			Prefix: "ip:",
+			Policy: lockout.Policy{
+				Threshold:  config.LoginIPThreshold,
+				BaseDelay:  config.LoginLockoutBase,
+				MaxDelay:   config.LoginLockoutMax,
+				ResetAfter: config.LoginFailureWindow,
+			},
+		},
 	}
 }
 
@@ -62,11 +103,16 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// automatically sign the user in after they create an account
-	if err := u.signIn(w, &user); err != nil {
+	if err := u.signIn(w, r, &user); err != nil {
 		http.Error(w, "Something went wrong during sign-in", http.StatusInternalServerError)
 		return
 	}
 
+	// The account works without it, so a failure here is only logged
+	if err := u.sendVerification(r.Context(), &user); err != nil {
+		log.Printf("Could not send verification email to user %d: %v", user.ID, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User created and logged in successfully!"})
@@ -90,11 +136,28 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := u.UserService.Authenticate(form.Email, form.Password)
+	email := strings.ToLower(strings.TrimSpace(form.Email))
+	ip := clientIP(r)
+
+	wait, err := u.loginLockedFor(email, ip)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many failed login attempts, please try again later")
+		return
+	}
+
+	user, err := u.UserService.Authenticate(email, form.Password)
 	if err != nil {
 		// 3. Relay the Result
 		switch err {
 		case models.ErrorNotFound, models.ErrorIncorrectPassword:
+			if err := u.recordLoginFailure(r.Context(), email, ip); err != nil {
+				log.Printf("Could not record failed login: %v", err)
+			}
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		default:
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -102,7 +165,28 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := u.signIn(w, user); err != nil {
+	// Users with two-factor authentication get a pending token instead of
+	// a session and finish with LoginTwoFactor. Their failed logins are
+	// only forgotten once the second factor is right too.
+	if user.TOTPEnabled {
+		token, err := u.UserService.StartTwoFactor(user)
+		if err != nil {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"message":             "Two-factor code required",
+			"two_factor_required": true,
+			"pending_token":       token,
+		})
+		return
+	}
+
+	if err := u.AccountLimiter.Reset(email); err != nil {
+		log.Printf("Could not reset failed logins for user %d: %v", user.ID, err)
+	}
+
+	if err := u.signIn(w, r, user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -113,33 +197,241 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 }
 
 ///////////////////////////////////////////////////////////////////////////////
-// User Cookie Test
+// User Logout
 ///////////////////////////////////////////////////////////////////////////////
 
-type UserResponse struct {
-	ID    int64  `json:"id"`
-	Name  string `json:"name"`
+// Logout ends the session the request was made with. Other devices stay
+// signed in. It must be wrapped in RequireUser.
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	session := appctx.Session(r.Context())
+
+	if err := u.SessionService.DB.Delete(session.ID); err != nil && err != models.ErrorNotFound {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	clearRememberCookie(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully!"})
+}
+
+// LogoutAll revokes every session of the current user, including the one
+// the request was made with. It must be wrapped in RequireUser.
+func (u *Users) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	if err := u.SessionService.DB.DeleteByUserID(user.ID); err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	clearRememberCookie(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out of all devices successfully!"})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Password Reset
+///////////////////////////////////////////////////////////////////////////////
+
+// ForgotPasswordForm defines the expected JSON structure for requesting a
+// password reset
+type ForgotPasswordForm struct {
 	Email string `json:"email"`
 }
 
-// CookieTest acts as a protected endpoint to verify a user's session.
-func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// ForgotPassword starts a password reset. It answers the same way whether
+// or not the email belongs to an account.
+func (u *Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var form ForgotPasswordForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, token, err := u.UserService.InitiateReset(form.Email)
+	switch err {
+	case nil:
+		err = u.sendEmail(r.Context(), user.Email, "password_reset", map[string]string{
+			"Name":      user.Name,
+			"URL":       clientURL("/reset-password", url.Values{"token": {token}}),
+			"ExpiresIn": humanDuration(config.PasswordResetTimeout),
+		})
+		if err != nil {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	case models.ErrorNotFound:
+		// Do not reveal whether the email is registered
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "If an account exists for that email, a reset link has been sent."})
+}
+
+// ResetPasswordForm defines the expected JSON structure for completing a
+// password reset. Code is a TOTP or recovery code, required for users with
+// two-factor login.
+type ResetPasswordForm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// ResetPassword sets a new password using a reset token, revokes every
+// existing session and signs the user in on this device. Users with
+// two-factor login must send a code along with the new password; wrong
+// codes count as failed logins.
+func (u *Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var form ResetPasswordForm
+	if err := parseJSON(r, &form); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	pending, err := u.UserService.ResetUser(form.Token)
+	switch err {
+	case nil:
+	case models.ErrorNotFound:
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	ip := clientIP(r)
+	if pending.TOTPEnabled {
+		wait, err := u.loginLockedFor(pending.Email, ip)
+		if err != nil {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			setRetryAfter(w, wait)
+			writeJSONError(w, http.StatusTooManyRequests, "Too many failed login attempts, please try again later")
+			return
+		}
+	}
+
+	user, err := u.UserService.CompleteReset(form.Token, form.Password, form.Code)
 	if err != nil {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		switch {
+		case err == models.ErrorNotFound:
+			http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		case err == models.ErrorCodeRequired:
+			writeJSON(w, http.StatusUnauthorized, map[string]any{
+				"error":               "Two-factor code required",
+				"two_factor_required": true,
+			})
+		case err == models.ErrorIncorrectCode:
+			if err := u.recordLoginFailure(r.Context(), pending.Email, ip); err != nil {
+				log.Printf("Could not record failed login: %v", err)
+			}
+			http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		default:
+			if writeInvalidInput(w, err) {
+				return
+			}
+			log.Printf("Could not complete password reset: %v", err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if user.TOTPEnabled {
+		if err := u.AccountLimiter.Reset(user.Email); err != nil {
+			log.Printf("Could not reset failed logins for user %d: %v", user.ID, err)
+		}
+	}
+
+	if err := u.signIn(w, r, user); err != nil {
+		http.Error(w, "Something went wrong during sign-in", http.StatusInternalServerError)
 		return
 	}
 
-	user, err := u.UserService.DB.ByRememberToken(cookie.Value)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully!"})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Email Verification
+///////////////////////////////////////////////////////////////////////////////
+
+// VerifyEmail confirms the address a verification link was sent to,
+// completing an email change if the link was for one. The token is read
+// from the "token" query parameter.
+func (u *Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	_, err := u.UserService.VerifyEmail(r.URL.Query().Get("token"))
 	if err != nil {
-		http.Error(w, "Invalid session token", http.StatusUnauthorized)
+		if err == models.ErrorNotFound {
+			http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, models.ErrorEmailTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified successfully!"})
+}
+
+// ResendVerification sends a new verification link to the current user.
+// It must be wrapped in RequireUser.
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
+	err := u.sendVerification(r.Context(), user)
+	var throttled *models.ThrottledError
+	switch {
+	case err == nil:
+	case errors.As(err, &throttled):
+		setRetryAfter(w, throttled.RetryAfter)
+		writeJSONError(w, http.StatusTooManyRequests, "Please wait before requesting another verification email")
+		return
+	case err == models.ErrorEmailVerified:
+		writeJSONError(w, http.StatusConflict, "Email is already verified")
+		return
+	default:
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent!"})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// User Cookie Test
+///////////////////////////////////////////////////////////////////////////////
+
+type UserResponse struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	// DeleteAfter is set while the account is scheduled for deletion
+	DeleteAfter *time.Time `json:"delete_after,omitempty"`
+}
+
+// CookieTest acts as a protected endpoint to verify a user's session.
+// It must be wrapped in RequireUser.
+func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
+	user := appctx.User(r.Context())
+
 	response := UserResponse{
-		ID:    user.ID,
-		Name:  user.Name,
-		Email: user.Email,
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		DeleteAfter:   user.DeleteAfter,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -150,20 +442,124 @@ func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
 // Helper functions
 ///////////////////////////////////////////////////////////////////////////////
 
-// signIn helper function sign in users via cookies
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if err := u.UserService.DB.Update(user); err != nil {
+// signIn helper function sign in users via cookies. Every sign in opens a
+// new session so other devices stay logged in.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	if err := u.SessionService.DB.Create(&session); err != nil {
 		return err
 	}
 
+	setRememberCookie(w, &session)
+	return nil
+}
+
+// loginLockedFor returns how long logins for the email from the IP are
+// locked out, zero if they may be attempted now
+func (u *Users) loginLockedFor(email, ip string) (time.Duration, error) {
+	accountWait, err := u.AccountLimiter.Check(email)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := u.IPLimiter.Check(ip)
+	if err != nil {
+		return 0, err
+	}
+	return max(accountWait, ipWait), nil
+}
+
+// recordLoginFailure counts a failed login and emails the account owner
+// when it locks their account
+func (u *Users) recordLoginFailure(ctx context.Context, email, ip string) error {
+	if _, err := u.IPLimiter.Fail(ip); err != nil {
+		return err
+	}
+	res, err := u.AccountLimiter.Fail(email)
+	if err != nil || !res.NewlyLocked {
+		return err
+	}
+
+	user, err := u.UserService.DB.ByEmail(email)
+	if err == models.ErrorNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return u.sendEmail(ctx, user.Email, "account_locked", map[string]string{
+		"Name":      user.Name,
+		"IP":        ip,
+		"LockedFor": humanDuration(res.RetryAfter),
+		"ResetURL":  clientURL("/forgot-password", nil),
+	})
+}
+
+// sendVerification issues a verification token for the user's email and
+// emails the link to them
+func (u *Users) sendVerification(ctx context.Context, user *models.User) error {
+	token, err := u.UserService.StartEmailVerification(user)
+	if err != nil {
+		return err
+	}
+	return u.sendEmail(ctx, user.Email, "verify_email", map[string]string{
+		"Name":      user.Name,
+		"Email":     user.Email,
+		"URL":       clientURL("/verify-email", url.Values{"token": {token}}),
+		"ExpiresIn": humanDuration(config.EmailVerificationTimeout),
+	})
+}
+
+// sendEmail renders the named email template and queues it for delivery
+func (u *Users) sendEmail(ctx context.Context, to, template string, data any) error {
+	msg, err := mailer.NewMessage(to, template, data)
+	if err != nil {
+		return err
+	}
+	return u.Mailer.Send(ctx, msg)
+}
+
+// rotateSession issues a fresh token for the current session and hands it
+// to the browser. It is used after privilege-sensitive actions.
+func (u *Users) rotateSession(w http.ResponseWriter, session *models.Session) error {
+	if err := u.SessionService.DB.Rotate(session); err != nil {
+		return err
+	}
+	setRememberCookie(w, session)
+	return nil
+}
+
+// setRememberCookie stores the session token in the browser. The cookie
+// lives until the absolute timeout; the idle timeout is enforced
+// server-side.
+func setRememberCookie(w http.ResponseWriter, session *models.Session) {
+	expiresAt := session.AbsoluteExpiresAt()
 	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
+		Name:     rememberCookie,
+		Value:    session.Token,
+		Expires:  expiresAt,
+		MaxAge:   int(time.Until(expiresAt).Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	}
+
+	http.SetCookie(w, &cookie)
+}
+
+// clearRememberCookie tells the browser to drop the remember token
+func clearRememberCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     rememberCookie,
+		Value:    "",
+		MaxAge:   -1,
 		HttpOnly: true,
 		Secure:   true,
 		SameSite: http.SameSiteNoneMode,
 	}
 
 	http.SetCookie(w, &cookie)
-	return nil
 }
@@ -0,0 +1,408 @@
+// Package exif reads camera metadata from JPEG, PNG and WebP files and
+// removes it from them. Files are processed as streams, so only the
+// metadata itself is ever held in memory.
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	exifHeader   = "Exif\x00\x00"
+	xmpHeader    = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpExtHeader = "http://ns.adobe.com/xmp/extension/\x00"
+	xmpKeyword   = "XML:com.adobe.xmp"
+
+	// maxChunk caps the PNG and WebP metadata chunks read into memory
+	maxChunk = 16 << 20
+)
+
+var (
+	ErrUnsupported = errors.New("exif: unsupported file format")
+	ErrMalformed   = errors.New("exif: malformed file")
+
+	// errDone stops a walk once the metadata has been found
+	errDone = errors.New("exif: done")
+)
+
+// Metadata is the camera information of a photo. Fields the file does
+// not have are left empty.
+type Metadata struct {
+	Make      string
+	Model     string
+	LensModel string
+	// ExposureTime is in seconds, written like "1/250"
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	// FocalLength is in millimetres
+	FocalLength float64
+	CapturedAt  *time.Time
+	// Orientation is the EXIF orientation, 1 to 8; 0 when missing
+	Orientation int
+	GPS         *GPS
+}
+
+// GPS is where a photo was taken, in decimal degrees and metres above sea
+// level
+type GPS struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  *float64
+}
+
+// Mode selects what Strip removes
+type Mode int
+
+const (
+	// StripLocation removes the GPS position and XMP data, which can hold
+	// a copy of it, and keeps the rest of the EXIF data
+	StripLocation Mode = iota + 1
+	// StripAll removes all EXIF and XMP data
+	StripAll
+)
+
+// exifFn is called with the EXIF block of a file. It returns the block to
+// write in its place, or nil to drop it.
+type exifFn func(payload []byte) ([]byte, error)
+
+// Extract reads the EXIF metadata of an image. It returns nil without an
+// error when the image has none.
+func Extract(r io.Reader) (*Metadata, error) {
+	var m *Metadata
+	err := walk(io.Discard, r, 0, func(payload []byte) ([]byte, error) {
+		if parsed, err := Parse(payload); err == nil {
+			m = parsed
+		}
+		// A broken EXIF block is treated as missing
+		return nil, errDone
+	})
+	if err != nil && err != errDone {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Strip copies an image from r to w without the metadata mode selects.
+// The image data itself is copied unchanged.
+func Strip(w io.Writer, r io.Reader, mode Mode) error {
+	return walk(w, r, mode, func(payload []byte) ([]byte, error) {
+		if mode == StripAll {
+			return nil, nil
+		}
+		if err := stripGPS(payload); err != nil {
+			// Unreadable EXIF cannot be checked for a location
+			return nil, nil
+		}
+		return payload, nil
+	})
+}
+
+// walk copies an image from r to w, passing its EXIF block to onExif.
+// XMP blocks are dropped unless mode is 0.
+func walk(w io.Writer, r io.Reader, mode Mode, onExif exifFn) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(12)
+	if err != nil && len(magic) < 8 {
+		return ErrUnsupported
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("\xff\xd8")):
+		return walkJPEG(w, br, mode, onExif)
+	case bytes.HasPrefix(magic, []byte("\x89PNG\r\n\x1a\n")):
+		return walkPNG(w, br, mode, onExif)
+	case len(magic) == 12 && string(magic[:4]) == "RIFF" && string(magic[8:]) == "WEBP":
+		return walkWebP(w, br, mode, onExif)
+	default:
+		return ErrUnsupported
+	}
+}
+
+// filter decides what to write in place of a metadata block
+func filter(exif bool, payload []byte, mode Mode, onExif exifFn) ([]byte, error) {
+	if exif {
+		return onExif(payload)
+	}
+	if mode != 0 {
+		return nil, nil
+	}
+	return payload, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// JPEG
+///////////////////////////////////////////////////////////////////////////////
+
+// walkJPEG visits the APP1 segments of a JPEG file, which hold EXIF and
+// XMP data. Everything from the start of the scan on is copied as is.
+func walkJPEG(w io.Writer, br *bufio.Reader, mode Mode, onExif exifFn) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil {
+		return ErrMalformed
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return ErrMalformed
+		}
+		if b != 0xFF {
+			return ErrMalformed
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xFF {
+			// Fill bytes
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return ErrMalformed
+		}
+
+		// Markers without a payload
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+		if marker == 0xD9 {
+			_, err := w.Write([]byte{0xFF, marker})
+			return err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return ErrMalformed
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return ErrMalformed
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return ErrMalformed
+		}
+
+		if marker == 0xE1 {
+			exif := bytes.HasPrefix(payload, []byte(exifHeader))
+			xmp := bytes.HasPrefix(payload, []byte(xmpHeader)) || bytes.HasPrefix(payload, []byte(xmpExtHeader))
+			if exif || xmp {
+				out, err := filter(exif, payload, mode, onExif)
+				if err != nil {
+					return err
+				}
+				if out == nil {
+					continue
+				}
+				payload = out
+			}
+		}
+
+		if _, err := w.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+
+		if marker == 0xDA {
+			// Start of scan: no metadata follows the image data
+			_, err := io.Copy(w, br)
+			return err
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// PNG
+///////////////////////////////////////////////////////////////////////////////
+
+// walkPNG visits the eXIf chunk and the XMP iTXt chunk of a PNG file
+func walkPNG(w io.Writer, br *bufio.Reader, mode Mode, onExif exifFn) error {
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(br, sig); err != nil {
+		return ErrMalformed
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return ErrMalformed
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		typ := string(header[4:])
+
+		exif, xmp := typ == "eXIf", false
+		if typ == "iTXt" {
+			keyword, _ := br.Peek(int(min(n, int64(len(xmpKeyword)+1))))
+			xmp = string(keyword) == xmpKeyword+"\x00"
+		}
+
+		if (exif || xmp) && n > maxChunk && mode != 0 {
+			// Too large to look at, so it cannot be kept
+			if _, err := io.CopyN(io.Discard, br, n+4); err != nil {
+				return ErrMalformed
+			}
+			continue
+		}
+		if !(exif || xmp) || n > maxChunk {
+			if _, err := w.Write(header[:]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, br, n+4); err != nil {
+				return ErrMalformed
+			}
+			if typ == "IEND" {
+				return nil
+			}
+			continue
+		}
+
+		// Read the data and the CRC
+		data := make([]byte, n+4)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return ErrMalformed
+		}
+		out, err := filter(exif, data[:n], mode, onExif)
+		if err != nil {
+			return err
+		}
+		if out == nil {
+			continue
+		}
+
+		var length, crc [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(out)))
+		sum := crc32.NewIEEE()
+		sum.Write(header[4:])
+		sum.Write(out)
+		binary.BigEndian.PutUint32(crc[:], sum.Sum32())
+		for _, b := range [][]byte{length[:], header[4:], out, crc[:]} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// WebP
+///////////////////////////////////////////////////////////////////////////////
+
+// WebP flags in the VP8X chunk
+const (
+	webpExifFlag = 0x08
+	webpXMPFlag  = 0x04
+)
+
+// walkWebP visits the EXIF and XMP chunks of a WebP file. The RIFF header
+// holds the file size and comes first, so dropped chunks are not removed
+// but blanked and renamed to a chunk type readers ignore.
+func walkWebP(w io.Writer, br *bufio.Reader, mode Mode, onExif exifFn) error {
+	riff := make([]byte, 12)
+	if _, err := io.ReadFull(br, riff); err != nil {
+		return ErrMalformed
+	}
+	if _, err := w.Write(riff); err != nil {
+		return err
+	}
+
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return ErrMalformed
+		}
+		fourcc := string(header[:4])
+		n := int64(binary.LittleEndian.Uint32(header[4:]))
+		padded := n + n%2
+
+		exif, xmp := fourcc == "EXIF", fourcc == "XMP "
+		if (exif || xmp) && n > maxChunk && mode != 0 {
+			// Too large to look at, so it cannot be kept
+			copy(header[:4], "JUNK")
+			if _, err := w.Write(header[:]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(io.Discard, br, padded); err != nil {
+				return ErrMalformed
+			}
+			if _, err := io.CopyN(w, zeros{}, padded); err != nil {
+				return err
+			}
+			continue
+		}
+		if !(exif || xmp) || n > maxChunk {
+			if _, err := w.Write(header[:]); err != nil {
+				return err
+			}
+			if fourcc == "VP8X" && n >= 4 {
+				if err := copyVP8X(w, br, padded, mode); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := io.CopyN(w, br, padded); err != nil {
+				return ErrMalformed
+			}
+			continue
+		}
+
+		data := make([]byte, padded)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return ErrMalformed
+		}
+		out, err := filter(exif, data[:n], mode, onExif)
+		if err != nil {
+			return err
+		}
+		if out == nil {
+			copy(header[:4], "JUNK")
+			clear(data)
+		}
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// copyVP8X copies the VP8X chunk, clearing the flags of the metadata
+// mode drops
+func copyVP8X(w io.Writer, br *bufio.Reader, n int64, mode Mode) error {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return ErrMalformed
+	}
+	if mode != 0 {
+		data[0] &^= webpXMPFlag
+	}
+	if mode == StripAll {
+		data[0] &^= webpExifFlag
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// zeros is an endless stream of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,433 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Building test files
+///////////////////////////////////////////////////////////////////////////////
+
+// field is one TIFF field to write
+type field struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiField(tag uint16, s string) field {
+	return field{tag, 2, uint32(len(s) + 1), []byte(s + "\x00")}
+}
+
+func shortField(tag uint16, v uint16) field {
+	return field{tag, 3, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func byteField(tag uint16, v byte) field {
+	return field{tag, 1, 1, []byte{v}}
+}
+
+func rationalField(tag uint16, rs ...[2]uint32) field {
+	var b []byte
+	for _, r := range rs {
+		b = binary.LittleEndian.AppendUint32(b, r[0])
+		b = binary.LittleEndian.AppendUint32(b, r[1])
+	}
+	return field{tag, 5, uint32(len(rs)), b}
+}
+
+// buildTIFF writes little endian TIFF data with IFD0 pointing to an Exif
+// and, if gps is not empty, a GPS sub-IFD
+func buildTIFF(ifd0, exif, gps []field) []byte {
+	le := binary.LittleEndian
+	ifdSize := func(n int) int { return 2 + 12*n + 4 }
+
+	n0 := len(ifd0) + 1
+	if len(gps) > 0 {
+		n0++
+	}
+	exifOff := 8 + ifdSize(n0)
+	gpsOff := exifOff + ifdSize(len(exif))
+	dataOff := gpsOff
+	if len(gps) > 0 {
+		dataOff += ifdSize(len(gps))
+	}
+
+	ifd0 = append(ifd0, field{tagExifIFD, 4, 1, le.AppendUint32(nil, uint32(exifOff))})
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, field{tagGPSIFD, 4, 1, le.AppendUint32(nil, uint32(gpsOff))})
+	}
+
+	out := []byte("II*\x00")
+	out = le.AppendUint32(out, 8)
+	var data []byte
+	for _, ifd := range [][]field{ifd0, exif, gps} {
+		if len(ifd) == 0 {
+			continue
+		}
+		out = le.AppendUint16(out, uint16(len(ifd)))
+		for _, f := range ifd {
+			out = le.AppendUint16(out, f.tag)
+			out = le.AppendUint16(out, f.typ)
+			out = le.AppendUint32(out, f.count)
+			if len(f.value) <= 4 {
+				inline := make([]byte, 4)
+				copy(inline, f.value)
+				out = append(out, inline...)
+				continue
+			}
+			out = le.AppendUint32(out, uint32(dataOff+len(data)))
+			data = append(data, f.value...)
+			if len(data)%2 == 1 {
+				data = append(data, 0)
+			}
+		}
+		out = le.AppendUint32(out, 0)
+	}
+	return append(out, data...)
+}
+
+// testEXIF is the TIFF data of a photo with a location
+func testEXIF() []byte {
+	return buildTIFF(
+		[]field{
+			asciiField(tagMake, "Canon"),
+			asciiField(tagModel, "EOS R5"),
+			shortField(tagOrientation, 6),
+		},
+		[]field{
+			rationalField(tagExposureTime, [2]uint32{1, 250}),
+			rationalField(tagFNumber, [2]uint32{28, 10}),
+			shortField(tagISO, 400),
+			asciiField(tagDateTimeOriginal, "2024:05:01 13:45:10"),
+			asciiField(tagOffsetTimeOriginal, "+02:00"),
+			rationalField(tagFocalLength, [2]uint32{50, 1}),
+			asciiField(tagLensModel, "RF50mm F1.8 STM"),
+		},
+		[]field{
+			asciiField(tagGPSLatitudeRef, "N"),
+			rationalField(tagGPSLatitude, [2]uint32{52, 1}, [2]uint32{31, 1}, [2]uint32{12, 1}),
+			asciiField(tagGPSLongitudeRef, "W"),
+			rationalField(tagGPSLongitude, [2]uint32{13, 1}, [2]uint32{24, 1}, [2]uint32{18, 1}),
+			byteField(tagGPSAltitudeRef, 0),
+			rationalField(tagGPSAltitude, [2]uint32{34, 1}),
+		},
+	)
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><exif:GPSLatitude>52,31.2N</exif:GPSLatitude></x:xmpmeta>`
+
+// testImage is a small gradient, so the encoded files have real image data
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 32), 128, 255})
+		}
+	}
+	return img
+}
+
+// testJPEG encodes testImage with EXIF and XMP APP1 segments after the SOI
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	segment := func(payload []byte) []byte {
+		seg := []byte{0xFF, 0xE1}
+		seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+		return append(seg, payload...)
+	}
+	out := append([]byte{}, encoded[:2]...)
+	out = append(out, segment(append([]byte(exifHeader), testEXIF()...))...)
+	out = append(out, segment([]byte(xmpHeader+testXMP))...)
+	return append(out, encoded[2:]...)
+}
+
+// pngChunk writes a PNG chunk with its CRC
+func pngChunk(typ string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// testPNG encodes testImage with eXIf and XMP iTXt chunks after the IHDR
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// The signature and the IHDR chunk
+	const afterIHDR = 8 + 8 + 13 + 4
+	out := append([]byte{}, encoded[:afterIHDR]...)
+	out = append(out, pngChunk("eXIf", testEXIF())...)
+	out = append(out, pngChunk("iTXt", []byte(xmpKeyword+"\x00\x00\x00\x00\x00"+testXMP))...)
+	return append(out, encoded[afterIHDR:]...)
+}
+
+// webpChunk writes a RIFF chunk, padded to an even length
+func webpChunk(fourcc string, data []byte) []byte {
+	chunk := append([]byte(fourcc), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// testWebPBitstream stands in for the VP8L image data, which Strip copies
+// without looking at
+var testWebPBitstream = []byte("\x2f\x0f\xc0\x07not really a lossless bitstream")
+
+// testWebP builds an extended WebP file with EXIF and XMP chunks
+func testWebP() []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpExifFlag | webpXMPFlag
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", testWebPBitstream)...)
+	body = append(body, webpChunk("EXIF", testEXIF())...)
+	body = append(body, webpChunk("XMP ", []byte(testXMP))...)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// webpChunks lists the chunks of a WebP file by FourCC
+func webpChunks(t *testing.T, file []byte) map[string][]byte {
+	t.Helper()
+	chunks := make(map[string][]byte)
+	for p := 12; p < len(file); {
+		if p+8 > len(file) {
+			t.Fatalf("truncated chunk header at %d", p)
+		}
+		n := int(binary.LittleEndian.Uint32(file[p+4:]))
+		end := p + 8 + n
+		if end > len(file) {
+			t.Fatalf("chunk %q runs past the end of the file", file[p:p+4])
+		}
+		chunks[string(file[p:p+4])] = file[p+8 : end]
+		p = end + n%2
+	}
+	return chunks
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Tests
+///////////////////////////////////////////////////////////////////////////////
+
+func checkMetadata(t *testing.T, m *Metadata, wantGPS bool) {
+	t.Helper()
+	if m == nil {
+		t.Fatal("metadata is missing")
+	}
+	if m.Make != "Canon" || m.Model != "EOS R5" || m.LensModel != "RF50mm F1.8 STM" {
+		t.Errorf("camera = %q %q %q", m.Make, m.Model, m.LensModel)
+	}
+	if m.ExposureTime != "1/250" || m.FNumber != 2.8 || m.ISO != 400 || m.FocalLength != 50 {
+		t.Errorf("exposure = %s f/%g ISO %d %gmm", m.ExposureTime, m.FNumber, m.ISO, m.FocalLength)
+	}
+	if m.Orientation != 6 {
+		t.Errorf("Orientation = %d, want 6", m.Orientation)
+	}
+	want := time.Date(2024, 5, 1, 11, 45, 10, 0, time.UTC)
+	if m.CapturedAt == nil || !m.CapturedAt.Equal(want) {
+		t.Errorf("CapturedAt = %v, want %v", m.CapturedAt, want)
+	}
+
+	if !wantGPS {
+		if m.GPS != nil {
+			t.Errorf("GPS = %+v, want none", m.GPS)
+		}
+		return
+	}
+	if m.GPS == nil {
+		t.Fatal("GPS is missing")
+	}
+	if math.Abs(m.GPS.Latitude-52.52) > 1e-9 || math.Abs(m.GPS.Longitude+13.405) > 1e-9 {
+		t.Errorf("position = %g, %g, want 52.52, -13.405", m.GPS.Latitude, m.GPS.Longitude)
+	}
+	if m.GPS.Altitude == nil || *m.GPS.Altitude != 34 {
+		t.Errorf("Altitude = %v, want 34", m.GPS.Altitude)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"bare TIFF":   testEXIF(),
+		"JPEG header": append([]byte(exifHeader), testEXIF()...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMetadata(t, m, true)
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":          nil,
+		"bad byte order": []byte("XX*\x00\x08\x00\x00\x00"),
+		"IFD past end":   []byte("II*\x00\xff\x00\x00\x00"),
+	} {
+		if _, err := Parse(data); err == nil {
+			t.Errorf("%s: Parse succeeded", name)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   func(*testing.T) []byte
+		decode func([]byte) (image.Image, error)
+	}{
+		{"JPEG", testJPEG, func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) }},
+		{"PNG", testPNG, func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) }},
+		{"WebP", func(*testing.T) []byte { return testWebP() }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tt.file(t)
+			m, err := Extract(bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMetadata(t, m, true)
+
+			for _, mode := range []Mode{StripLocation, StripAll} {
+				var out bytes.Buffer
+				if err := Strip(&out, bytes.NewReader(file), mode); err != nil {
+					t.Fatalf("Strip(%d): %v", mode, err)
+				}
+				stripped := out.Bytes()
+
+				if bytes.Contains(stripped, []byte(testXMP)) {
+					t.Errorf("Strip(%d) kept the XMP data", mode)
+				}
+				m, err := Extract(bytes.NewReader(stripped))
+				if err != nil {
+					t.Fatalf("Extract after Strip(%d): %v", mode, err)
+				}
+				if mode == StripAll {
+					if m != nil {
+						t.Errorf("Strip(StripAll) kept metadata %+v", m)
+					}
+				} else {
+					checkMetadata(t, m, false)
+				}
+
+				if tt.decode == nil {
+					continue
+				}
+				want, err := tt.decode(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := tt.decode(stripped)
+				if err != nil {
+					t.Fatalf("decoding after Strip(%d): %v", mode, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Strip(%d) changed the image", mode)
+				}
+			}
+		})
+	}
+}
+
+func TestStripWebPLayout(t *testing.T) {
+	file := testWebP()
+	tests := []struct {
+		mode      Mode
+		wantFlags byte
+		wantEXIF  bool
+	}{
+		{StripLocation, webpExifFlag, true},
+		{StripAll, 0, false},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := Strip(&out, bytes.NewReader(file), tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		stripped := out.Bytes()
+
+		// Chunks are blanked rather than removed, so the RIFF size holds
+		if len(stripped) != len(file) || !bytes.Equal(stripped[:12], file[:12]) {
+			t.Errorf("Strip(%d) changed the RIFF header or file size", tt.mode)
+		}
+		chunks := webpChunks(t, stripped)
+		if flags := chunks["VP8X"][0]; flags != tt.wantFlags {
+			t.Errorf("Strip(%d) left VP8X flags %#x, want %#x", tt.mode, flags, tt.wantFlags)
+		}
+		if !bytes.Equal(chunks["VP8L"], testWebPBitstream) {
+			t.Errorf("Strip(%d) changed the image data", tt.mode)
+		}
+		if _, ok := chunks["EXIF"]; ok != tt.wantEXIF {
+			t.Errorf("Strip(%d) EXIF chunk present = %t, want %t", tt.mode, ok, tt.wantEXIF)
+		}
+		if _, ok := chunks["XMP "]; ok {
+			t.Errorf("Strip(%d) kept the XMP chunk", tt.mode)
+		}
+		if junk := chunks["JUNK"]; junk == nil || !bytes.Equal(junk, make([]byte, len(junk))) {
+			t.Errorf("Strip(%d) did not blank the dropped chunks", tt.mode)
+		}
+	}
+}
+
+func TestExtractWithoutMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Extract(&buf)
+	if err != nil || m != nil {
+		t.Errorf("Extract = %+v, %v, want nil, nil", m, err)
+	}
+}
+
+func TestUnsupportedAndMalformed(t *testing.T) {
+	jpegFile := testJPEG(t)
+	pngFile := testPNG(t)
+
+	tests := []struct {
+		name string
+		file []byte
+		want error
+	}{
+		{"GIF", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), ErrUnsupported},
+		{"empty", nil, ErrUnsupported},
+		{"truncated JPEG", jpegFile[:40], ErrMalformed},
+		{"truncated PNG", pngFile[:40], ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Strip(&bytes.Buffer{}, bytes.NewReader(tt.file), StripAll)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Strip = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package exif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// TIFF tags we read
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagLensModel          = 0xA434
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+	tagGPSAltitudeRef     = 0x0005
+	tagGPSAltitude        = 0x0006
+)
+
+// typeSizes is the size in bytes of one value of each TIFF field type
+var typeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+var errMalformed = errors.New("exif: malformed TIFF data")
+
+// entry is one field of an IFD
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// value holds the field's bytes, whether stored inline or elsewhere
+	value []byte
+	// offset is where the value lives in the TIFF data, or -1 if it is
+	// stored inline in the entry
+	offset int
+	// index is the position of the entry in its IFD
+	index int
+}
+
+// tiff is a parsed TIFF header
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+	ifd0  int
+}
+
+func parseTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 {
+		return nil, errMalformed
+	}
+	t := &tiff{data: data}
+	switch string(data[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, errMalformed
+	}
+	t.ifd0 = int(t.order.Uint32(data[4:]))
+	return t, nil
+}
+
+// entries reads the IFD at offset
+func (t *tiff) entries(offset int) ([]entry, error) {
+	if offset < 8 || offset+2 > len(t.data) {
+		return nil, errMalformed
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	if offset+2+12*n > len(t.data) {
+		return nil, errMalformed
+	}
+
+	es := make([]entry, 0, n)
+	for i := 0; i < n; i++ {
+		p := t.data[offset+2+12*i:]
+		e := entry{
+			tag:    t.order.Uint16(p),
+			typ:    t.order.Uint16(p[2:]),
+			count:  t.order.Uint32(p[4:]),
+			offset: -1,
+			index:  i,
+		}
+		size, ok := typeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(e.count)
+		if total <= 4 {
+			e.value = p[8 : 8+total]
+		} else {
+			off := uint64(t.order.Uint32(p[8:]))
+			if off+total > uint64(len(t.data)) {
+				continue
+			}
+			e.offset = int(off)
+			e.value = t.data[off : off+total]
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
+func (t *tiff) uint(e entry) (uint32, bool) {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value)), true
+	case e.typ == 4 && len(e.value) >= 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+func (t *tiff) string(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(e.value), "\x00")
+	return strings.TrimSpace(s)
+}
+
+// rationals returns the numerators and denominators of a RATIONAL field
+func (t *tiff) rationals(e entry) [][2]uint32 {
+	if e.typ != 5 && e.typ != 10 {
+		return nil
+	}
+	rs := make([][2]uint32, 0, len(e.value)/8)
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		rs = append(rs, [2]uint32{t.order.Uint32(e.value[i:]), t.order.Uint32(e.value[i+4:])})
+	}
+	return rs
+}
+
+func (t *tiff) float(e entry) (float64, bool) {
+	rs := t.rationals(e)
+	if len(rs) == 0 || rs[0][1] == 0 {
+		return 0, false
+	}
+	return ratio(rs[0]), true
+}
+
+func ratio(r [2]uint32) float64 {
+	return float64(r[0]) / float64(r[1])
+}
+
+// Parse reads the metadata from raw EXIF data, which is a TIFF structure
+// optionally preceded by the "Exif\x00\x00" header of JPEG files
+func Parse(data []byte) (*Metadata, error) {
+	t, err := parseTIFF(trimHeader(data))
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := t.entries(t.ifd0)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{}
+	var exifIFD, gpsIFD uint32
+	for _, e := range ifd0 {
+		switch e.tag {
+		case tagMake:
+			m.Make = t.string(e)
+		case tagModel:
+			m.Model = t.string(e)
+		case tagOrientation:
+			if o, ok := t.uint(e); ok && o >= 1 && o <= 8 {
+				m.Orientation = int(o)
+			}
+		case tagExifIFD:
+			exifIFD, _ = t.uint(e)
+		case tagGPSIFD:
+			gpsIFD, _ = t.uint(e)
+		}
+	}
+
+	if exifIFD != 0 {
+		if es, err := t.entries(int(exifIFD)); err == nil {
+			t.readExif(m, es)
+		}
+	}
+	if gpsIFD != 0 {
+		if es, err := t.entries(int(gpsIFD)); err == nil {
+			m.GPS = t.readGPS(es)
+		}
+	}
+	return m, nil
+}
+
+// readExif fills in the exposure details of the Exif sub-IFD
+func (t *tiff) readExif(m *Metadata, es []entry) {
+	var captured, offset string
+	for _, e := range es {
+		switch e.tag {
+		case tagExposureTime:
+			if rs := t.rationals(e); len(rs) > 0 && rs[0][1] != 0 {
+				m.ExposureTime = formatExposure(rs[0])
+			}
+		case tagFNumber:
+			m.FNumber, _ = t.float(e)
+		case tagISO:
+			if iso, ok := t.uint(e); ok {
+				m.ISO = int(iso)
+			}
+		case tagFocalLength:
+			m.FocalLength, _ = t.float(e)
+		case tagLensModel:
+			m.LensModel = t.string(e)
+		case tagDateTimeOriginal:
+			captured = t.string(e)
+		case tagOffsetTimeOriginal:
+			offset = t.string(e)
+		}
+	}
+	if captured != "" {
+		m.CapturedAt = parseDateTime(captured, offset)
+	}
+}
+
+// readGPS returns the position of the GPS sub-IFD, or nil if it has none
+func (t *tiff) readGPS(es []entry) *GPS {
+	var lat, lon [][2]uint32
+	var latRef, lonRef string
+	var alt *float64
+	var below bool
+	for _, e := range es {
+		switch e.tag {
+		case tagGPSLatitudeRef:
+			latRef = t.string(e)
+		case tagGPSLatitude:
+			lat = t.rationals(e)
+		case tagGPSLongitudeRef:
+			lonRef = t.string(e)
+		case tagGPSLongitude:
+			lon = t.rationals(e)
+		case tagGPSAltitudeRef:
+			below = len(e.value) > 0 && e.value[0] == 1
+		case tagGPSAltitude:
+			if a, ok := t.float(e); ok {
+				alt = &a
+			}
+		}
+	}
+
+	latitude, ok1 := degrees(lat)
+	longitude, ok2 := degrees(lon)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	if latRef == "S" {
+		latitude = -latitude
+	}
+	if lonRef == "W" {
+		longitude = -longitude
+	}
+	if alt != nil && below {
+		*alt = -*alt
+	}
+	return &GPS{Latitude: latitude, Longitude: longitude, Altitude: alt}
+}
+
+// degrees converts degrees, minutes and seconds to decimal degrees
+func degrees(dms [][2]uint32) (float64, bool) {
+	if len(dms) != 3 {
+		return 0, false
+	}
+	var d float64
+	for i, scale := range []float64{1, 60, 3600} {
+		if dms[i][1] == 0 {
+			return 0, false
+		}
+		d += ratio(dms[i]) / scale
+	}
+	if math.IsNaN(d) || d > 180 {
+		return 0, false
+	}
+	return d, true
+}
+
+// formatExposure writes an exposure time the way cameras show it, e.g.
+// "1/250" or "2.5"
+func formatExposure(r [2]uint32) string {
+	if r[0] == 0 {
+		return "0"
+	}
+	if r[0] < r[1] {
+		return fmt.Sprintf("1/%d", int(math.Round(float64(r[1])/float64(r[0]))))
+	}
+	return fmt.Sprintf("%g", ratio(r))
+}
+
+// parseDateTime reads an EXIF timestamp such as "2024:05:01 13:45:10".
+// Without an offset the time is in the camera's unknown local zone, so it
+// is returned as UTC wall clock time.
+func parseDateTime(s, offset string) *time.Time {
+	loc := time.UTC
+	if offset != "" {
+		if t, err := time.Parse("-07:00", offset); err == nil {
+			loc = t.Location()
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, loc)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// stripGPS removes the GPS sub-IFD from EXIF data in place. The GPS
+// fields and their values are overwritten with zeros and the pointer to
+// them is taken out of IFD0, so every other offset stays valid.
+func stripGPS(data []byte) error {
+	t, err := parseTIFF(trimHeader(data))
+	if err != nil {
+		return err
+	}
+	ifd0, err := t.entries(t.ifd0)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range ifd0 {
+		if e.tag != tagGPSIFD {
+			continue
+		}
+		if gpsIFD, ok := t.uint(e); ok {
+			if es, err := t.entries(int(gpsIFD)); err == nil {
+				for _, ge := range es {
+					if ge.offset >= 0 {
+						clear(ge.value)
+					}
+				}
+				n := int(t.order.Uint16(t.data[gpsIFD:]))
+				clear(t.data[gpsIFD:min(int(gpsIFD)+2+12*n+4, len(t.data))])
+			}
+		}
+
+		// Shift the following entries and the next-IFD offset up over
+		// the GPS pointer
+		n := int(t.order.Uint16(t.data[t.ifd0:]))
+		start := t.ifd0 + 2 + 12*e.index
+		end := t.ifd0 + 2 + 12*n + 4
+		if end > len(t.data) {
+			return errMalformed
+		}
+		copy(t.data[start:], t.data[start+12:end])
+		clear(t.data[end-12 : end])
+		t.order.PutUint16(t.data[t.ifd0:], uint16(n-1))
+		return nil
+	}
+	return nil
+}
+
+// trimHeader drops the "Exif\x00\x00" header JPEG files put in front of
+// the TIFF data
+func trimHeader(data []byte) []byte {
+	if len(data) >= 6 && string(data[:6]) == exifHeader {
+		return data[6:]
+	}
+	return data
+}
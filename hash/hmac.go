@@ -4,23 +4,78 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
+	"strings"
 )
 
+// keySeparator divides the key ID from the hash. It is not part of the
+// URL-safe base64 alphabet, so hashes made with an unnamed key, which have
+// no ID in front, can be told apart.
+const keySeparator = ":"
+
+// Key is a secret HMAC key and the ID stored with the hashes made with it
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// HMAC hashes tokens with SHA-256 HMAC. It holds the current key, which
+// new hashes are made with, and any previous keys, which hashes made
+// before a rotation are still checked against. Every call uses its own
+// hash state, so an HMAC is safe for concurrent use.
 type HMAC struct {
-	hmac hash.Hash
+	current  Key
+	previous []Key
 }
 
+// NewHMAC returns an HMAC with a single unnamed key. Its hashes are bare
+// base64, as they were before keys had IDs.
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
+	return NewKeyedHMAC(Key{Secret: key})
+}
+
+// NewKeyedHMAC returns an HMAC that hashes with current and still accepts
+// hashes made with previous
+func NewKeyedHMAC(current Key, previous ...Key) HMAC {
 	return HMAC{
-		hmac: h,
+		current:  current,
+		previous: previous,
 	}
 }
 
+// Hash hashes input with the current key
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()                              // reset to start fresh
-	h.hmac.Write([]byte(input))                 // write data to be hashed
-	b := h.hmac.Sum(nil)                        // compute hash
-	return base64.URLEncoding.EncodeToString(b) // encode to string
+	return hashWith(h.current, input)
+}
+
+// Hashes returns the hash of input under every key, the current key's
+// first. A stored hash matching any of them was made from input.
+func (h HMAC) Hashes(input string) []string {
+	hashes := make([]string, 0, 1+len(h.previous))
+	hashes = append(hashes, h.Hash(input))
+	for _, key := range h.previous {
+		hashes = append(hashes, hashWith(key, input))
+	}
+	return hashes
+}
+
+// IsCurrent reports whether hash was made with the current key. Hashes
+// made with a previous key should be replaced with Hash when the input is
+// at hand.
+func (h HMAC) IsCurrent(hash string) bool {
+	id, _, found := strings.Cut(hash, keySeparator)
+	if !found {
+		return h.current.ID == ""
+	}
+	return id == h.current.ID
+}
+
+// hashWith hashes input with key, putting the key's ID in front
+func hashWith(key Key, input string) string {
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	mac.Write([]byte(input))
+	sum := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	if key.ID == "" {
+		return sum
+	}
+	return key.ID + keySeparator + sum
 }
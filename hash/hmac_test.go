@@ -0,0 +1,125 @@
+package hash
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// RFC 4231, test case 2
+const (
+	rfcKey  = "Jefe"
+	rfcData = "what do ya want for nothing?"
+	rfcMAC  = "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+)
+
+func rfcHash(t *testing.T) string {
+	t.Helper()
+	sum, err := hex.DecodeString(rfcMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.URLEncoding.EncodeToString(sum)
+}
+
+func TestHash(t *testing.T) {
+	want := rfcHash(t)
+
+	tests := []struct {
+		name string
+		h    HMAC
+		want string
+	}{
+		{"unnamed key", NewHMAC(rfcKey), want},
+		{"unnamed keyed", NewKeyedHMAC(Key{Secret: rfcKey}), want},
+		{"named key", NewKeyedHMAC(Key{ID: "k1", Secret: rfcKey}), "k1:" + want},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.h.Hash(rfcData); got != tt.want {
+				t.Errorf("Hash = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashesAfterRotation(t *testing.T) {
+	legacy := NewHMAC("legacy secret")
+	first := NewKeyedHMAC(Key{ID: "k1", Secret: "first secret"}, Key{Secret: "legacy secret"})
+	second := NewKeyedHMAC(
+		Key{ID: "k2", Secret: "second secret"},
+		Key{ID: "k1", Secret: "first secret"},
+		Key{Secret: "legacy secret"},
+	)
+
+	hashes := second.Hashes("token")
+	want := []string{second.Hash("token"), first.Hash("token"), legacy.Hash("token")}
+	if len(hashes) != len(want) {
+		t.Fatalf("Hashes returned %d hashes, want %d", len(hashes), len(want))
+	}
+	for i := range want {
+		if hashes[i] != want[i] {
+			t.Errorf("Hashes[%d] = %s, want %s", i, hashes[i], want[i])
+		}
+	}
+	if !strings.HasPrefix(hashes[0], "k2:") {
+		t.Errorf("current hash %s does not start with the current key ID", hashes[0])
+	}
+	if hashes[0] == hashes[1] || hashes[1] == hashes[2] {
+		t.Error("different keys made the same hash")
+	}
+}
+
+func TestIsCurrent(t *testing.T) {
+	legacy := NewHMAC("legacy secret")
+	old := NewKeyedHMAC(Key{ID: "k1", Secret: "first secret"})
+	rotated := NewKeyedHMAC(Key{ID: "k2", Secret: "second secret"},
+		Key{ID: "k1", Secret: "first secret"}, Key{Secret: "legacy secret"})
+
+	tests := []struct {
+		name string
+		h    HMAC
+		hash string
+		want bool
+	}{
+		{"unnamed key, its own hash", legacy, legacy.Hash("t"), true},
+		{"unnamed key, named hash", legacy, old.Hash("t"), false},
+		{"rotated, current hash", rotated, rotated.Hash("t"), true},
+		{"rotated, previous key hash", rotated, old.Hash("t"), false},
+		{"rotated, unnamed key hash", rotated, legacy.Hash("t"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.h.IsCurrent(tt.hash); got != tt.want {
+				t.Errorf("IsCurrent(%s) = %t, want %t", tt.hash, got, tt.want)
+			}
+		})
+	}
+}
+
+// Run with -race: an HMAC is shared by every request
+func TestConcurrentUse(t *testing.T) {
+	h := NewKeyedHMAC(Key{ID: "k2", Secret: "second secret"}, Key{ID: "k1", Secret: "first secret"})
+	want := h.Hash("token")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := h.Hash("token"); got != want {
+					t.Errorf("Hash = %s, want %s", got, want)
+					return
+				}
+				if hashes := h.Hashes("token"); hashes[0] != want {
+					t.Errorf("Hashes[0] = %s, want %s", hashes[0], want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,54 @@
+package imaging
+
+import "image"
+
+// Swapped reports whether an EXIF orientation turns the image on its
+// side, so that its displayed width is its stored height
+func Swapped(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// Orient turns an image the way its EXIF orientation (1 to 8) says it
+// should be displayed. Resized copies carry no EXIF data, so the rotation
+// has to be applied to the pixels.
+func Orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if Swapped(orientation) {
+		dw, dh = h, w
+	}
+
+	// at maps a pixel of the result to the source pixel it comes from
+	var at func(x, y int) (int, int)
+	switch orientation {
+	case 2: // mirrored horizontally
+		at = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3: // rotated 180°
+		at = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4: // mirrored vertically
+		at = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5: // mirrored along the top-left to bottom-right diagonal
+		at = func(x, y int) (int, int) { return y, x }
+	case 6: // needs turning 90° clockwise
+		at = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7: // mirrored along the top-right to bottom-left diagonal
+		at = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8: // needs turning 90° anticlockwise
+		at = func(x, y int) (int, int) { return w - 1 - y, x }
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := at(x, y)
+			s := src.PixOffset(b.Min.X+sx, b.Min.Y+sy)
+			d := dst.PixOffset(x, y)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
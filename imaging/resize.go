@@ -0,0 +1,129 @@
+// Package imaging resizes decoded images without any dependencies outside
+// the standard library.
+package imaging
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Fit returns the size of a width x height image scaled down to at most
+// maxWidth pixels wide, keeping its aspect ratio. Images that are already
+// narrow enough keep their size; they are never scaled up.
+func Fit(width, height, maxWidth int) (int, int) {
+	if width <= maxWidth || width <= 0 {
+		return width, height
+	}
+	h := int(math.Round(float64(height) * float64(maxWidth) / float64(width)))
+	if h < 1 {
+		h = 1
+	}
+	return maxWidth, h
+}
+
+// Resize scales src to width x height. Each output pixel averages the
+// source pixels under it with a triangle filter, so large reductions stay
+// smooth instead of aliasing like nearest-neighbour sampling does.
+func Resize(src image.Image, width, height int) *image.RGBA {
+	rgba := toRGBA(src)
+	b := rgba.Bounds()
+	if b.Dx() == width && b.Dy() == height {
+		return rgba
+	}
+
+	// Scale horizontally first, then vertically
+	tmp := image.NewRGBA(image.Rect(0, 0, width, b.Dy()))
+	resample(rgba.Pix, rgba.Stride, 4, tmp.Pix, tmp.Stride, 4, b.Dx(), width, b.Dy())
+
+	// Columns are the lines of the vertical pass
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	resample(tmp.Pix, 4, tmp.Stride, dst.Pix, 4, dst.Stride, b.Dy(), height, width)
+	return dst
+}
+
+// toRGBA returns src as an *image.RGBA whose bounds start at the origin.
+// draw.Draw has fast paths for the types the standard decoders produce.
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	return rgba
+}
+
+// contribution is one source pixel's share of an output pixel
+type contribution struct {
+	index  int
+	weight float32
+}
+
+// weights works out, for every output position along one axis, which
+// source positions it is made of and how much each counts
+func weights(srcLen, dstLen int) [][]contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	radius := math.Max(scale, 1)
+
+	out := make([][]contribution, dstLen)
+	for i := range out {
+		center := (float64(i)+0.5)*scale - 0.5
+		lo := int(math.Ceil(center - radius))
+		hi := int(math.Floor(center + radius))
+
+		var sum float64
+		var cs []contribution
+		for j := lo; j <= hi; j++ {
+			w := 1 - math.Abs(float64(j)-center)/radius
+			if w <= 0 {
+				continue
+			}
+			k := min(max(j, 0), srcLen-1)
+			cs = append(cs, contribution{index: k, weight: float32(w)})
+			sum += w
+		}
+		for k := range cs {
+			cs[k].weight /= float32(sum)
+		}
+		out[i] = cs
+	}
+	return out
+}
+
+// resample scales lines of premultiplied RGBA pixels along one axis.
+// srcStep and dstStep are the byte distances between neighbouring pixels
+// along that axis and srcLine and dstLine the distances between lines, so
+// the same code handles rows and columns.
+func resample(src []byte, srcLine, srcStep int, dst []byte, dstLine, dstStep int, srcLen, dstLen, lines int) {
+	ws := weights(srcLen, dstLen)
+	for l := 0; l < lines; l++ {
+		srcBase, dstBase := l*srcLine, l*dstLine
+		for i, cs := range ws {
+			var r, g, b, a float32
+			for _, c := range cs {
+				p := src[srcBase+c.index*srcStep:]
+				r += float32(p[0]) * c.weight
+				g += float32(p[1]) * c.weight
+				b += float32(p[2]) * c.weight
+				a += float32(p[3]) * c.weight
+			}
+			q := dst[dstBase+i*dstStep:]
+			q[0] = clamp(r)
+			q[1] = clamp(g)
+			q[2] = clamp(b)
+			q[3] = clamp(a)
+		}
+	}
+}
+
+func clamp(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	default:
+		return uint8(v + 0.5)
+	}
+}
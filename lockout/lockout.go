@@ -0,0 +1,122 @@
+package lockout
+
+import (
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Storage
+///////////////////////////////////////////////////////////////////////////////
+
+// Record is the failure history of one key, such as an account or an IP
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Store keeps failure records. Update must apply fn atomically with
+// respect to other calls for the same key.
+type Store interface {
+	// Get returns the record for key, or a zero Record if there is none
+	Get(key string) (Record, error)
+
+	// Update loads the record for key (zero if missing), passes it to fn
+	// and saves the result
+	Update(key string, fn func(*Record)) (Record, error)
+
+	// Delete forgets key
+	Delete(key string) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Limiter
+///////////////////////////////////////////////////////////////////////////////
+
+// Policy decides when repeated failures lock a key and for how long
+type Policy struct {
+	// Threshold is how many failures are allowed before the first lockout
+	Threshold int
+	// BaseDelay is the first lockout; each further failure doubles it
+	BaseDelay time.Duration
+	// MaxDelay caps a single lockout
+	MaxDelay time.Duration
+	// ResetAfter forgets failures once a key has been quiet this long
+	ResetAfter time.Duration
+}
+
+// delay returns the lockout earned by the given number of failures
+func (p Policy) delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := p.Threshold; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// Result describes a key after a failure was recorded
+type Result struct {
+	// RetryAfter is how long the key is locked for, zero if it is not
+	RetryAfter time.Duration
+	// NewlyLocked is true for the failure that first locks the key
+	// since it was last reset
+	NewlyLocked bool
+}
+
+// Limiter applies a Policy to the keys of one kind, such as accounts,
+// kept in Store under Prefix.
+type Limiter struct {
+	Store  Store
+	Policy Policy
+	Prefix string
+}
+
+// Check returns how long key remains locked, zero if it may try now
+func (l *Limiter) Check(key string) (time.Duration, error) {
+	rec, err := l.Store.Get(l.Prefix + key)
+	if err != nil {
+		return 0, err
+	}
+	return remaining(rec.LockedUntil, time.Now()), nil
+}
+
+// Fail records a failed attempt for key
+func (l *Limiter) Fail(key string) (Result, error) {
+	now := time.Now()
+	var res Result
+	_, err := l.Store.Update(l.Prefix+key, func(rec *Record) {
+		if !rec.LastFailure.IsZero() && now.Sub(rec.LastFailure) > l.Policy.ResetAfter {
+			*rec = Record{}
+		}
+		rec.Failures++
+		rec.LastFailure = now
+
+		if d := l.Policy.delay(rec.Failures); d > 0 {
+			rec.LockedUntil = now.Add(d)
+			res.RetryAfter = d
+			res.NewlyLocked = rec.Failures == l.Policy.Threshold
+		}
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return res, nil
+}
+
+// Reset forgets the failures of key, e.g. after a successful login
+func (l *Limiter) Reset(key string) error {
+	return l.Store.Delete(l.Prefix + key)
+}
+
+func remaining(until, now time.Time) time.Duration {
+	if d := until.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
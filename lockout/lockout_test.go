@@ -0,0 +1,186 @@
+package lockout
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	Threshold:  3,
+	BaseDelay:  time.Minute,
+	MaxDelay:   10 * time.Minute,
+	ResetAfter: time.Hour,
+}
+
+func TestPolicyDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 8 * time.Minute},
+		{7, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := testPolicy.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func newTestLimiter() *Limiter {
+	return &Limiter{
+		Store:  NewMemoryStore(time.Hour),
+		Policy: testPolicy,
+		Prefix: "account:",
+	}
+}
+
+func TestLimiterLocksAfterThreshold(t *testing.T) {
+	l := newTestLimiter()
+
+	want := []Result{
+		{},
+		{},
+		{RetryAfter: time.Minute, NewlyLocked: true},
+		{RetryAfter: 2 * time.Minute},
+	}
+	for i, w := range want {
+		got, err := l.Fail("jo@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Errorf("failure %d: Fail = %+v, want %+v", i+1, got, w)
+		}
+	}
+
+	wait, err := l.Check("jo@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= time.Minute || wait > 2*time.Minute {
+		t.Errorf("Check = %v, want just under 2m", wait)
+	}
+}
+
+func TestLimiterReset(t *testing.T) {
+	l := newTestLimiter()
+	for i := 0; i < testPolicy.Threshold; i++ {
+		if _, err := l.Fail("jo@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Reset("jo@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if wait, _ := l.Check("jo@example.com"); wait != 0 {
+		t.Errorf("Check after Reset = %v, want 0", wait)
+	}
+	res, _ := l.Fail("jo@example.com")
+	if res.RetryAfter != 0 {
+		t.Errorf("first failure after Reset locked the key for %v", res.RetryAfter)
+	}
+}
+
+func TestLimiterForgetsQuietKeys(t *testing.T) {
+	l := newTestLimiter()
+	_, err := l.Store.Update("account:jo@example.com", func(rec *Record) {
+		rec.Failures = 10
+		rec.LastFailure = time.Now().Add(-2 * testPolicy.ResetAfter)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := l.Fail("jo@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetryAfter != 0 {
+		t.Errorf("Fail after a quiet period locked the key for %v", res.RetryAfter)
+	}
+	rec, _ := l.Store.Get("account:jo@example.com")
+	if rec.Failures != 1 {
+		t.Errorf("Failures = %d, want 1", rec.Failures)
+	}
+}
+
+func TestLimiterPrefixesKeys(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	accounts := &Limiter{Store: store, Policy: Policy{Threshold: 1, BaseDelay: time.Minute, MaxDelay: time.Minute, ResetAfter: time.Hour}, Prefix: "account:"}
+	ips := &Limiter{Store: store, Policy: accounts.Policy, Prefix: "ip:"}
+
+	if _, err := accounts.Fail("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := accounts.Check("192.0.2.1"); wait == 0 {
+		t.Error("account key is not locked")
+	}
+	if wait, _ := ips.Check("192.0.2.1"); wait != 0 {
+		t.Errorf("IP key with the same name is locked for %v", wait)
+	}
+}
+
+func TestLimiterConcurrentFailures(t *testing.T) {
+	l := newTestLimiter()
+	const n = 100
+
+	var wg sync.WaitGroup
+	newlyLocked := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := l.Fail("jo@example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			newlyLocked <- res.NewlyLocked
+		}()
+	}
+	wg.Wait()
+	close(newlyLocked)
+
+	rec, _ := l.Store.Get("account:jo@example.com")
+	if rec.Failures != n {
+		t.Errorf("Failures = %d, want %d", rec.Failures, n)
+	}
+	locks := 0
+	for newly := range newlyLocked {
+		if newly {
+			locks++
+		}
+	}
+	if locks != 1 {
+		t.Errorf("%d failures reported locking the key, want 1", locks)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	ms := NewMemoryStore(time.Hour)
+	now := time.Now()
+	ms.records = map[string]Record{
+		"stale":  {Failures: 1, LastFailure: now.Add(-2 * time.Hour)},
+		"recent": {Failures: 1, LastFailure: now.Add(-time.Minute)},
+		"locked": {Failures: 9, LastFailure: now.Add(-2 * time.Hour), LockedUntil: now.Add(time.Hour)},
+	}
+
+	ms.sweep(now)
+
+	if _, ok := ms.records["stale"]; ok {
+		t.Error("stale record was kept")
+	}
+	for _, key := range []string{"recent", "locked"} {
+		if _, ok := ms.records[key]; !ok {
+			t.Errorf("%s record was swept", key)
+		}
+	}
+}
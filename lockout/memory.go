@@ -0,0 +1,71 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many updates pass between sweeps for stale records
+const sweepEvery = 1024
+
+// MemoryStore keeps records in process memory. Records untouched for TTL
+// are swept away. It suits a single server; use a shared store when
+// running several.
+type MemoryStore struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	records map[string]Record
+	updates int
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		TTL:     ttl,
+		records: map[string]Record{},
+	}
+}
+
+// Get
+func (ms *MemoryStore) Get(key string) (Record, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.records[key], nil
+}
+
+// Update
+func (ms *MemoryStore) Update(key string, fn func(*Record)) (Record, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	rec := ms.records[key]
+	fn(&rec)
+	ms.records[key] = rec
+
+	ms.updates++
+	if ms.updates%sweepEvery == 0 {
+		ms.sweep(time.Now())
+	}
+	return rec, nil
+}
+
+// Delete
+func (ms *MemoryStore) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.records, key)
+	return nil
+}
+
+// sweep drops records that are no longer locked and have been quiet for
+// TTL. The caller must hold ms.mu.
+func (ms *MemoryStore) sweep(now time.Time) {
+	for key, rec := range ms.records {
+		if now.After(rec.LockedUntil) && now.Sub(rec.LastFailure) > ms.TTL {
+			delete(ms.records, key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CaptureMailer keeps every message in memory instead of sending it, and
+// also writes each one as an .eml file when Dir is set. It is meant for
+// development and tests.
+type CaptureMailer struct {
+	Dir string
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewCaptureMailer returns a CaptureMailer writing into dir, or only
+// keeping messages in memory when dir is empty.
+func NewCaptureMailer(dir string) *CaptureMailer {
+	return &CaptureMailer{
+		Dir: dir,
+	}
+}
+
+// Send records msg
+func (cm *CaptureMailer) Send(ctx context.Context, msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.messages = append(cm.messages, *msg)
+	if cm.Dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(cm.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%03d.eml", time.Now().Format("20060102-150405"), len(cm.messages))
+	return os.WriteFile(filepath.Join(cm.Dir, name), body, 0o644)
+}
+
+// Messages returns a copy of every message captured so far
+func (cm *CaptureMailer) Messages() []Message {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	out := make([]Message, len(cm.messages))
+	copy(out, cm.messages)
+	return out
+}
+
+// Reset forgets every captured message
+func (cm *CaptureMailer) Reset() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.messages = nil
+}
@@ -0,0 +1,76 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureMailer(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  bool
+	}{
+		{"memory only", false},
+		{"with directory", true},
+	}
+	for _, tt := range tests {
+		var dir string
+		if tt.dir {
+			dir = filepath.Join(t.TempDir(), "mail")
+		}
+		cm := NewCaptureMailer(dir)
+
+		for _, subject := range []string{"first", "second"} {
+			if err := cm.Send(context.Background(), testMessage(subject)); err != nil {
+				t.Fatalf("%s: Send: %v", tt.name, err)
+			}
+		}
+
+		msgs := cm.Messages()
+		if len(msgs) != 2 || msgs[0].Subject != "first" || msgs[1].Subject != "second" {
+			t.Errorf("%s: Messages = %+v", tt.name, msgs)
+		}
+		// Messages returns a copy
+		msgs[0].Subject = "changed"
+		if cm.Messages()[0].Subject != "first" {
+			t.Errorf("%s: Messages shares its slice", tt.name)
+		}
+
+		if tt.dir {
+			files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 2 {
+				t.Fatalf("%s: %d .eml files, want 2", tt.name, len(files))
+			}
+			body, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), "Subject: first\r\n") {
+				t.Errorf("%s: .eml file has no subject header:\n%s", tt.name, body)
+			}
+		}
+
+		cm.Reset()
+		if n := len(cm.Messages()); n != 0 {
+			t.Errorf("%s: %d messages after Reset, want 0", tt.name, n)
+		}
+	}
+}
+
+func TestCaptureMailerRejectsInvalidMessages(t *testing.T) {
+	cm := NewCaptureMailer("")
+	msg := testMessage("Hi")
+	msg.Text = ""
+	if err := cm.Send(context.Background(), msg); err == nil {
+		t.Error("Send accepted a message without a body")
+	}
+	if n := len(cm.Messages()); n != 0 {
+		t.Errorf("%d messages captured, want 0", n)
+	}
+}
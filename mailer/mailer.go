@@ -0,0 +1,148 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/rand"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Mailer
+///////////////////////////////////////////////////////////////////////////////
+
+// Mailer delivers a single message. Implementations must be safe for
+// concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Message is an email with a plain text body and an optional HTML
+// alternative.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// New returns the mailer selected by config.MailBackend, wrapped in a
+// Queue so callers never wait on delivery. Close the queue on shutdown.
+func New() *Queue {
+	var m Mailer
+	switch config.MailBackend {
+	case "smtp":
+		m = &SMTPMailer{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+		}
+	default:
+		if config.MailBackend != "capture" {
+			log.Printf("Unknown MAIL_BACKEND %q, capturing mail instead", config.MailBackend)
+		}
+		m = NewCaptureMailer(config.MailCaptureDir)
+	}
+	return NewQueue(m, defaultWorkers, defaultQueueSize)
+}
+
+// validate checks that a message can be sent at all
+func (msg *Message) validate() error {
+	if msg.From == "" {
+		return errors.New("mailer: message has no sender")
+	}
+	if len(msg.To) == 0 {
+		return errors.New("mailer: message has no recipients")
+	}
+	if msg.Text == "" && msg.HTML == "" {
+		return errors.New("mailer: message has no body")
+	}
+	return nil
+}
+
+// Bytes renders the message in RFC 5322 format as a multipart/alternative
+// MIME message.
+func (msg *Message) Bytes() ([]byte, error) {
+	if err := msg.validate(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	id, err := rand.String(16)
+	if err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(msg.From, "@"); at >= 0 {
+		domain = strings.Trim(msg.From[at+1:], "> ")
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", msg.From)
+	header.Set("To", strings.Join(msg.To, ", "))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", fmt.Sprintf("<%s@%s>", strings.TrimRight(id, "="), domain))
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+
+	var head bytes.Buffer
+	for _, k := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"} {
+		fmt.Fprintf(&head, "%s: %s\r\n", k, header.Get(k))
+	}
+	head.WriteString("\r\n")
+
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+	for _, p := range parts {
+		if p.body == "" {
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return append(head.Bytes(), buf.Bytes()...), nil
+}
+
+// addressOf strips the display name from an address such as
+// "LensLocked <noreply@lenslocked.com>"
+func addressOf(s string) string {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return s
+	}
+	return addr.Address
+}
@@ -0,0 +1,137 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers   = 2
+	defaultQueueSize = 256
+
+	// maxAttempts is how many times a message is tried before it is dropped
+	maxAttempts = 5
+)
+
+// firstBackoff is the wait after the first failure; it doubles each time.
+// Tests shorten it.
+var firstBackoff = 2 * time.Second
+
+var ErrQueueFull = errors.New("mailer: queue is full")
+var ErrQueueClosed = errors.New("mailer: queue is closed")
+
+// Queue sends messages in the background through another Mailer, retrying
+// failures with exponential backoff. Send only enqueues, so request
+// handlers are never blocked by a slow mail server.
+type Queue struct {
+	next Mailer
+	jobs chan *Message
+	done chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+	abort  sync.Once
+}
+
+// NewQueue starts workers goroutines delivering through next
+func NewQueue(next Mailer, workers, size int) *Queue {
+	q := &Queue{
+		next: next,
+		jobs: make(chan *Message, size),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Send enqueues msg for delivery. It fails fast when the queue is full.
+func (q *Queue) Send(ctx context.Context, msg *Message) error {
+	if err := msg.validate(); err != nil {
+		return err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case q.jobs <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting messages and waits for the queued ones to be
+// delivered or to run out of attempts. Messages still waiting on a retry
+// backoff when ctx is done are dropped.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		q.abort.Do(func() { close(q.done) })
+		<-finished
+		return ctx.Err()
+	}
+}
+
+// Unwrap returns the Mailer the queue delivers through
+func (q *Queue) Unwrap() Mailer {
+	return q.next
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for msg := range q.jobs {
+		q.deliver(msg)
+	}
+}
+
+// deliver tries msg until it succeeds or runs out of attempts
+func (q *Queue) deliver(msg *Message) {
+	backoff := firstBackoff
+	for attempt := 1; ; attempt++ {
+		err := q.next.Send(context.Background(), msg)
+		if err == nil {
+			return
+		}
+		if attempt == maxAttempts {
+			log.Printf("mailer: giving up on %q to %v after %d attempts: %v", msg.Subject, msg.To, attempt, err)
+			return
+		}
+		log.Printf("mailer: attempt %d for %q failed, retrying in %s: %v", attempt, msg.Subject, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-q.done:
+			log.Printf("mailer: dropping %q to %v on shutdown", msg.Subject, msg.To)
+			return
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,146 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyMailer fails the first failures sends and hands the rest to a
+// CaptureMailer
+type flakyMailer struct {
+	failures int
+
+	mu       sync.Mutex
+	attempts []time.Time
+	capture  CaptureMailer
+}
+
+func (fm *flakyMailer) Send(ctx context.Context, msg *Message) error {
+	fm.mu.Lock()
+	fm.attempts = append(fm.attempts, time.Now())
+	n := len(fm.attempts)
+	fm.mu.Unlock()
+
+	if n <= fm.failures {
+		return errors.New("connection refused")
+	}
+	return fm.capture.Send(ctx, msg)
+}
+
+func (fm *flakyMailer) Attempts() []time.Time {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return append([]time.Time(nil), fm.attempts...)
+}
+
+func testMessage(subject string) *Message {
+	return &Message{
+		From:    "LensLocked <noreply@lenslocked.com>",
+		To:      []string{"jo@example.com"},
+		Subject: subject,
+		Text:    "Hello\n",
+	}
+}
+
+// shortBackoff makes retries fast for the length of a test
+func shortBackoff(t *testing.T) {
+	saved := firstBackoff
+	firstBackoff = time.Millisecond
+	t.Cleanup(func() { firstBackoff = saved })
+}
+
+func TestQueueRetries(t *testing.T) {
+	shortBackoff(t)
+
+	tests := []struct {
+		failures      int
+		wantAttempts  int
+		wantDelivered bool
+	}{
+		{0, 1, true},
+		{1, 2, true},
+		{3, 4, true},
+		{maxAttempts - 1, maxAttempts, true},
+		{maxAttempts, maxAttempts, false},
+		{maxAttempts + 3, maxAttempts, false},
+	}
+	for _, tt := range tests {
+		fm := &flakyMailer{failures: tt.failures}
+		q := NewQueue(fm, 1, 1)
+		if err := q.Send(context.Background(), testMessage("Hi")); err != nil {
+			t.Fatalf("%d failures: Send: %v", tt.failures, err)
+		}
+		if err := q.Close(context.Background()); err != nil {
+			t.Fatalf("%d failures: Close: %v", tt.failures, err)
+		}
+
+		attempts := fm.Attempts()
+		if len(attempts) != tt.wantAttempts {
+			t.Errorf("%d failures: %d attempts, want %d", tt.failures, len(attempts), tt.wantAttempts)
+		}
+		if delivered := len(fm.capture.Messages()) == 1; delivered != tt.wantDelivered {
+			t.Errorf("%d failures: delivered = %v, want %v", tt.failures, delivered, tt.wantDelivered)
+		}
+
+		// Each wait is at least twice the one before
+		backoff := firstBackoff
+		for i := 1; i < len(attempts); i++ {
+			if gap := attempts[i].Sub(attempts[i-1]); gap < backoff {
+				t.Errorf("%d failures: wait before attempt %d was %v, want at least %v", tt.failures, i+1, gap, backoff)
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func TestQueueCloseDropsMessagesInBackoff(t *testing.T) {
+	saved := firstBackoff
+	firstBackoff = time.Hour
+	defer func() { firstBackoff = saved }()
+
+	fm := &flakyMailer{failures: 1}
+	q := NewQueue(fm, 1, 1)
+	if err := q.Send(context.Background(), testMessage("Hi")); err != nil {
+		t.Fatal(err)
+	}
+	for len(fm.Attempts()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Close = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := len(fm.Attempts()); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+	if n := len(fm.capture.Messages()); n != 0 {
+		t.Errorf("%d messages delivered, want 0", n)
+	}
+}
+
+func TestQueueSendErrors(t *testing.T) {
+	// No workers, so nothing leaves the queue
+	q := NewQueue(&flakyMailer{}, 0, 1)
+
+	if err := q.Send(context.Background(), &Message{To: []string{"jo@example.com"}, Text: "Hi"}); err == nil {
+		t.Error("Send accepted a message without a sender")
+	}
+	if err := q.Send(context.Background(), testMessage("first")); err != nil {
+		t.Fatalf("Send = %v, want nil", err)
+	}
+	if err := q.Send(context.Background(), testMessage("second")); err != ErrQueueFull {
+		t.Errorf("Send on a full queue = %v, want %v", err, ErrQueueFull)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q.Close(ctx)
+	if err := q.Send(context.Background(), testMessage("third")); err != ErrQueueClosed {
+		t.Errorf("Send after Close = %v, want %v", err, ErrQueueClosed)
+	}
+}
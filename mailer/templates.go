@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/pranav244872/lenslocked.com/config"
+)
+
+// Every email is a pair of templates in templates/: <name>.txt, which
+// also defines the "subject" block, and an optional <name>.html.
+//
+//go:embed templates/*
+var templateFS embed.FS
+
+var textTemplates, htmlTemplates = mustParseTemplates()
+
+// mustParseTemplates parses each template file into its own set so every
+// email can define its own "subject" block.
+func mustParseTemplates() (map[string]*texttemplate.Template, map[string]*htmltemplate.Template) {
+	texts := map[string]*texttemplate.Template{}
+	htmls := map[string]*htmltemplate.Template{}
+
+	files, err := fs.Glob(templateFS, "templates/*")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		ext := path.Ext(file)
+		name := strings.TrimSuffix(path.Base(file), ext)
+		switch ext {
+		case ".txt":
+			texts[name] = texttemplate.Must(texttemplate.ParseFS(templateFS, file))
+		case ".html":
+			htmls[name] = htmltemplate.Must(htmltemplate.ParseFS(templateFS, file))
+		}
+	}
+	return texts, htmls
+}
+
+// NewMessage renders the named email for one recipient. data is passed to
+// both the text and HTML templates.
+func NewMessage(to, name string, data any) (*Message, error) {
+	tt, ok := textTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("mailer: unknown template %q", name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tt.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := tt.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if ht, ok := htmlTemplates[name]; ok {
+		if err := ht.Execute(&html, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Message{
+		From:    config.MailFrom,
+		To:      []string{to},
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
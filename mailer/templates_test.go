@@ -0,0 +1,114 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pranav244872/lenslocked.com/config"
+)
+
+// templateData has the fields each email is rendered with
+var templateData = map[string]map[string]any{
+	"account_deletion_scheduled": {"Name": "Jo", "DeleteAfter": "2 May 2026", "URL": "https://app.test/account"},
+	"account_locked":             {"Name": "Jo", "IP": "203.0.113.7", "LockedFor": "30 seconds", "ResetURL": "https://app.test/reset"},
+	"email_change_requested":     {"Name": "Jo", "NewEmail": "new@example.com", "ResetURL": "https://app.test/reset"},
+	"password_changed":           {"Name": "Jo", "ResetURL": "https://app.test/reset"},
+	"password_reset":             {"Name": "Jo", "URL": "https://app.test/reset?token=abc", "ExpiresIn": "1 hour"},
+	"selection_submitted":        {"Name": "Jo", "Label": "Smith wedding", "Gallery": "Wedding", "Picks": 3, "URL": "https://app.test/selection"},
+	"verify_email":               {"Name": "Jo", "Email": "jo@example.com", "URL": "https://app.test/verify?token=abc", "ExpiresIn": "2 days"},
+}
+
+func TestEveryTemplateRenders(t *testing.T) {
+	saved := config.MailFrom
+	config.MailFrom = "LensLocked <noreply@lenslocked.com>"
+	defer func() { config.MailFrom = saved }()
+
+	for name := range textTemplates {
+		data, ok := templateData[name]
+		if !ok {
+			t.Errorf("%s: no test data", name)
+			continue
+		}
+		msg, err := NewMessage("jo@example.com", name, data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if msg.From != config.MailFrom || len(msg.To) != 1 || msg.To[0] != "jo@example.com" {
+			t.Errorf("%s: From = %q, To = %v", name, msg.From, msg.To)
+		}
+		if msg.Subject == "" || strings.Contains(msg.Subject, "\n") {
+			t.Errorf("%s: bad subject %q", name, msg.Subject)
+		}
+		if strings.HasPrefix(msg.Text, msg.Subject) {
+			t.Errorf("%s: subject leaked into the body", name)
+		}
+		for key, value := range data {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			if !strings.Contains(msg.Text, s) {
+				t.Errorf("%s: text is missing %s %q", name, key, s)
+			}
+			if _, ok := htmlTemplates[name]; ok && !strings.Contains(msg.HTML, s) {
+				t.Errorf("%s: HTML is missing %s %q", name, key, s)
+			}
+		}
+		// A field the data lacks renders as "<no value>"
+		if strings.Contains(msg.Text, "<no value>") {
+			t.Errorf("%s: text uses a field without data", name)
+		}
+		if _, err := msg.Bytes(); err != nil {
+			t.Errorf("%s: Bytes: %v", name, err)
+		}
+	}
+	for name := range htmlTemplates {
+		if _, ok := textTemplates[name]; !ok {
+			t.Errorf("%s: HTML template has no text template", name)
+		}
+	}
+}
+
+func TestTemplateConditionals(t *testing.T) {
+	tests := []struct {
+		label string
+		picks int
+		want  []string
+	}{
+		{"Smith wedding", 1, []string{"Smith wedding submitted", "picked 1 image."}},
+		{"", 3, []string{"A client submitted", "picked 3 images."}},
+	}
+	for _, tt := range tests {
+		msg, err := NewMessage("jo@example.com", "selection_submitted", map[string]any{
+			"Name": "Jo", "Label": tt.label, "Gallery": "Wedding", "Picks": tt.picks, "URL": "https://app.test/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(msg.Text, want) {
+				t.Errorf("label %q, %d picks: text %q is missing %q", tt.label, tt.picks, msg.Text, want)
+			}
+		}
+	}
+}
+
+func TestHTMLIsEscaped(t *testing.T) {
+	msg, err := NewMessage("jo@example.com", "password_changed", map[string]any{
+		"Name": "<script>alert(1)</script>", "ResetURL": "https://app.test/reset",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg.HTML, "<script>") {
+		t.Errorf("HTML was not escaped: %s", msg.HTML)
+	}
+}
+
+func TestUnknownTemplate(t *testing.T) {
+	if _, err := NewMessage("jo@example.com", "no_such_email", nil); err == nil {
+		t.Error("NewMessage accepted an unknown template")
+	}
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/pranav244872/lenslocked.com/config"
 	"github.com/pranav244872/lenslocked.com/controllers"
+	"github.com/pranav244872/lenslocked.com/lockout"
+	"github.com/pranav244872/lenslocked.com/mailer"
 	"github.com/pranav244872/lenslocked.com/models"
+	"github.com/pranav244872/lenslocked.com/ratelimit"
+	"github.com/pranav244872/lenslocked.com/storage"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -33,46 +39,183 @@ func main() {
 	// Load environment variables from .env
 	config.LoadEnv()
 
+	// Image file storage
+	store, err := storage.New()
+	must(err)
+
 	// Connect to database
 	dsn := config.GetDSN()
-	userService, err := models.NewUserService(dsn)
+	services, err := models.NewServices(dsn, store)
 	must(err)
 	defer func() {
 		log.Println("Closing database connection...")
-		if err := userService.DB.Close(); err != nil {
+		if err := services.Close(); err != nil {
 			log.Printf("Error closing DB: %v", err)
 		}
 	}()
 
 	log.Println("Database connected")
 	// Auto-migrate schema
-	must(userService.DB.AutoMigrate())
+	must(services.AutoMigrate())
+
+	// Resumable uploads that were abandoned
+	services.Upload.StartExpiring(time.Hour)
+	defer services.Upload.Close()
+
+	// Accounts whose deletion grace period is over
+	services.Purger.Start(time.Hour)
+	defer services.Purger.Close()
+
+	// Image processing left unfinished by the last run
+	must(services.Image.ResumeProcessing())
+	defer func() {
+		log.Println("Stopping image workers...")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := services.Image.Close(ctx); err != nil {
+			log.Printf("Error stopping image workers: %v", err)
+		}
+	}()
+
+	// Outbound email
+	mail := mailer.New()
+	defer func() {
+		log.Println("Flushing outgoing email...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := mail.Close(ctx); err != nil {
+			log.Printf("Error flushing email: %v", err)
+		}
+	}()
+
+	// Login failure counters
+	var loginAttempts lockout.Store = services.LoginAttempts
+	if config.LockoutStore != "postgres" {
+		loginAttempts = lockout.NewMemoryStore(config.LoginFailureWindow)
+	}
 
 	// Controllers
-	usersC := controllers.NewUsers(userService)
+	usersC := controllers.NewUsers(services.User, services.Session, mail, loginAttempts)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.ShareLink, services.Upload, services.User, mail)
+
+	// Middleware
+	auth := controllers.NewAuth(services.User, services.Session)
+
+	// Rate limits
+	defaultLimit := ratelimit.New(config.RateLimitDefault.Requests, config.RateLimitDefault.Per)
+	// Every login-style route gets its own limiter, so guessing on one
+	// does not use up the quota of the others
+	loginLimit := func(next http.Handler) http.Handler {
+		return ratelimit.New(config.RateLimitLogin.Requests, config.RateLimitLogin.Per).Middleware(ratelimit.ByIP)(next)
+	}
+	signupLimit := ratelimit.New(config.RateLimitSignup.Requests, config.RateLimitSignup.Per).Middleware(ratelimit.ByIP)
+	uploadLimit := ratelimit.New(config.RateLimitUpload.Requests, config.RateLimitUpload.Per).Middleware(ratelimit.ByUser)
+	shareLimit := ratelimit.New(config.RateLimitShare.Requests, config.RateLimitShare.Per).Middleware(ratelimit.ByIP)
 
 	// Router
 	r := mux.NewRouter()
+	r.Use(defaultLimit.Middleware(ratelimit.ByIP))
 
 	// User routes
-	r.HandleFunc("/api/signup", usersC.Create).Methods("POST")
-	r.HandleFunc("/api/login", usersC.Login).Methods("POST")
-	r.HandleFunc("/api/cookietest", usersC.CookieTest).Methods("GET")
+	r.Handle("/api/signup", signupLimit(http.HandlerFunc(usersC.Create))).Methods("POST")
+	r.Handle("/api/login", loginLimit(http.HandlerFunc(usersC.Login))).Methods("POST")
+	r.Handle("/api/login/2fa", loginLimit(http.HandlerFunc(usersC.LoginTwoFactor))).Methods("POST")
+	r.Handle("/api/logout", auth.RequireUserFn(usersC.Logout)).Methods("POST")
+	r.Handle("/api/logout/all", auth.RequireUserFn(usersC.LogoutAll)).Methods("POST")
+	r.Handle("/api/password/forgot", loginLimit(http.HandlerFunc(usersC.ForgotPassword))).Methods("POST")
+	r.Handle("/api/password/reset", loginLimit(http.HandlerFunc(usersC.ResetPassword))).Methods("POST")
+	r.HandleFunc("/api/verify-email", usersC.VerifyEmail).Methods("GET")
+	r.Handle("/api/verify-email/resend", auth.RequireUserFn(usersC.ResendVerification)).Methods("POST")
+	r.Handle("/api/me/password", loginLimit(auth.RequireUserFn(usersC.ChangePassword))).Methods("PUT")
+	r.Handle("/api/me/email", loginLimit(auth.RequireUserFn(usersC.ChangeEmail))).Methods("PUT")
+	r.Handle("/api/me/deletion", loginLimit(auth.RequireUserFn(usersC.ScheduleDeletion))).Methods("POST")
+	r.Handle("/api/me/deletion", auth.RequireUserFn(usersC.CancelDeletion)).Methods("DELETE")
+	r.Handle("/api/2fa/setup", auth.RequireUserFn(usersC.SetupTwoFactor)).Methods("POST")
+	r.Handle("/api/2fa/confirm", loginLimit(auth.RequireUserFn(usersC.ConfirmTwoFactor))).Methods("POST")
+	r.Handle("/api/2fa/disable", loginLimit(auth.RequireUserFn(usersC.DisableTwoFactor))).Methods("POST")
+	r.Handle("/api/cookietest", auth.RequireUserFn(usersC.CookieTest)).Methods("GET")
+
+	// Gallery routes
+	r.Handle("/api/galleries", auth.RequireUserFn(galleriesC.Index)).Methods("GET")
+	r.Handle("/api/galleries", auth.RequireUserFn(galleriesC.Create)).Methods("POST")
+	r.Handle("/api/galleries/{id:[0-9]+}", auth.MaybeUserFn(galleriesC.Show)).Methods("GET")
+	r.Handle("/api/galleries/{id:[0-9]+}", auth.RequireUserFn(galleriesC.Update)).Methods("PUT")
+	r.Handle("/api/galleries/{id:[0-9]+}", auth.RequireUserFn(galleriesC.Delete)).Methods("DELETE")
+	r.Handle("/api/g/{slug}", auth.MaybeUserFn(galleriesC.Show)).Methods("GET")
+	r.Handle("/api/users/{id:[0-9]+}/galleries", auth.MaybeUserFn(galleriesC.Profile)).Methods("GET")
+
+	// Image routes
+	r.Handle("/api/galleries/{id:[0-9]+}/images", auth.MaybeUserFn(galleriesC.Images)).Methods("GET")
+	r.Handle("/api/g/{slug}/images", auth.MaybeUserFn(galleriesC.Images)).Methods("GET")
+	r.Handle("/api/galleries/{id:[0-9]+}/images", auth.RequireUser(uploadLimit(http.HandlerFunc(galleriesC.UploadImages)))).Methods("POST")
+	r.Handle("/api/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}", auth.RequireUserFn(galleriesC.DeleteImage)).Methods("DELETE")
+	r.Handle("/api/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/derivatives/retry", auth.RequireUserFn(galleriesC.RetryDerivatives)).Methods("POST")
+
+	// Resumable upload routes, following the tus 1.0 protocol
+	r.HandleFunc("/api/galleries/{id:[0-9]+}/uploads", galleriesC.UploadOptions).Methods("OPTIONS")
+	r.Handle("/api/galleries/{id:[0-9]+}/uploads", auth.RequireUser(uploadLimit(http.HandlerFunc(galleriesC.CreateUpload)))).Methods("POST")
+	r.Handle("/api/galleries/{id:[0-9]+}/uploads/{uploadID}", auth.RequireUserFn(galleriesC.UploadStatus)).Methods("HEAD")
+	r.Handle("/api/galleries/{id:[0-9]+}/uploads/{uploadID}", auth.RequireUser(uploadLimit(http.HandlerFunc(galleriesC.WriteUpload)))).Methods("PATCH")
+	r.Handle("/api/galleries/{id:[0-9]+}/uploads/{uploadID}", auth.RequireUserFn(galleriesC.TerminateUpload)).Methods("DELETE")
+
+	// Gallery download routes
+	r.Handle("/api/galleries/{id:[0-9]+}/download", auth.MaybeUserFn(galleriesC.Download)).Methods("GET")
+	r.Handle("/api/galleries/{id:[0-9]+}/downloads", auth.RequireUserFn(galleriesC.Downloads)).Methods("GET")
+	r.Handle("/api/share/{token}/download", shareLimit(auth.MaybeUserFn(galleriesC.Download))).Methods("GET")
+
+	// Share link routes. Links can carry a password, so opening them has
+	// its own limit.
+	r.Handle("/api/galleries/{id:[0-9]+}/links", auth.RequireUserFn(galleriesC.ShareLinks)).Methods("GET")
+	r.Handle("/api/galleries/{id:[0-9]+}/links", auth.RequireVerifiedUserFn(galleriesC.CreateShareLink)).Methods("POST")
+	r.Handle("/api/galleries/{id:[0-9]+}/links/{linkID:[0-9]+}", auth.RequireUserFn(galleriesC.RevokeShareLink)).Methods("DELETE")
+	r.Handle("/api/share/{token}", shareLimit(auth.MaybeUserFn(galleriesC.SharedGallery))).Methods("GET")
+	r.Handle("/api/share/{token}/images", shareLimit(auth.MaybeUserFn(galleriesC.Images))).Methods("GET")
+
+	// Proofing routes: clients pick images through a share link and the
+	// owner reviews the selection
+	r.Handle("/api/share/{token}/selection", shareLimit(auth.MaybeUserFn(galleriesC.Selection))).Methods("GET")
+	r.Handle("/api/share/{token}/selection/{imageID:[0-9]+}", shareLimit(auth.MaybeUserFn(galleriesC.Select))).Methods("PUT")
+	r.Handle("/api/share/{token}/selection/submit", shareLimit(auth.MaybeUserFn(galleriesC.SubmitSelection))).Methods("POST")
+	r.Handle("/api/galleries/{id:[0-9]+}/links/{linkID:[0-9]+}/selection", auth.RequireUserFn(galleriesC.LinkSelection)).Methods("GET")
+	r.Handle("/api/galleries/{id:[0-9]+}/links/{linkID:[0-9]+}/selection.csv", auth.RequireUserFn(galleriesC.ExportSelection)).Methods("GET")
+	r.Handle("/api/galleries/{id:[0-9]+}/links/{linkID:[0-9]+}/selection/reopen", auth.RequireUserFn(galleriesC.ReopenSelection)).Methods("POST")
+
+	// Files of the local storage backend, reachable through signed URLs
+	if local, ok := store.(*storage.Local); ok {
+		r.PathPrefix("/files/").Handler(http.StripPrefix("/files", local)).Methods("GET", "HEAD")
+	}
 
 	// CORS configuration
 	allowedOrigins := handlers.AllowedOrigins([]string{config.ClientOrigin})
-	allowedMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
-	allowedHeaders := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
+	allowedMethods := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
+	allowedHeaders := handlers.AllowedHeaders([]string{
+		"X-Requested-With", "Content-Type", "Authorization", "X-Share-Password",
+		"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset",
+	})
 	allowedCredentials := handlers.AllowCredentials()
+	exposedHeaders := handlers.ExposedHeaders([]string{
+		"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After",
+		"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+		"Upload-Offset", "Upload-Length", "Upload-Expires",
+	})
 
 	// Graceful shutdown
 	go func() {
 		addr := config.ServerHost + ":" + config.ServerPort
 		log.Println("Server starting on https://" + addr)
 
-		handler := handlers.CORS(
-			allowedOrigins, allowedMethods, allowedHeaders, allowedCredentials,
+		cors := handlers.CORS(
+			allowedOrigins, allowedMethods, allowedHeaders, allowedCredentials, exposedHeaders,
 		)(r)
+		// The CORS handler answers every OPTIONS request itself, but tus
+		// clients also send plain ones to discover what the server supports
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") == "" {
+				r.ServeHTTP(w, req)
+				return
+			}
+			cors.ServeHTTP(w, req)
+		})
 
 		if err := http.ListenAndServeTLS(":"+config.ServerPort, config.CertFile, config.KeyFile, handler); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Could not start HTTPS server on https://%s: %v", addr, err)
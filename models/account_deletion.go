@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Account Purging
+///////////////////////////////////////////////////////////////////////////////
+
+// AccountPurger permanently deletes the accounts whose deletion grace
+// period has passed, along with their galleries, images and stored files.
+// Every step can be repeated, so an account that fails part way through is
+// picked up again on the next run.
+type AccountPurger struct {
+	users     *UserService
+	galleries GalleryDB
+	images    *ImageService
+	links     *ShareLinkService
+	uploads   *UploadService
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newAccountPurger(us *UserService, gs *GalleryService, is *ImageService, sls *ShareLinkService, ups *UploadService) *AccountPurger {
+	return &AccountPurger{
+		users:     us,
+		galleries: gs.DB,
+		images:    is,
+		links:     sls,
+		uploads:   ups,
+	}
+}
+
+// Start purges the accounts that are due every interval until Close is
+// called
+func (ap *AccountPurger) Start(interval time.Duration) {
+	ap.stop = make(chan struct{})
+	ap.done = make(chan struct{})
+	go func() {
+		defer close(ap.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := ap.purgeDue(context.Background()); err != nil {
+				log.Printf("accounts: finding accounts to purge: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ap.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops purging accounts
+func (ap *AccountPurger) Close() {
+	if ap.stop == nil {
+		return
+	}
+	close(ap.stop)
+	<-ap.done
+}
+
+// purgeDue purges every account that is due. A failure for one account is
+// logged and does not hold up the others.
+func (ap *AccountPurger) purgeDue(ctx context.Context) error {
+	users, err := ap.users.DB.DueForPurge(time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		// Skip users who kept their account since the list was read.
+		// Soft-deleted users are not found, but they were scheduled too,
+		// so they are purged all the same.
+		current, err := ap.users.DB.ByID(users[i].ID)
+		if err != nil && err != ErrorNotFound {
+			log.Printf("accounts: loading user %d: %v", users[i].ID, err)
+			continue
+		}
+		if err == nil && !current.DueForPurge(time.Now()) {
+			continue
+		}
+		if err := ap.Purge(ctx, &users[i]); err != nil {
+			log.Printf("accounts: purging user %d: %v", users[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// Purge deletes a user and everything they own for good, freeing their
+// email for a new account
+func (ap *AccountPurger) Purge(ctx context.Context, user *User) error {
+	if err := ap.uploads.TerminateAll(user.ID); err != nil {
+		return err
+	}
+
+	galleries, err := ap.galleries.AllByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	for i := range galleries {
+		if err := ap.purgeGallery(ctx, &galleries[i]); err != nil {
+			return err
+		}
+	}
+
+	// Downloads the user made from other people's galleries stay in the
+	// owners' history, without the user
+	if err := ap.images.downloads.ForgetUser(user.ID); err != nil {
+		return err
+	}
+
+	err = ap.users.purge(user)
+	if err == ErrorNotFound {
+		return nil
+	}
+	return err
+}
+
+// purgeGallery deletes a gallery with its share links, images and files
+func (ap *AccountPurger) purgeGallery(ctx context.Context, gallery *Gallery) error {
+	links, err := ap.links.DB.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	for i := range links {
+		if err := ap.links.Revoke(&links[i]); err != nil && err != ErrorNotFound {
+			return err
+		}
+	}
+
+	if err := ap.images.DeleteGallery(ctx, gallery.ID); err != nil {
+		return err
+	}
+	return ap.galleries.Purge(gallery.ID)
+}
@@ -0,0 +1,70 @@
+package models
+
+///////////////////////////////////////////////////////////////////////////////
+// Gallery Authorization
+///////////////////////////////////////////////////////////////////////////////
+
+// Permission is something a visitor can do with a gallery and its images
+type Permission int
+
+const (
+	// PermView is seeing the gallery and its images
+	PermView Permission = iota + 1
+	// PermEdit is changing or deleting the gallery and its images
+	PermEdit
+	// PermDownload is downloading the gallery's original images
+	PermDownload
+)
+
+// Visitor is whoever is asking for a gallery and how they found it
+type Visitor struct {
+	// User is the signed-in user, nil for anonymous visitors
+	User *User
+	// BySlug is true when the gallery was looked up by its slug rather
+	// than its ID
+	BySlug bool
+	// Link is the share link the visitor came by, if any
+	Link *ShareLink
+}
+
+// IsOwner reports whether the visitor owns the gallery
+func (v Visitor) IsOwner(gallery *Gallery) bool {
+	return v.User != nil && v.User.ID == gallery.UserID
+}
+
+// Authorize decides whether the visitor may do perm with the gallery.
+// Owners may do anything. Anyone may view public galleries, and unlisted
+// ones when they came by the slug. A share link lets its holder view the
+// gallery whatever its visibility, and download it when the link allows
+// that. It returns ErrorNotFound when the gallery should look like it does
+// not exist, so private and unlisted galleries do not leak, and
+// ErrorForbidden when the visitor can see the gallery but not do perm.
+func Authorize(v Visitor, gallery *Gallery, perm Permission) error {
+	if v.IsOwner(gallery) {
+		return nil
+	}
+
+	link := v.Link
+	if link != nil && link.GalleryID != gallery.ID {
+		link = nil
+	}
+
+	canView := link != nil
+	switch gallery.Visibility {
+	case VisibilityPublic:
+		canView = true
+	case VisibilityUnlisted:
+		canView = canView || v.BySlug
+	}
+	if !canView {
+		return ErrorNotFound
+	}
+
+	switch {
+	case perm == PermView:
+		return nil
+	case perm == PermDownload && link != nil && link.AllowDownload:
+		return nil
+	}
+	return ErrorForbidden
+}
@@ -0,0 +1,505 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	_ "image/gif" // register the GIF decoder
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/imaging"
+	"gorm.io/gorm"
+)
+
+// Derivative statuses
+const (
+	DerivativePending = "pending"
+	DerivativeReady   = "ready"
+	DerivativeFailed  = "failed"
+)
+
+const (
+	// maxDerivativeAttempts is how many times a derivative is generated
+	// automatically before it is marked failed
+	maxDerivativeAttempts = 3
+	// derivativeRetryBackoff is the wait after the first failure; it
+	// doubles with every further one
+	derivativeRetryBackoff = 30 * time.Second
+)
+
+// derivableTypes are the image types the standard library can decode
+var derivableTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// errPermanent marks generation failures that retrying cannot fix
+var errPermanent = errors.New("permanent failure")
+
+///////////////////////////////////////////////////////////////////////////////
+// Derivative Model
+///////////////////////////////////////////////////////////////////////////////
+
+// Derivative is a resized copy of an image, one per configured size. It
+// is created pending when the image is uploaded and becomes ready once
+// the background workers have stored the file.
+type Derivative struct {
+	ID          int64  `gorm:"primaryKey;autoIncrement"`
+	ImageID     int64  `gorm:"not null;uniqueIndex:idx_derivatives_image_name"`
+	Name        string `gorm:"not null;uniqueIndex:idx_derivatives_image_name"`
+	Width       int
+	Height      int
+	ContentType string
+	Size        int64
+	StorageKey  string
+	Status      string `gorm:"not null;index"`
+	Error       string
+	Attempts    int `gorm:"not null;default:0"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type DerivativeDB interface {
+	// Create
+	Create(derivative *Derivative) error
+
+	// Read
+	ByImageID(imageID int64) ([]Derivative, error)
+	ByImageIDs(imageIDs []int64) ([]Derivative, error)
+	PendingImageIDs() ([]int64, error)
+
+	// Update
+	Update(derivative *Derivative) error
+
+	// Delete
+	DeleteByImageID(imageID int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// Derivatives returns the derivatives of the given images, keyed by image
+// ID
+func (is *ImageService) Derivatives(imageIDs ...int64) (map[int64][]Derivative, error) {
+	derivatives, err := is.derivatives.ByImageIDs(imageIDs)
+	if err != nil {
+		return nil, err
+	}
+	byImage := make(map[int64][]Derivative, len(imageIDs))
+	for _, d := range derivatives {
+		byImage[d.ImageID] = append(byImage[d.ImageID], d)
+	}
+	return byImage, nil
+}
+
+// DerivativeURL returns a time-limited link to a ready derivative
+func (is *ImageService) DerivativeURL(ctx context.Context, derivative *Derivative) (string, error) {
+	return is.store.SignedURL(ctx, derivative.StorageKey, config.SignedURLTTL)
+}
+
+// RetryDerivatives queues every derivative of image that is not ready for
+// generation again, including sizes added to the configuration since the
+// image was uploaded
+func (is *ImageService) RetryDerivatives(image *Image) error {
+	if err := is.planDerivatives(image); err != nil {
+		return err
+	}
+
+	derivatives, err := is.derivatives.ByImageID(image.ID)
+	if err != nil {
+		return err
+	}
+	for i := range derivatives {
+		d := &derivatives[i]
+		if d.Status == DerivativeReady {
+			continue
+		}
+		d.Status = DerivativePending
+		d.Attempts = 0
+		d.Error = ""
+		if err := is.derivatives.Update(d); err != nil {
+			return err
+		}
+	}
+	is.queue.enqueue(image.ID)
+	return nil
+}
+
+// ResumeProcessing queues every image that still has pending derivatives
+// or whose served file does not match its gallery's EXIF policy, such as
+// those left behind by a restart. It should be called once at startup,
+// after migrations.
+func (is *ImageService) ResumeProcessing() error {
+	pending, err := is.derivatives.PendingImageIDs()
+	if err != nil {
+		return err
+	}
+	stale, err := is.DB.StaleExifPolicyIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range append(pending, stale...) {
+		is.queue.enqueue(id)
+	}
+	return nil
+}
+
+// Close stops the image workers, waiting for the images being processed
+// until ctx is done. Queued work is picked up again by ResumeProcessing.
+func (is *ImageService) Close(ctx context.Context) error {
+	return is.queue.close(ctx)
+}
+
+// processImage is the background job run for every queued image. It
+// makes the served copy match the gallery's EXIF policy and generates
+// the pending derivatives.
+func (is *ImageService) processImage(ctx context.Context, imageID int64) {
+	image, err := is.DB.ByID(imageID)
+	if err == ErrorNotFound {
+		// Deleted while queued
+		return
+	}
+	if err != nil {
+		log.Printf("images: loading image %d: %v", imageID, err)
+		return
+	}
+
+	if err := is.applyExifPolicy(ctx, image); err != nil {
+		log.Printf("images: applying the EXIF policy to image %d: %v", imageID, err)
+	}
+	is.generateDerivatives(ctx, image)
+}
+
+// planDerivatives creates the pending rows for configured sizes the image
+// does not have yet. Images of a type that cannot be resized get none.
+func (is *ImageService) planDerivatives(image *Image) error {
+	if !derivableTypes[image.ContentType] {
+		return nil
+	}
+	existing, err := is.derivatives.ByImageID(image.ID)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(existing))
+	for _, d := range existing {
+		have[d.Name] = true
+	}
+	for _, size := range config.DerivativeSizes {
+		if have[size.Name] {
+			continue
+		}
+		d := Derivative{ImageID: image.ID, Name: size.Name, Status: DerivativePending}
+		if err := is.derivatives.Create(&d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateDerivatives decodes the image once and stores every pending
+// derivative. Failures are recorded on the derivative; transient ones are
+// retried with backoff until maxDerivativeAttempts is reached.
+func (is *ImageService) generateDerivatives(ctx context.Context, image *Image) {
+	derivatives, err := is.derivatives.ByImageID(image.ID)
+	if err != nil {
+		log.Printf("derivatives: loading derivatives of image %d: %v", image.ID, err)
+		return
+	}
+	var pending []*Derivative
+	for i := range derivatives {
+		if derivatives[i].Status == DerivativePending {
+			pending = append(pending, &derivatives[i])
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	orientation := is.orientation(image.ID)
+	src, err := is.decode(ctx, image, orientation)
+	if err != nil {
+		if ctx.Err() == nil {
+			is.derivativesFailed(image, pending, err)
+		}
+		return
+	}
+
+	sizes := make(map[string]int, len(config.DerivativeSizes))
+	for _, size := range config.DerivativeSizes {
+		sizes[size.Name] = size.Width
+	}
+
+	var failed []*Derivative
+	var lastErr error
+	for _, d := range pending {
+		width, ok := sizes[d.Name]
+		if !ok {
+			// The size was removed from the configuration
+			width = image.Width
+		}
+		if err := is.storeDerivative(ctx, image, d, src, orientation, width); err != nil {
+			failed = append(failed, d)
+			lastErr = err
+			continue
+		}
+		d.Status = DerivativeReady
+		d.Error = ""
+		if err := is.derivatives.Update(d); err != nil {
+			log.Printf("derivatives: saving %s of image %d: %v", d.Name, image.ID, err)
+		}
+	}
+	if len(failed) > 0 && ctx.Err() == nil {
+		is.derivativesFailed(image, failed, lastErr)
+	}
+}
+
+// decode reads and decodes the original image, recording its displayed
+// dimensions on the image the first time
+func (is *ImageService) decode(ctx context.Context, img *Image, orientation int) (image.Image, error) {
+	rc, _, err := is.store.Get(ctx, img.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// Check the dimensions before committing memory to the pixels
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(rc, &head))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	if cfg.Width*cfg.Height > config.DerivativeMaxPixels {
+		return nil, fmt.Errorf("%w: image is %dx%d, more than %d pixels",
+			errPermanent, cfg.Width, cfg.Height, config.DerivativeMaxPixels)
+	}
+	width, height := cfg.Width, cfg.Height
+	if imaging.Swapped(orientation) {
+		width, height = height, width
+	}
+	if img.Width != width || img.Height != height {
+		img.Width, img.Height = width, height
+		if err := is.DB.Update(img); err != nil {
+			return nil, err
+		}
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&head, rc))
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	return src, nil
+}
+
+// storeDerivative resizes src to at most width pixels wide, as
+// displayed, and stores it next to the original. JPEGs stay JPEGs;
+// everything else becomes a PNG so transparency survives. Derivatives
+// carry no metadata, so the EXIF orientation is applied to the pixels.
+func (is *ImageService) storeDerivative(ctx context.Context, image *Image, d *Derivative, src image.Image, orientation, width int) error {
+	b := src.Bounds()
+	swapped := imaging.Swapped(orientation)
+	sw, sh := b.Dx(), b.Dy()
+	if swapped {
+		sw, sh = sh, sw
+	}
+	w, h := imaging.Fit(sw, sh, width)
+	rw, rh := w, h
+	if swapped {
+		rw, rh = h, w
+	}
+	resized := imaging.Orient(imaging.Resize(src, rw, rh), orientation)
+
+	var buf bytes.Buffer
+	contentType, ext := "image/png", ".png"
+	if image.ContentType == "image/jpeg" {
+		contentType, ext = "image/jpeg", ".jpg"
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: config.DerivativeQuality}); err != nil {
+			return err
+		}
+	} else if err := png.Encode(&buf, resized); err != nil {
+		return err
+	}
+
+	key := derivativeKey(image.StorageKey, d.Name, ext)
+	info, err := is.store.Put(ctx, key, &buf, contentType)
+	if err != nil {
+		return err
+	}
+
+	d.Width, d.Height = w, h
+	d.ContentType = contentType
+	d.Size = info.Size
+	d.StorageKey = key
+	return nil
+}
+
+// derivativesFailed records err on every derivative in ds and schedules
+// another attempt if the error may be transient
+func (is *ImageService) derivativesFailed(image *Image, ds []*Derivative, err error) {
+	log.Printf("derivatives: image %d: %v", image.ID, err)
+
+	permanent := errors.Is(err, errPermanent)
+	retry := false
+	for _, d := range ds {
+		d.Attempts++
+		d.Error = strings.TrimPrefix(err.Error(), errPermanent.Error()+": ")
+		if permanent || d.Attempts >= maxDerivativeAttempts {
+			d.Status = DerivativeFailed
+		} else {
+			retry = true
+		}
+		if err := is.derivatives.Update(d); err != nil {
+			log.Printf("derivatives: saving %s of image %d: %v", d.Name, image.ID, err)
+		}
+	}
+	if retry {
+		backoff := derivativeRetryBackoff << (ds[0].Attempts - 1)
+		is.queue.enqueueAfter(image.ID, backoff)
+	}
+}
+
+// deleteDerivatives removes every derivative of image and its file
+func (is *ImageService) deleteDerivatives(ctx context.Context, image *Image) error {
+	derivatives, err := is.derivatives.ByImageID(image.ID)
+	if err != nil {
+		return err
+	}
+	for _, d := range derivatives {
+		if d.StorageKey == "" {
+			continue
+		}
+		if err := is.store.Delete(ctx, d.StorageKey); err != nil {
+			return err
+		}
+	}
+	return is.derivatives.DeleteByImageID(image.ID)
+}
+
+// derivativeKey names a derivative after its original, e.g.
+// "galleries/1/abc_thumbnail.jpg" for "galleries/1/abc.png"
+func derivativeKey(originalKey, name, ext string) string {
+	base := strings.TrimSuffix(originalKey, path.Ext(originalKey))
+	return base + "_" + name + ext
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type derivativeValidator struct {
+	DerivativeDB
+}
+
+func newDerivativeValidator(nextLayer DerivativeDB) *derivativeValidator {
+	return &derivativeValidator{
+		DerivativeDB: nextLayer,
+	}
+}
+
+// Create
+func (dv *derivativeValidator) Create(derivative *Derivative) error {
+	if derivative.ImageID <= 0 {
+		return ErrorInvalidId
+	}
+	if derivative.Name == "" {
+		return errors.New("derivative name is required")
+	}
+	if derivative.Status == "" {
+		derivative.Status = DerivativePending
+	}
+	return dv.DerivativeDB.Create(derivative)
+}
+
+// Update
+func (dv *derivativeValidator) Update(derivative *Derivative) error {
+	if derivative.ID <= 0 {
+		return ErrorInvalidId
+	}
+	if derivative.Status == DerivativeReady && derivative.StorageKey == "" {
+		return errors.New("ready derivative has no storage key")
+	}
+	return dv.DerivativeDB.Update(derivative)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of DerivativeDB interface
+type derivativeGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of derivativeGorm
+func newDerivativeGorm(db *gorm.DB) *derivativeGorm {
+	return &derivativeGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create derivative
+func (dg *derivativeGorm) Create(derivative *Derivative) error {
+	return dg.db.Create(derivative).Error
+}
+
+// Retrieve every derivative of an image
+func (dg *derivativeGorm) ByImageID(imageID int64) ([]Derivative, error) {
+	var derivatives []Derivative
+	db := dg.db.Where("image_id = ?", imageID).Order("width, id")
+	if err := all(db, &derivatives); err != nil {
+		return nil, err
+	}
+	return derivatives, nil
+}
+
+// Retrieve every derivative of several images
+func (dg *derivativeGorm) ByImageIDs(imageIDs []int64) ([]Derivative, error) {
+	var derivatives []Derivative
+	if len(imageIDs) == 0 {
+		return derivatives, nil
+	}
+	db := dg.db.Where("image_id IN ?", imageIDs).Order("image_id, width, id")
+	if err := all(db, &derivatives); err != nil {
+		return nil, err
+	}
+	return derivatives, nil
+}
+
+// Retrieve the IDs of images with derivatives waiting to be generated
+func (dg *derivativeGorm) PendingImageIDs() ([]int64, error) {
+	var ids []int64
+	err := dg.db.Model(&Derivative{}).
+		Where("status = ?", DerivativePending).
+		Distinct().Order("image_id").Pluck("image_id", &ids).Error
+	return ids, err
+}
+
+// Update
+func (dg *derivativeGorm) Update(derivative *Derivative) error {
+	return dg.db.Save(derivative).Error
+}
+
+// Delete every derivative of an image
+func (dg *derivativeGorm) DeleteByImageID(imageID int64) error {
+	return dg.db.Where("image_id = ?", imageID).Delete(&Derivative{}).Error
+}
@@ -0,0 +1,253 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"gorm.io/gorm"
+)
+
+// DownloadOriginal selects the image files themselves, as served under
+// the gallery's EXIF policy, rather than one of the derivative sizes
+const DownloadOriginal = "original"
+
+///////////////////////////////////////////////////////////////////////////////
+// Download Event Model
+///////////////////////////////////////////////////////////////////////////////
+
+// DownloadEvent records a download of a whole gallery. It is created when
+// the download starts and marked completed once every file was sent.
+type DownloadEvent struct {
+	ID        int64 `gorm:"primaryKey;autoIncrement"`
+	GalleryID int64 `gorm:"not null;index"`
+	// UserID is set when a signed-in user downloaded the gallery and
+	// ShareLinkID when it was downloaded through a share link
+	UserID      *int64
+	ShareLinkID *int64 `gorm:"index"`
+	Size        string `gorm:"not null"`
+	Files       int    `gorm:"not null"`
+	Bytes       int64  `gorm:"not null;default:0"`
+	Completed   bool   `gorm:"not null;default:false"`
+	IP          string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// DownloadFile is one file of a gallery download
+type DownloadFile struct {
+	// Name is the file's name in the archive, unique within it
+	Name       string
+	StorageKey string
+	Modified   time.Time
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type DownloadEventDB interface {
+	// Create
+	Create(event *DownloadEvent) error
+
+	// Read
+	ByGalleryID(galleryID int64) ([]DownloadEvent, error)
+
+	// Update
+	Update(event *DownloadEvent) error
+	// ForgetUser drops the user from the downloads they made
+	ForgetUser(userID int64) error
+
+	// Delete
+	DeleteByGalleryID(galleryID int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// DownloadFiles lists the files of a gallery download: the originals, or
+// the derivatives named size. Images still being processed, withheld
+// under the EXIF policy or without a ready derivative of that size are
+// left out.
+func (is *ImageService) DownloadFiles(gallery *Gallery, size string) ([]DownloadFile, error) {
+	if !validDownloadSize(size) {
+		return nil, ErrorDownloadSize
+	}
+
+	images, err := is.DB.ByGalleryID(gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(images))
+	for i := range images {
+		ids[i] = images[i].ID
+	}
+	derivatives := map[int64][]Derivative{}
+	if size != DownloadOriginal {
+		if derivatives, err = is.Derivatives(ids...); err != nil {
+			return nil, err
+		}
+	}
+
+	names := map[string]bool{}
+	files := make([]DownloadFile, 0, len(images))
+	for i := range images {
+		image := &images[i]
+		key, ok := downloadKey(gallery, image, size, derivatives[image.ID])
+		if !ok {
+			continue
+		}
+		name := image.Filename
+		if size != DownloadOriginal {
+			name = strings.TrimSuffix(name, path.Ext(name)) + "_" + size + path.Ext(key)
+		}
+		files = append(files, DownloadFile{
+			Name:       uniqueName(names, name),
+			StorageKey: key,
+			Modified:   image.CreatedAt,
+		})
+	}
+	return files, nil
+}
+
+// OpenDownloadFile returns the contents of a file of a gallery download.
+// The caller must close it.
+func (is *ImageService) OpenDownloadFile(ctx context.Context, file DownloadFile) (io.ReadCloser, error) {
+	rc, _, err := is.store.Get(ctx, file.StorageKey)
+	return rc, err
+}
+
+// RecordDownload stores the start of a gallery download
+func (is *ImageService) RecordDownload(event *DownloadEvent) error {
+	return is.downloads.Create(event)
+}
+
+// FinishDownload stores how a gallery download ended
+func (is *ImageService) FinishDownload(event *DownloadEvent) error {
+	return is.downloads.Update(event)
+}
+
+// Downloads lists the downloads of a gallery, newest first
+func (is *ImageService) Downloads(gallery *Gallery) ([]DownloadEvent, error) {
+	return is.downloads.ByGalleryID(gallery.ID)
+}
+
+// validDownloadSize reports whether size is original or one of the
+// configured derivative sizes
+func validDownloadSize(size string) bool {
+	if size == DownloadOriginal {
+		return true
+	}
+	for _, s := range config.DerivativeSizes {
+		if s.Name == size {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadKey returns the storage key of the file downloaded for an image
+func downloadKey(gallery *Gallery, image *Image, size string, derivatives []Derivative) (string, bool) {
+	if size == DownloadOriginal {
+		key, err := servedKey(gallery, image)
+		return key, err == nil
+	}
+	for _, d := range derivatives {
+		if d.Name == size && d.Status == DerivativeReady {
+			return d.StorageKey, true
+		}
+	}
+	return "", false
+}
+
+// uniqueName returns name, numbered like "photo (2).jpg" if it is already
+// in taken, and adds it to taken. Names are compared case-insensitively,
+// as many file systems do.
+func uniqueName(taken map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for n := 2; taken[strings.ToLower(unique)]; n++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	taken[strings.ToLower(unique)] = true
+	return unique
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type downloadEventValidator struct {
+	DownloadEventDB
+}
+
+func newDownloadEventValidator(nextLayer DownloadEventDB) *downloadEventValidator {
+	return &downloadEventValidator{
+		DownloadEventDB: nextLayer,
+	}
+}
+
+// Create
+func (dv *downloadEventValidator) Create(event *DownloadEvent) error {
+	if event.GalleryID <= 0 {
+		return ErrorInvalidId
+	}
+	if !validDownloadSize(event.Size) {
+		return ErrorDownloadSize
+	}
+	return dv.DownloadEventDB.Create(event)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of DownloadEventDB interface
+type downloadEventGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of downloadEventGorm
+func newDownloadEventGorm(db *gorm.DB) *downloadEventGorm {
+	return &downloadEventGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create download event
+func (dg *downloadEventGorm) Create(event *DownloadEvent) error {
+	return dg.db.Create(event).Error
+}
+
+// Retrieve the download events of a gallery, newest first
+func (dg *downloadEventGorm) ByGalleryID(galleryID int64) ([]DownloadEvent, error) {
+	var events []DownloadEvent
+	db := dg.db.Where("gallery_id = ?", galleryID).Order("created_at DESC")
+	if err := all(db, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Update download event
+func (dg *downloadEventGorm) Update(event *DownloadEvent) error {
+	return dg.db.Save(event).Error
+}
+
+// Clear the user of every download they made
+func (dg *downloadEventGorm) ForgetUser(userID int64) error {
+	return dg.db.Model(&DownloadEvent{}).Where("user_id = ?", userID).Update("user_id", nil).Error
+}
+
+// Delete the download history of a gallery
+func (dg *downloadEventGorm) DeleteByGalleryID(galleryID int64) error {
+	return dg.db.Where("gallery_id = ?", galleryID).Delete(&DownloadEvent{}).Error
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/hash"
+	"github.com/pranav244872/lenslocked.com/rand"
+	"gorm.io/gorm"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Email Verification Model
+///////////////////////////////////////////////////////////////////////////////
+
+// EmailVerification is an outstanding request to confirm that a user owns
+// Email. A user has at most one at a time; resending replaces it.
+type EmailVerification struct {
+	ID     int64  `gorm:"primaryKey;autoIncrement"`
+	UserID int64  `gorm:"not null;uniqueIndex"`
+	Email  string `gorm:"not null"`
+	// Change marks a request to move the account to Email, which only
+	// replaces the user's address once confirmed
+	Change    bool   `gorm:"not null;default:false"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+	CreatedAt time.Time
+	SentAt    time.Time `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type EmailVerificationDB interface {
+	// Create
+	Create(ev *EmailVerification) error
+
+	// Read
+	ByToken(token string) (*EmailVerification, error)
+	ByUserID(userID int64) (*EmailVerification, error)
+
+	// Delete
+	DeleteByUserID(userID int64) error
+}
+
+func newEmailVerificationDB(db *gorm.DB, hmac hash.HMAC) EmailVerificationDB {
+	return newEmailVerificationValidator(newEmailVerificationGorm(db), hmac)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type emailVerificationValidator struct {
+	EmailVerificationDB
+	hmac hash.HMAC
+}
+
+func newEmailVerificationValidator(nextLayer EmailVerificationDB, hmac hash.HMAC) *emailVerificationValidator {
+	return &emailVerificationValidator{
+		EmailVerificationDB: nextLayer,
+		hmac:                hmac,
+	}
+}
+
+// Create
+func (evv *emailVerificationValidator) Create(ev *EmailVerification) error {
+	err := runEmailVerificationValFns(ev,
+		evv.userIDRequired,
+		evv.emailRequired,
+		evv.setToken,
+		evv.hashToken,
+		evv.setExpiry,
+	)
+	if err != nil {
+		return err
+	}
+	return evv.EmailVerificationDB.Create(ev)
+}
+
+// Read By Token. Expired verifications are reported as not found.
+func (evv *emailVerificationValidator) ByToken(token string) (*EmailVerification, error) {
+	if token == "" {
+		return nil, ErrorNotFound
+	}
+	var ev *EmailVerification
+	_, err := findHashed(evv.hmac, token, func(tokenHash string) (err error) {
+		ev, err = evv.EmailVerificationDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(ev.ExpiresAt) {
+		return nil, ErrorNotFound
+	}
+	return ev, nil
+}
+
+// --- Validation Helpers ---
+
+type emailVerificationValFn func(*EmailVerification) error
+
+func runEmailVerificationValFns(ev *EmailVerification, fns ...emailVerificationValFn) error {
+	for _, fn := range fns {
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) userIDRequired(ev *EmailVerification) error {
+	if ev.UserID <= 0 {
+		return ErrorInvalidId
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) emailRequired(ev *EmailVerification) error {
+	if ev.Email == "" {
+		return errors.New("email is required")
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) setToken(ev *EmailVerification) error {
+	if ev.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ev.Token = token
+	return nil
+}
+
+func (evv *emailVerificationValidator) hashToken(ev *EmailVerification) error {
+	if ev.Token == "" {
+		return errors.New("verification token is required")
+	}
+	ev.TokenHash = evv.hmac.Hash(ev.Token)
+	return nil
+}
+
+func (evv *emailVerificationValidator) setExpiry(ev *EmailVerification) error {
+	now := time.Now()
+	ev.SentAt = now
+	ev.ExpiresAt = now.Add(config.EmailVerificationTimeout)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of EmailVerificationDB interface
+type emailVerificationGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of emailVerificationGorm
+func newEmailVerificationGorm(db *gorm.DB) *emailVerificationGorm {
+	return &emailVerificationGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create email verification
+func (evg *emailVerificationGorm) Create(ev *EmailVerification) error {
+	return evg.db.Create(ev).Error
+}
+
+// Retrieve by the hash of a verification token
+func (evg *emailVerificationGorm) ByToken(tokenHash string) (*EmailVerification, error) {
+	var ev EmailVerification
+
+	db := evg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &ev)
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// Retrieve the outstanding verification of a user
+func (evg *emailVerificationGorm) ByUserID(userID int64) (*EmailVerification, error) {
+	var ev EmailVerification
+
+	db := evg.db.Where("user_id = ?", userID)
+	err := first(db, &ev)
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// Delete the outstanding verification of a user
+func (evg *emailVerificationGorm) DeleteByUserID(userID int64) error {
+	return evg.db.Where("user_id = ?", userID).Delete(&EmailVerification{}).Error
+}
@@ -0,0 +1,372 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/rand"
+	"gorm.io/gorm"
+)
+
+const (
+	maxGalleryTitleLength       = 200
+	maxGalleryDescriptionLength = 5000
+
+	// gallerySlugBytes is the randomness in a gallery slug, enough that
+	// unlisted galleries cannot be found by guessing
+	gallerySlugBytes = 12
+)
+
+// Gallery visibilities
+const (
+	// VisibilityPrivate galleries are only seen by their owner
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries are seen by anyone who has their slug
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries are seen by anyone and listed on the
+	// owner's profile
+	VisibilityPublic = "public"
+)
+
+// EXIF policies of a gallery, deciding which metadata is removed from the
+// image files it serves
+const (
+	ExifKeep          = "keep"
+	ExifStripLocation = "strip_location"
+	ExifStripAll      = "strip_all"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Gallery Model
+///////////////////////////////////////////////////////////////////////////////
+
+type Gallery struct {
+	ID          int64  `gorm:"primaryKey;autoIncrement"`
+	UserID      int64  `gorm:"not null;index"`
+	Title       string `gorm:"not null"`
+	Description string
+	Visibility  string `gorm:"not null;default:'private';index"`
+	Slug        string `gorm:"uniqueIndex"`
+	ExifPolicy  string `gorm:"not null;default:'keep'"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type GalleryDB interface {
+	// Create
+	Create(gallery *Gallery) error
+
+	// Read
+	ByID(id int64) (*Gallery, error)
+	BySlug(slug string) (*Gallery, error)
+	ByUserID(userID int64) ([]Gallery, error)
+	PublicByUserID(userID int64) ([]Gallery, error)
+	// AllByUserID includes galleries soft-deleted by Delete
+	AllByUserID(userID int64) ([]Gallery, error)
+
+	// Update
+	Update(gallery *Gallery) error
+
+	// Delete
+	Delete(id int64) error
+	// Purge deletes the gallery row for good
+	Purge(id int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type GalleryService struct {
+	DB GalleryDB
+}
+
+func newGalleryService(db *gorm.DB) *GalleryService {
+	// Create db layer implementation
+	gg := newGalleryGorm(db)
+
+	// create validation layer
+	gv := newGalleryValidator(gg)
+
+	// Create service layer
+	return &GalleryService{
+		DB: gv,
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type galleryValidator struct {
+	GalleryDB
+}
+
+func newGalleryValidator(nextLayer GalleryDB) *galleryValidator {
+	return &galleryValidator{
+		GalleryDB: nextLayer,
+	}
+}
+
+// Create
+func (gv *galleryValidator) Create(gallery *Gallery) error {
+	err := runGalleryValFns(gallery,
+		gv.userIDRequired,
+		gv.normalizeText,
+		gv.titleRequired,
+		gv.textLength,
+		gv.visibilityValid,
+		gv.setSlug,
+		gv.exifPolicyValid,
+	)
+	if err != nil {
+		return err
+	}
+	return gv.GalleryDB.Create(gallery)
+}
+
+// Update
+func (gv *galleryValidator) Update(gallery *Gallery) error {
+	err := runGalleryValFns(gallery,
+		gv.idGreaterThan(0),
+		gv.userIDRequired,
+		gv.normalizeText,
+		gv.titleRequired,
+		gv.textLength,
+		gv.visibilityValid,
+		gv.setSlug,
+		gv.exifPolicyValid,
+	)
+	if err != nil {
+		return err
+	}
+	return gv.GalleryDB.Update(gallery)
+}
+
+// Read By Slug
+func (gv *galleryValidator) BySlug(slug string) (*Gallery, error) {
+	if slug == "" {
+		return nil, ErrorNotFound
+	}
+	return gv.GalleryDB.BySlug(slug)
+}
+
+// Delete
+func (gv *galleryValidator) Delete(id int64) error {
+	var gallery Gallery
+	gallery.ID = id
+	err := runGalleryValFns(&gallery, gv.idGreaterThan(0))
+	if err != nil {
+		return err
+	}
+	return gv.GalleryDB.Delete(id)
+}
+
+// Purge
+func (gv *galleryValidator) Purge(id int64) error {
+	var gallery Gallery
+	gallery.ID = id
+	err := runGalleryValFns(&gallery, gv.idGreaterThan(0))
+	if err != nil {
+		return err
+	}
+	return gv.GalleryDB.Purge(id)
+}
+
+// --- Validation Helpers ---
+
+type galleryValFn func(*Gallery) error
+
+func runGalleryValFns(gallery *Gallery, fns ...galleryValFn) error {
+	for _, fn := range fns {
+		if err := fn(gallery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gv *galleryValidator) idGreaterThan(n int64) galleryValFn {
+	return func(gallery *Gallery) error {
+		if gallery.ID <= n {
+			return ErrorInvalidId
+		}
+		return nil
+	}
+}
+
+func (gv *galleryValidator) userIDRequired(gallery *Gallery) error {
+	if gallery.UserID <= 0 {
+		return errors.New("gallery owner is required")
+	}
+	return nil
+}
+
+func (gv *galleryValidator) normalizeText(gallery *Gallery) error {
+	gallery.Title = strings.TrimSpace(gallery.Title)
+	gallery.Description = strings.TrimSpace(gallery.Description)
+	return nil
+}
+
+func (gv *galleryValidator) titleRequired(gallery *Gallery) error {
+	if gallery.Title == "" {
+		return &ValidationError{"title is required"}
+	}
+	return nil
+}
+
+func (gv *galleryValidator) textLength(gallery *Gallery) error {
+	if len(gallery.Title) > maxGalleryTitleLength {
+		return &ValidationError{"title must be at most 200 characters long"}
+	}
+	if len(gallery.Description) > maxGalleryDescriptionLength {
+		return &ValidationError{"description must be at most 5000 characters long"}
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(gallery *Gallery) error {
+	switch gallery.Visibility {
+	case "":
+		gallery.Visibility = VisibilityPrivate
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+	default:
+		return &ValidationError{"visibility must be private, unlisted or public"}
+	}
+	return nil
+}
+
+func (gv *galleryValidator) setSlug(gallery *Gallery) error {
+	if gallery.Slug != "" {
+		return nil
+	}
+	slug, err := newGallerySlug()
+	if err != nil {
+		return err
+	}
+	gallery.Slug = slug
+	return nil
+}
+
+func (gv *galleryValidator) exifPolicyValid(gallery *Gallery) error {
+	switch gallery.ExifPolicy {
+	case "":
+		gallery.ExifPolicy = ExifKeep
+	case ExifKeep, ExifStripLocation, ExifStripAll:
+	default:
+		return &ValidationError{"exif policy must be keep, strip_location or strip_all"}
+	}
+	return nil
+}
+
+// newGallerySlug returns a random, URL-safe gallery slug
+func newGallerySlug() (string, error) {
+	return rand.String(gallerySlugBytes)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of GalleryDB interface
+type galleryGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of galleryGorm
+func newGalleryGorm(db *gorm.DB) *galleryGorm {
+	return &galleryGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create gallery
+func (gg *galleryGorm) Create(gallery *Gallery) error {
+	return gg.db.Create(gallery).Error
+}
+
+// Retrieve by id
+func (gg *galleryGorm) ByID(id int64) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("id = ?", id)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// Retrieve by slug
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("slug = ?", slug)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// Retrieve every gallery of a user, newest first
+func (gg *galleryGorm) ByUserID(userID int64) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Where("user_id = ?", userID).Order("created_at DESC")
+	if err := all(db, &galleries); err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// Retrieve every gallery of a user, soft-deleted ones included
+func (gg *galleryGorm) AllByUserID(userID int64) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Unscoped().Where("user_id = ?", userID)
+	if err := all(db, &galleries); err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// Retrieve the public galleries of a user, newest first
+func (gg *galleryGorm) PublicByUserID(userID int64) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Where("user_id = ? AND visibility = ?", userID, VisibilityPublic).Order("created_at DESC")
+	if err := all(db, &galleries); err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// Update
+func (gg *galleryGorm) Update(gallery *Gallery) error {
+	return gg.db.Save(gallery).Error
+}
+
+// Delete
+func (gg *galleryGorm) Delete(id int64) error {
+	gallery := Gallery{ID: id}
+	result := gg.db.Delete(&gallery)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
+
+// Purge deletes the row itself rather than marking it deleted
+func (gg *galleryGorm) Purge(id int64) error {
+	return gg.db.Unscoped().Delete(&Gallery{ID: id}).Error
+}
@@ -0,0 +1,298 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/exif"
+	"gorm.io/gorm"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// ImageMetadata Model
+///////////////////////////////////////////////////////////////////////////////
+
+// ImageMetadata is the camera information read from an image's EXIF data
+// when it was uploaded. Images without EXIF data have none.
+type ImageMetadata struct {
+	ID           int64 `gorm:"primaryKey;autoIncrement"`
+	ImageID      int64 `gorm:"not null;uniqueIndex"`
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	CapturedAt   *time.Time
+	Orientation  int
+	// Latitude, Longitude and Altitude are only set for photos with a
+	// GPS position
+	Latitude  *float64
+	Longitude *float64
+	Altitude  *float64
+	CreatedAt time.Time
+}
+
+// HasLocation reports whether the photo has a GPS position
+func (m *ImageMetadata) HasLocation() bool {
+	return m.Latitude != nil && m.Longitude != nil
+}
+
+// newImageMetadata converts parsed EXIF data into a record for an image
+func newImageMetadata(imageID int64, m *exif.Metadata) *ImageMetadata {
+	md := &ImageMetadata{
+		ImageID:      imageID,
+		CameraMake:   m.Make,
+		CameraModel:  m.Model,
+		LensModel:    m.LensModel,
+		ExposureTime: m.ExposureTime,
+		FNumber:      m.FNumber,
+		ISO:          m.ISO,
+		FocalLength:  m.FocalLength,
+		CapturedAt:   m.CapturedAt,
+		Orientation:  m.Orientation,
+	}
+	if m.GPS != nil {
+		md.Latitude = &m.GPS.Latitude
+		md.Longitude = &m.GPS.Longitude
+		md.Altitude = m.GPS.Altitude
+	}
+	return md
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type ImageMetadataDB interface {
+	// Create
+	Create(metadata *ImageMetadata) error
+
+	// Read
+	ByImageID(imageID int64) (*ImageMetadata, error)
+	ByImageIDs(imageIDs []int64) ([]ImageMetadata, error)
+
+	// Delete
+	DeleteByImageID(imageID int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// Metadata returns the EXIF metadata of the given images, keyed by image
+// ID. Images without metadata are missing from the map.
+func (is *ImageService) Metadata(imageIDs ...int64) (map[int64]*ImageMetadata, error) {
+	metadata, err := is.metadata.ByImageIDs(imageIDs)
+	if err != nil {
+		return nil, err
+	}
+	byImage := make(map[int64]*ImageMetadata, len(metadata))
+	for i := range metadata {
+		byImage[metadata[i].ImageID] = &metadata[i]
+	}
+	return byImage, nil
+}
+
+// ApplyExifPolicy queues every image of a gallery so its served copy is
+// made to match the gallery's current EXIF policy. Until it does, the
+// images are reported as processing rather than served unstripped.
+func (is *ImageService) ApplyExifPolicy(gallery *Gallery) error {
+	images, err := is.DB.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		is.queue.enqueue(image.ID)
+	}
+	return nil
+}
+
+// servedKey returns the storage key of the file served for an image under
+// the gallery's EXIF policy
+func servedKey(gallery *Gallery, image *Image) (string, error) {
+	if gallery.ExifPolicy == ExifKeep || gallery.ExifPolicy == "" {
+		return image.StorageKey, nil
+	}
+	if image.StrippedPolicy != gallery.ExifPolicy {
+		return "", ErrorImageProcessing
+	}
+	if image.StrippedKey == "" {
+		// The file could not be stripped, so it is never served
+		return "", ErrorNotFound
+	}
+	return image.StrippedKey, nil
+}
+
+// applyExifPolicy makes the stripped copy of an image match the EXIF
+// policy of its gallery, removing it when the gallery keeps metadata
+func (is *ImageService) applyExifPolicy(ctx context.Context, image *Image) error {
+	gallery, err := is.galleries.ByID(image.GalleryID)
+	if err == ErrorNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var mode exif.Mode
+	switch gallery.ExifPolicy {
+	case ExifStripLocation:
+		mode = exif.StripLocation
+	case ExifStripAll:
+		mode = exif.StripAll
+	default:
+		if err := is.deleteStripped(ctx, image); err != nil {
+			return err
+		}
+		if image.StrippedKey == "" && image.StrippedPolicy == "" {
+			return nil
+		}
+		image.StrippedKey, image.StrippedPolicy = "", ""
+		return is.DB.Update(image)
+	}
+	if image.StrippedPolicy == gallery.ExifPolicy {
+		return nil
+	}
+
+	key, err := is.storeStripped(ctx, image, mode)
+	if err != nil && !errors.Is(err, exif.ErrMalformed) && !errors.Is(err, exif.ErrUnsupported) {
+		return err
+	}
+	// A file too broken to strip is withheld rather than served as is
+	image.StrippedKey, image.StrippedPolicy = key, gallery.ExifPolicy
+	return is.DB.Update(image)
+}
+
+// storeStripped stores a copy of the image without the metadata mode
+// selects and returns its key. GIFs cannot carry EXIF data, so they are
+// served as they are.
+func (is *ImageService) storeStripped(ctx context.Context, image *Image, mode exif.Mode) (string, error) {
+	if image.ContentType == "image/gif" {
+		return image.StorageKey, nil
+	}
+
+	rc, _, err := is.store.Get(ctx, image.StorageKey)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	pr, pw := io.Pipe()
+	stripped := make(chan error, 1)
+	go func() {
+		err := exif.Strip(pw, rc, mode)
+		pw.CloseWithError(err)
+		stripped <- err
+	}()
+	key := derivativeKey(image.StorageKey, "stripped", path.Ext(image.StorageKey))
+	_, err = is.store.Put(ctx, key, pr, image.ContentType)
+	pr.CloseWithError(err)
+
+	// A failed strip also fails the Put, so report the cause
+	if serr := <-stripped; errors.Is(serr, exif.ErrMalformed) || errors.Is(serr, exif.ErrUnsupported) {
+		return "", serr
+	}
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// deleteStripped removes the stripped copy of an image, if it has one
+func (is *ImageService) deleteStripped(ctx context.Context, image *Image) error {
+	if image.StrippedKey == "" || image.StrippedKey == image.StorageKey {
+		return nil
+	}
+	return is.store.Delete(ctx, image.StrippedKey)
+}
+
+// orientation returns the EXIF orientation of an image, 1 when unknown
+func (is *ImageService) orientation(imageID int64) int {
+	md, err := is.metadata.ByImageID(imageID)
+	if err != nil || md.Orientation == 0 {
+		return 1
+	}
+	return md.Orientation
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type imageMetadataValidator struct {
+	ImageMetadataDB
+}
+
+func newImageMetadataValidator(nextLayer ImageMetadataDB) *imageMetadataValidator {
+	return &imageMetadataValidator{
+		ImageMetadataDB: nextLayer,
+	}
+}
+
+// Create
+func (mv *imageMetadataValidator) Create(metadata *ImageMetadata) error {
+	if metadata.ImageID <= 0 {
+		return ErrorInvalidId
+	}
+	if metadata.Orientation < 0 || metadata.Orientation > 8 {
+		metadata.Orientation = 0
+	}
+	return mv.ImageMetadataDB.Create(metadata)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of ImageMetadataDB interface
+type imageMetadataGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of imageMetadataGorm
+func newImageMetadataGorm(db *gorm.DB) *imageMetadataGorm {
+	return &imageMetadataGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create metadata
+func (mg *imageMetadataGorm) Create(metadata *ImageMetadata) error {
+	return mg.db.Create(metadata).Error
+}
+
+// Retrieve the metadata of an image
+func (mg *imageMetadataGorm) ByImageID(imageID int64) (*ImageMetadata, error) {
+	var metadata ImageMetadata
+	db := mg.db.Where("image_id = ?", imageID)
+	err := first(db, &metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// Retrieve the metadata of several images
+func (mg *imageMetadataGorm) ByImageIDs(imageIDs []int64) ([]ImageMetadata, error) {
+	var metadata []ImageMetadata
+	if len(imageIDs) == 0 {
+		return metadata, nil
+	}
+	db := mg.db.Where("image_id IN ?", imageIDs)
+	if err := all(db, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// Delete the metadata of an image
+func (mg *imageMetadataGorm) DeleteByImageID(imageID int64) error {
+	return mg.db.Where("image_id = ?", imageID).Delete(&ImageMetadata{}).Error
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// imageQueueSize is how many images can wait for a worker. Images that
+// do not fit are picked up again by ResumeProcessing.
+const imageQueueSize = 1024
+
+// imageQueue hands image IDs to a fixed number of background workers,
+// so uploads return before their files are processed
+type imageQueue struct {
+	jobs   chan int64
+	work   func(ctx context.Context, imageID int64)
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// newImageQueue starts workers goroutines calling work for every
+// queued image
+func newImageQueue(workers int, work func(ctx context.Context, imageID int64)) *imageQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &imageQueue{
+		jobs:   make(chan int64, imageQueueSize),
+		work:   work,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.run()
+	}
+	return q
+}
+
+// enqueue queues an image without blocking
+func (q *imageQueue) enqueue(imageID int64) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return
+	}
+	select {
+	case q.jobs <- imageID:
+	default:
+		log.Printf("images: queue is full, image %d stays pending", imageID)
+	}
+}
+
+// enqueueAfter queues an image once d has passed
+func (q *imageQueue) enqueueAfter(imageID int64, d time.Duration) {
+	time.AfterFunc(d, func() { q.enqueue(imageID) })
+}
+
+// close stops accepting images and waits for the workers to finish the
+// queue, cancelling the work in progress when ctx is done
+func (q *imageQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (q *imageQueue) run() {
+	defer q.wg.Done()
+	for imageID := range q.jobs {
+		if q.ctx.Err() != nil {
+			// Shutting down; the rest stays pending
+			continue
+		}
+		q.work(q.ctx, imageID)
+	}
+}
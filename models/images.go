@@ -0,0 +1,413 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/exif"
+	"github.com/pranav244872/lenslocked.com/rand"
+	"github.com/pranav244872/lenslocked.com/storage"
+	"gorm.io/gorm"
+)
+
+// sniffLen is how many bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// imageExtensions maps the content types we accept to the extension the
+// stored file gets. Only types derivatives can be made from are accepted,
+// which leaves out WebP until a decoder for it is added.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Image Model
+///////////////////////////////////////////////////////////////////////////////
+
+type Image struct {
+	ID          int64  `gorm:"primaryKey;autoIncrement"`
+	GalleryID   int64  `gorm:"not null;index"`
+	Filename    string `gorm:"not null"`
+	ContentType string `gorm:"not null"`
+	Size        int64  `gorm:"not null"`
+	StorageKey  string `gorm:"not null;uniqueIndex"`
+	// StrippedKey is a copy of the file without the metadata
+	// StrippedPolicy removes. It is what gets served while StrippedPolicy
+	// matches the gallery's EXIF policy.
+	StrippedKey    string `gorm:"not null;default:''"`
+	StrippedPolicy string `gorm:"not null;default:''"`
+	// Width and Height are the displayed size, filled in when derivatives
+	// are generated
+	Width     int
+	Height    int
+	CreatedAt time.Time
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type ImageDB interface {
+	// Create
+	Create(image *Image) error
+
+	// Read
+	ByID(id int64) (*Image, error)
+	ByGalleryID(galleryID int64) ([]Image, error)
+	StaleExifPolicyIDs() ([]int64, error)
+
+	// Update
+	Update(image *Image) error
+
+	// Delete
+	Delete(id int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type ImageService struct {
+	DB          ImageDB
+	derivatives DerivativeDB
+	metadata    ImageMetadataDB
+	galleries   GalleryDB
+	store       storage.ImageStore
+	queue       *imageQueue
+	selections  SelectionDB
+	downloads   DownloadEventDB
+}
+
+func newImageService(db *gorm.DB, store storage.ImageStore) *ImageService {
+	// Create db layer implementation
+	ig := newImageGorm(db)
+
+	// create validation layer
+	iv := newImageValidator(ig)
+
+	// Create service layer
+	is := &ImageService{
+		DB:          iv,
+		derivatives: newDerivativeValidator(newDerivativeGorm(db)),
+		metadata:    newImageMetadataValidator(newImageMetadataGorm(db)),
+		selections:  newSelectionGorm(db),
+		downloads:   newDownloadEventValidator(newDownloadEventGorm(db)),
+		galleries:   newGalleryGorm(db),
+		store:       store,
+	}
+	is.queue = newImageQueue(config.DerivativeWorkers, is.processImage)
+	return is
+}
+
+// Upload streams an image into storage and records it in the gallery.
+// The content type is sniffed from the file itself; anything that is not
+// a supported image returns ErrorNotAnImage, and files over
+// config.MaxImageBytes return ErrorImageTooLarge. EXIF metadata is read
+// while the file streams through; the copy with metadata stripped and the
+// resized copies are made in the background afterwards.
+func (is *ImageService) Upload(ctx context.Context, galleryID int64, filename string, r io.Reader) (*Image, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	contentType := http.DetectContentType(head)
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		return nil, ErrorNotAnImage
+	}
+
+	name, err := rand.String(18)
+	if err != nil {
+		return nil, err
+	}
+	key := galleryPrefix(galleryID) + name + ext
+
+	// Feed the file to the EXIF parser as it is stored
+	pr, pw := io.Pipe()
+	parsed := make(chan *exif.Metadata, 1)
+	go func() {
+		m, _ := exif.Extract(pr)
+		io.Copy(io.Discard, pr)
+		parsed <- m
+	}()
+
+	body := &sizeLimitReader{
+		r:     io.TeeReader(io.MultiReader(bytes.NewReader(head), r), pw),
+		limit: config.MaxImageBytes,
+	}
+	info, err := is.store.Put(ctx, key, body, contentType)
+	pw.CloseWithError(err)
+	m := <-parsed
+	if err != nil {
+		if errors.Is(err, ErrorImageTooLarge) {
+			return nil, ErrorImageTooLarge
+		}
+		return nil, err
+	}
+
+	image := Image{
+		GalleryID:   galleryID,
+		Filename:    cleanFilename(filename),
+		ContentType: contentType,
+		Size:        info.Size,
+		StorageKey:  key,
+	}
+	if err := is.DB.Create(&image); err != nil {
+		is.store.Delete(ctx, key)
+		return nil, err
+	}
+	if m != nil {
+		if err := is.metadata.Create(newImageMetadata(image.ID, m)); err != nil {
+			log.Printf("images: saving the metadata of image %d: %v", image.ID, err)
+		}
+	}
+	if err := is.planDerivatives(&image); err != nil {
+		// The original is stored; the derivatives can be retried
+		log.Printf("derivatives: scheduling image %d: %v", image.ID, err)
+	}
+	is.queue.enqueue(image.ID)
+	return &image, nil
+}
+
+// URL returns a time-limited link to the image file. When the gallery
+// strips metadata the link is to the stripped copy, and
+// ErrorImageProcessing is returned until that copy has been made.
+func (is *ImageService) URL(ctx context.Context, gallery *Gallery, image *Image) (string, error) {
+	key, err := servedKey(gallery, image)
+	if err != nil {
+		return "", err
+	}
+	return is.store.SignedURL(ctx, key, config.SignedURLTTL)
+}
+
+// Open returns the image file as served for the gallery. The caller must
+// close it.
+func (is *ImageService) Open(ctx context.Context, gallery *Gallery, image *Image) (io.ReadCloser, error) {
+	key, err := servedKey(gallery, image)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := is.store.Get(ctx, key)
+	return rc, err
+}
+
+// Delete removes the image record, its metadata, its derivatives and
+// their files
+func (is *ImageService) Delete(ctx context.Context, image *Image) error {
+	if err := is.deleteDerivatives(ctx, image); err != nil {
+		return err
+	}
+	if err := is.deleteStripped(ctx, image); err != nil {
+		return err
+	}
+	if err := is.metadata.DeleteByImageID(image.ID); err != nil {
+		return err
+	}
+	if err := is.selections.DeleteByImageID(image.ID); err != nil {
+		return err
+	}
+	if err := is.DB.Delete(image.ID); err != nil {
+		return err
+	}
+	return is.store.Delete(ctx, image.StorageKey)
+}
+
+// DeleteGallery removes every image of a gallery, its download history
+// and any other file stored under it, such as ones left behind by failed
+// uploads. It is used when the gallery itself goes away for good.
+func (is *ImageService) DeleteGallery(ctx context.Context, galleryID int64) error {
+	images, err := is.DB.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		if err := is.Delete(ctx, &images[i]); err != nil {
+			return err
+		}
+	}
+	if err := is.downloads.DeleteByGalleryID(galleryID); err != nil {
+		return err
+	}
+
+	leftovers, err := is.store.List(ctx, galleryPrefix(galleryID))
+	if err != nil {
+		return err
+	}
+	for _, obj := range leftovers {
+		if err := is.store.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// galleryPrefix is the start of the storage key of every file in a
+// gallery
+func galleryPrefix(galleryID int64) string {
+	return path.Join("galleries", fmt.Sprint(galleryID)) + "/"
+}
+
+// sizeLimitReader fails with ErrorImageTooLarge once more than limit bytes
+// have been read, so storage backends abandon the upload
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+	if lr.read > lr.limit {
+		return 0, ErrorImageTooLarge
+	}
+	return n, err
+}
+
+// cleanFilename keeps only the base name of an uploaded file, since
+// browsers and other clients may send a full path
+func cleanFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = strings.TrimSpace(path.Base(name))
+	if name == "." || name == "/" || name == "" {
+		return "image"
+	}
+	return name
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type imageValidator struct {
+	ImageDB
+}
+
+func newImageValidator(nextLayer ImageDB) *imageValidator {
+	return &imageValidator{
+		ImageDB: nextLayer,
+	}
+}
+
+// Create
+func (iv *imageValidator) Create(image *Image) error {
+	if image.GalleryID <= 0 {
+		return errors.New("gallery is required")
+	}
+	if image.StorageKey == "" {
+		return errors.New("storage key is required")
+	}
+	if _, ok := imageExtensions[image.ContentType]; !ok {
+		return ErrorNotAnImage
+	}
+	return iv.ImageDB.Create(image)
+}
+
+// Update
+func (iv *imageValidator) Update(image *Image) error {
+	if image.ID <= 0 {
+		return ErrorInvalidId
+	}
+	if image.Width < 0 || image.Height < 0 {
+		return errors.New("image dimensions cannot be negative")
+	}
+	return iv.ImageDB.Update(image)
+}
+
+// Delete
+func (iv *imageValidator) Delete(id int64) error {
+	if id <= 0 {
+		return ErrorInvalidId
+	}
+	return iv.ImageDB.Delete(id)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of ImageDB interface
+type imageGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of imageGorm
+func newImageGorm(db *gorm.DB) *imageGorm {
+	return &imageGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create image
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+// Retrieve by id
+func (ig *imageGorm) ByID(id int64) (*Image, error) {
+	var image Image
+	db := ig.db.Where("id = ?", id)
+	err := first(db, &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// Retrieve every image in a gallery in upload order
+func (ig *imageGorm) ByGalleryID(galleryID int64) ([]Image, error) {
+	var images []Image
+	db := ig.db.Where("gallery_id = ?", galleryID).Order("id")
+	if err := all(db, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Retrieve the IDs of images whose stripped copy does not match the
+// EXIF policy of their gallery
+func (ig *imageGorm) StaleExifPolicyIDs() ([]int64, error) {
+	var ids []int64
+	err := ig.db.Model(&Image{}).
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where("(galleries.exif_policy <> ? AND images.stripped_policy <> galleries.exif_policy) OR "+
+			"(galleries.exif_policy = ? AND images.stripped_key <> '')", ExifKeep, ExifKeep).
+		Order("images.id").Pluck("images.id", &ids).Error
+	return ids, err
+}
+
+// Update
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+// Delete
+func (ig *imageGorm) Delete(id int64) error {
+	result := ig.db.Delete(&Image{ID: id})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
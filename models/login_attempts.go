@@ -0,0 +1,88 @@
+package models
+
+import (
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/lockout"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Login Attempt Model
+///////////////////////////////////////////////////////////////////////////////
+
+// LoginAttempt persists a lockout.Record so failure counters are shared
+// between servers and survive restarts.
+type LoginAttempt struct {
+	Key         string `gorm:"primaryKey"`
+	Failures    int    `gorm:"not null;default:0"`
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+func (la *LoginAttempt) record() lockout.Record {
+	return lockout.Record{
+		Failures:    la.Failures,
+		LastFailure: la.LastFailure,
+		LockedUntil: la.LockedUntil,
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of the lockout.Store interface
+type loginAttemptGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of loginAttemptGorm
+func newLoginAttemptGorm(db *gorm.DB) *loginAttemptGorm {
+	return &loginAttemptGorm{
+		db: db,
+	}
+}
+
+// Get
+func (lag *loginAttemptGorm) Get(key string) (lockout.Record, error) {
+	var la LoginAttempt
+
+	err := first(lag.db.Where("key = ?", key), &la)
+	switch err {
+	case nil:
+		return la.record(), nil
+	case ErrorNotFound:
+		return lockout.Record{}, nil
+	default:
+		return lockout.Record{}, err
+	}
+}
+
+// Update locks the row for the duration of fn so concurrent failures are
+// all counted
+func (lag *loginAttemptGorm) Update(key string, fn func(*lockout.Record)) (lockout.Record, error) {
+	var rec lockout.Record
+	err := lag.db.Transaction(func(tx *gorm.DB) error {
+		la := LoginAttempt{Key: key}
+		db := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key)
+		if err := first(db, &la); err != nil && err != ErrorNotFound {
+			return err
+		}
+
+		rec = la.record()
+		fn(&rec)
+		la.Failures = rec.Failures
+		la.LastFailure = rec.LastFailure
+		la.LockedUntil = rec.LockedUntil
+
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&la).Error
+	})
+	return rec, err
+}
+
+// Delete
+func (lag *loginAttemptGorm) Delete(key string) error {
+	return lag.db.Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
@@ -0,0 +1,236 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/hash"
+	"github.com/pranav244872/lenslocked.com/rand"
+	"gorm.io/gorm"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Password Reset Model
+///////////////////////////////////////////////////////////////////////////////
+
+// PasswordReset is a pending request to reset a user's password. Only the
+// HMAC of the token is stored; the raw token is handed to the user once.
+type PasswordReset struct {
+	ID        int64  `gorm:"primaryKey;autoIncrement"`
+	UserID    int64  `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type PasswordResetDB interface {
+	// Create
+	Create(pwr *PasswordReset) error
+
+	// Read
+	ByToken(token string) (*PasswordReset, error)
+
+	// Consume deletes the reset of an unexpired token, failing with
+	// ErrorNotFound if there is none, so a token can only be used once
+	Consume(token string) error
+
+	// Delete
+	Delete(id int64) error
+	DeleteByUserID(userID int64) error
+}
+
+func newPasswordResetDB(db *gorm.DB, hmac hash.HMAC) PasswordResetDB {
+	return newPasswordResetValidator(newPasswordResetGorm(db), hmac)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type passwordResetValidator struct {
+	PasswordResetDB
+	hmac hash.HMAC
+}
+
+func newPasswordResetValidator(nextLayer PasswordResetDB, hmac hash.HMAC) *passwordResetValidator {
+	return &passwordResetValidator{
+		PasswordResetDB: nextLayer,
+		hmac:            hmac,
+	}
+}
+
+// Create
+func (pwrv *passwordResetValidator) Create(pwr *PasswordReset) error {
+	err := runPasswordResetValFns(pwr,
+		pwrv.userIDRequired,
+		pwrv.setToken,
+		pwrv.hashToken,
+		pwrv.setExpiry,
+	)
+	if err != nil {
+		return err
+	}
+	return pwrv.PasswordResetDB.Create(pwr)
+}
+
+// Read By Token. Expired resets are reported as not found.
+func (pwrv *passwordResetValidator) ByToken(token string) (*PasswordReset, error) {
+	if token == "" {
+		return nil, ErrorNotFound
+	}
+	var pwr *PasswordReset
+	_, err := findHashed(pwrv.hmac, token, func(tokenHash string) (err error) {
+		pwr, err = pwrv.PasswordResetDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(pwr.ExpiresAt) {
+		return nil, ErrorNotFound
+	}
+	return pwr, nil
+}
+
+// Consume
+func (pwrv *passwordResetValidator) Consume(token string) error {
+	if token == "" {
+		return ErrorNotFound
+	}
+	_, err := findHashed(pwrv.hmac, token, func(tokenHash string) error {
+		return pwrv.PasswordResetDB.Consume(tokenHash)
+	})
+	return err
+}
+
+// Delete
+func (pwrv *passwordResetValidator) Delete(id int64) error {
+	if id <= 0 {
+		return ErrorInvalidId
+	}
+	return pwrv.PasswordResetDB.Delete(id)
+}
+
+// --- Validation Helpers ---
+
+type passwordResetValFn func(*PasswordReset) error
+
+func runPasswordResetValFns(pwr *PasswordReset, fns ...passwordResetValFn) error {
+	for _, fn := range fns {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pwrv *passwordResetValidator) userIDRequired(pwr *PasswordReset) error {
+	if pwr.UserID <= 0 {
+		return ErrorInvalidId
+	}
+	return nil
+}
+
+func (pwrv *passwordResetValidator) setToken(pwr *PasswordReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+	return nil
+}
+
+func (pwrv *passwordResetValidator) hashToken(pwr *PasswordReset) error {
+	if pwr.Token == "" {
+		return errors.New("reset token is required")
+	}
+	pwr.TokenHash = pwrv.hmac.Hash(pwr.Token)
+	return nil
+}
+
+func (pwrv *passwordResetValidator) setExpiry(pwr *PasswordReset) error {
+	pwr.ExpiresAt = time.Now().Add(config.PasswordResetTimeout)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of PasswordResetDB interface
+type passwordResetGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of passwordResetGorm
+func newPasswordResetGorm(db *gorm.DB) *passwordResetGorm {
+	return &passwordResetGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create password reset
+func (pwrg *passwordResetGorm) Create(pwr *PasswordReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+
+// Retrieve by the hash of a reset token
+func (pwrg *passwordResetGorm) ByToken(tokenHash string) (*PasswordReset, error) {
+	var pwr PasswordReset
+
+	db := pwrg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &pwr)
+	if err != nil {
+		return nil, err
+	}
+	return &pwr, nil
+}
+
+// Consume deletes the reset in a single statement that also checks the
+// expiry, so of two requests with the same token only one succeeds
+func (pwrg *passwordResetGorm) Consume(tokenHash string) error {
+	result := pwrg.db.
+		Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now()).
+		Delete(&PasswordReset{})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
+
+// Delete
+func (pwrg *passwordResetGorm) Delete(id int64) error {
+	result := pwrg.db.Delete(&PasswordReset{ID: id})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
+
+// Delete every outstanding reset for a user
+func (pwrg *passwordResetGorm) DeleteByUserID(userID int64) error {
+	return pwrg.db.Where("user_id = ?", userID).Delete(&PasswordReset{}).Error
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the fewest characters a password may have
+const minPasswordLength = 8
+
+// minPersonalToken is the shortest part of a name or email that counts as
+// personal information; shorter parts turn up in passwords by chance
+const minPersonalToken = 3
+
+///////////////////////////////////////////////////////////////////////////////
+// Password Strength
+///////////////////////////////////////////////////////////////////////////////
+
+// basedOnPersonalInfo reports whether password is mostly made of the
+// words in the user's name and email address, like "JohnSmith1!" or
+// "john.example". Once every such word is taken out, a password has to
+// still be long enough to stand on its own.
+func basedOnPersonalInfo(password, name, email string) bool {
+	lowered := strings.ToLower(password)
+	rest := lowered
+	for _, token := range personalTokens(name, email) {
+		rest = strings.ReplaceAll(rest, token, "")
+	}
+	if rest == lowered {
+		return false
+	}
+	return len([]rune(rest)) < minPasswordLength
+}
+
+// personalTokens splits a name and an email address into lowercase words,
+// longest first so that "johnson" is removed before "john". The top level
+// domain is left out.
+func personalTokens(name, email string) []string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	local, domain, _ := strings.Cut(email, "@")
+	if i := strings.LastIndex(domain, "."); i >= 0 {
+		domain = domain[:i]
+	}
+
+	isSeparator := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+	candidates := []string{local}
+	candidates = append(candidates, strings.FieldsFunc(strings.ToLower(name), isSeparator)...)
+	candidates = append(candidates, strings.FieldsFunc(local, isSeparator)...)
+	candidates = append(candidates, strings.FieldsFunc(domain, isSeparator)...)
+
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, token := range candidates {
+		if len([]rune(token)) < minPersonalToken || seen[token] {
+			continue
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return len(tokens[i]) > len(tokens[j])
+	})
+	return tokens
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Password Hashing
+///////////////////////////////////////////////////////////////////////////////
+
+// Password hashes are bcrypt hashes of the password with a pepper appended.
+// The pepper is not part of the hash, so the version of the pepper used is
+// stored next to it. bcrypt records its own cost, which lets the cost be
+// raised without a version of its own.
+
+// hashPassword hashes password with the current pepper and cost, and
+// returns the hash with the pepper version to store alongside it
+func hashPassword(password string) (string, int, error) {
+	pwBytes := []byte(password + config.PassPepper)
+	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, config.PasswordCost)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(hashedBytes), config.PassPepperVersion, nil
+}
+
+// comparePassword checks password against a hash made with the pepper of
+// version. It returns ErrorIncorrectPassword when they do not match, and
+// reports whether a matching hash should be replaced with one from
+// hashPassword.
+func comparePassword(hash string, version int, password string) (bool, error) {
+	pepper, ok := passPepper(version)
+	if !ok {
+		// The pepper has been retired, so the password cannot be checked
+		// and has to be reset
+		return false, ErrorIncorrectPassword
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password+pepper))
+	switch err {
+	case nil:
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return false, ErrorIncorrectPassword
+	default:
+		return false, err
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, err
+	}
+	return version != config.PassPepperVersion || cost != config.PasswordCost, nil
+}
+
+// passPepper returns the pepper of a version, if it is still configured
+func passPepper(version int) (string, bool) {
+	if version == config.PassPepperVersion {
+		return config.PassPepper, true
+	}
+	pepper, ok := config.PassPeppersPrevious[version]
+	return pepper, ok
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxSelectionNoteLength = 2000
+
+///////////////////////////////////////////////////////////////////////////////
+// Selection Model
+///////////////////////////////////////////////////////////////////////////////
+
+// Selection is what a client made of one image while proofing a gallery
+// through a share link: whether they picked it and the note they left.
+// Images the client has not touched have none.
+type Selection struct {
+	ID          int64  `gorm:"primaryKey;autoIncrement"`
+	ShareLinkID int64  `gorm:"not null;uniqueIndex:idx_selection_link_image"`
+	ImageID     int64  `gorm:"not null;uniqueIndex:idx_selection_link_image;index"`
+	Picked      bool   `gorm:"not null;default:false"`
+	Note        string `gorm:"not null;default:''"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// PickedImage is a picked image with its filename, for exporting a
+// selection
+type PickedImage struct {
+	ImageID  int64
+	Filename string
+	Note     string
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type SelectionDB interface {
+	// Read
+	ByShareLinkID(shareLinkID int64) ([]Selection, error)
+	PickedByShareLinkID(shareLinkID int64) ([]PickedImage, error)
+
+	// Update loads the selection of an image made through a share link,
+	// or a new one, passes it to fn and saves the result. The share link
+	// is locked meanwhile, so concurrent updates through it run one at a
+	// time. It returns ErrorSelectionSubmitted once the selection has
+	// been submitted and ErrorTooManyPicks when fn picks an image and the
+	// link already has maxPicks other picks. A maxPicks of 0 means no
+	// limit.
+	Update(shareLinkID, imageID int64, maxPicks int, fn func(*Selection) error) (*Selection, error)
+
+	// Delete
+	DeleteByShareLinkID(shareLinkID int64) error
+	DeleteByImageID(imageID int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// SelectionChange is a client's change to one image of their selection.
+// Nil fields are left as they were.
+type SelectionChange struct {
+	Picked *bool
+	Note   *string
+}
+
+// Select applies a client's change to an image of the gallery the link
+// shares. It returns ErrorSelectionSubmitted once the selection has been
+// submitted and ErrorTooManyPicks when picking the image would go over
+// the link's MaxPicks.
+func (sls *ShareLinkService) Select(link *ShareLink, imageID int64, change SelectionChange) (*Selection, error) {
+	if link.Submitted() {
+		return nil, ErrorSelectionSubmitted
+	}
+
+	image, err := sls.images.ByID(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if image.GalleryID != link.GalleryID {
+		return nil, ErrorNotFound
+	}
+
+	// The selection is read and the limit checked under the same lock as
+	// the write, so picks made from two tabs at once cannot go over it
+	return sls.selections.Update(link.ID, image.ID, link.MaxPicks, func(selection *Selection) error {
+		if change.Picked != nil {
+			selection.Picked = *change.Picked
+		}
+		if change.Note != nil {
+			selection.Note = *change.Note
+		}
+		return nil
+	})
+}
+
+// Selections returns the selection state of every image the client has
+// touched through the link
+func (sls *ShareLinkService) Selections(link *ShareLink) ([]Selection, error) {
+	return sls.selections.ByShareLinkID(link.ID)
+}
+
+// Picked returns the images picked through the link, by filename
+func (sls *ShareLinkService) Picked(link *ShareLink) ([]PickedImage, error) {
+	return sls.selections.PickedByShareLinkID(link.ID)
+}
+
+// Submit locks the selection made through the link so the client can no
+// longer change it. It returns ErrorSelectionSubmitted when it already
+// was.
+func (sls *ShareLinkService) Submit(link *ShareLink) error {
+	return sls.DB.Submit(link)
+}
+
+// Reopen lifts the submission lock so the client can change their
+// selection again
+func (sls *ShareLinkService) Reopen(link *ShareLink) error {
+	return sls.DB.Reopen(link)
+}
+
+// Revoke deletes a share link together with the selection made through it
+func (sls *ShareLinkService) Revoke(link *ShareLink) error {
+	if err := sls.selections.DeleteByShareLinkID(link.ID); err != nil {
+		return err
+	}
+	return sls.DB.Delete(link.ID)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type selectionValidator struct {
+	SelectionDB
+}
+
+func newSelectionValidator(nextLayer SelectionDB) *selectionValidator {
+	return &selectionValidator{
+		SelectionDB: nextLayer,
+	}
+}
+
+// Update checks the selection fn leaves before it is saved
+func (sv *selectionValidator) Update(shareLinkID, imageID int64, maxPicks int, fn func(*Selection) error) (*Selection, error) {
+	if shareLinkID <= 0 || imageID <= 0 {
+		return nil, ErrorInvalidId
+	}
+	return sv.SelectionDB.Update(shareLinkID, imageID, maxPicks, func(selection *Selection) error {
+		if err := fn(selection); err != nil {
+			return err
+		}
+		selection.Note = strings.TrimSpace(selection.Note)
+		if utf8.RuneCountInString(selection.Note) > maxSelectionNoteLength {
+			return &ValidationError{"note must be at most 2000 characters long"}
+		}
+		return nil
+	})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of SelectionDB interface
+type selectionGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of selectionGorm
+func newSelectionGorm(db *gorm.DB) *selectionGorm {
+	return &selectionGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Retrieve every selection made through a share link
+func (sg *selectionGorm) ByShareLinkID(shareLinkID int64) ([]Selection, error) {
+	var selections []Selection
+	db := sg.db.Where("share_link_id = ?", shareLinkID).Order("image_id")
+	if err := all(db, &selections); err != nil {
+		return nil, err
+	}
+	return selections, nil
+}
+
+// Retrieve the images picked through a share link, in upload order
+func (sg *selectionGorm) PickedByShareLinkID(shareLinkID int64) ([]PickedImage, error) {
+	var picked []PickedImage
+	db := sg.db.Model(&Selection{}).
+		Select("selections.image_id, images.filename, selections.note").
+		Joins("JOIN images ON images.id = selections.image_id").
+		Where("selections.share_link_id = ? AND selections.picked", shareLinkID).
+		Order("images.created_at, images.id")
+	if err := db.Scan(&picked).Error; err != nil {
+		return nil, err
+	}
+	return picked, nil
+}
+
+// Update runs in a transaction that starts by locking the share link row.
+// The selection is read after the lock is taken, so a concurrent update
+// that created it is seen rather than inserted a second time.
+func (sg *selectionGorm) Update(shareLinkID, imageID int64, maxPicks int, fn func(*Selection) error) (*Selection, error) {
+	var selection Selection
+	err := sg.db.Transaction(func(tx *gorm.DB) error {
+		var link ShareLink
+		db := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "submitted_at").
+			Where("id = ?", shareLinkID)
+		if err := first(db, &link); err != nil {
+			return err
+		}
+		if link.Submitted() {
+			return ErrorSelectionSubmitted
+		}
+
+		db = tx.Where("share_link_id = ? AND image_id = ?", shareLinkID, imageID)
+		err := first(db, &selection)
+		if err == ErrorNotFound {
+			selection = Selection{ShareLinkID: shareLinkID, ImageID: imageID}
+		} else if err != nil {
+			return err
+		}
+
+		wasPicked := selection.Picked
+		if err := fn(&selection); err != nil {
+			return err
+		}
+
+		// Only a new pick counts against the limit, so a client can
+		// still change the note of an image picked before the limit was
+		// lowered
+		if selection.Picked && !wasPicked && maxPicks > 0 {
+			var others int64
+			err := tx.Model(&Selection{}).
+				Where("share_link_id = ? AND image_id <> ? AND picked", shareLinkID, imageID).
+				Count(&others).Error
+			if err != nil {
+				return err
+			}
+			if others >= int64(maxPicks) {
+				return ErrorTooManyPicks
+			}
+		}
+
+		return tx.Save(&selection).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &selection, nil
+}
+
+// Delete every selection made through a share link
+func (sg *selectionGorm) DeleteByShareLinkID(shareLinkID int64) error {
+	return sg.db.Where("share_link_id = ?", shareLinkID).Delete(&Selection{}).Error
+}
+
+// Delete every selection of an image
+func (sg *selectionGorm) DeleteByImageID(imageID int64) error {
+	return sg.db.Where("image_id = ?", imageID).Delete(&Selection{}).Error
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"github.com/pranav244872/lenslocked.com/breach"
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/hash"
+	"github.com/pranav244872/lenslocked.com/lockout"
+	"github.com/pranav244872/lenslocked.com/storage"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Services
+///////////////////////////////////////////////////////////////////////////////
+
+// Services bundles every service so they can share a single
+// database connection and the same hashing tools.
+type Services struct {
+	User    *UserService
+	Session *SessionService
+	Gallery *GalleryService
+	Image   *ImageService
+	// ShareLink is for the links owners send to clients to view galleries
+	ShareLink *ShareLinkService
+	// Upload runs resumable uploads of images
+	Upload *UploadService
+	// Purger deletes accounts once their deletion grace period is over
+	Purger *AccountPurger
+
+	// LoginAttempts is the Postgres-backed store for login failure counters
+	LoginAttempts lockout.Store
+
+	db *gorm.DB
+}
+
+// NewServices connects to the database and builds every service. Image
+// files are kept in store.
+func NewServices(connectionInfo string, store storage.ImageStore) (*Services, error) {
+	// initialize db connection
+	db, err := gorm.Open(postgres.Open(connectionInfo), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Info),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create shared tools first
+	hmac := newHMAC()
+	breached, err := breach.Open(config.BreachedPasswordsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := newSessionService(db, hmac)
+	us := newUserService(db, hmac, ss.DB, breached)
+	gs := newGalleryService(db)
+	is := newImageService(db, store)
+	sls := newShareLinkService(db, hmac)
+	ups := newUploadService(db, is)
+
+	return &Services{
+		User:          us,
+		Session:       ss,
+		Gallery:       gs,
+		Image:         is,
+		ShareLink:     sls,
+		Upload:        ups,
+		Purger:        newAccountPurger(us, gs, is, sls, ups),
+		LoginAttempts: newLoginAttemptGorm(db),
+		db:            db,
+	}, nil
+}
+
+// newHMAC builds the token HMAC from the configured keys. Without
+// HMACKeys, tokens are hashed with HMACKey alone, as they always were.
+func newHMAC() hash.HMAC {
+	if len(config.HMACKeys) == 0 {
+		return hash.NewHMAC(config.HMACKey)
+	}
+	keys := make([]hash.Key, 0, len(config.HMACKeys)+1)
+	for _, k := range config.HMACKeys {
+		keys = append(keys, hash.Key{ID: k.ID, Secret: k.Secret})
+	}
+	if config.HMACKey != "" {
+		keys = append(keys, hash.Key{Secret: config.HMACKey})
+	}
+	return hash.NewKeyedHMAC(keys[0], keys[1:]...)
+}
+
+// findHashed calls find with the hash of token under each key of h, the
+// current key first, until one is found. It returns the hash that was,
+// so callers can tell whether it needs rehashing.
+func findHashed(h hash.HMAC, token string, find func(tokenHash string) error) (string, error) {
+	for _, tokenHash := range h.Hashes(token) {
+		err := find(tokenHash)
+		if err != ErrorNotFound {
+			return tokenHash, err
+		}
+	}
+	return "", ErrorNotFound
+}
+
+// --- Lifecycle Methods ---
+
+// closes the database connection.
+func (s *Services) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// runs the GORM auto-migration for every model.
+func (s *Services) AutoMigrate() error {
+	if err := s.db.AutoMigrate(
+		&User{}, &Session{}, &PasswordReset{}, &EmailVerification{},
+		&RecoveryCode{}, &TwoFactorChallenge{}, &LoginAttempt{},
+		&Gallery{}, &Image{}, &Derivative{}, &ImageMetadata{}, &ShareLink{}, &Selection{},
+		&DownloadEvent{}, &ResumableUpload{},
+	); err != nil {
+		return err
+	}
+	// Remember tokens now live in the sessions table
+	if s.db.Migrator().HasColumn(&User{}, "remember_hash") {
+		if err := s.db.Migrator().DropColumn(&User{}, "remember_hash"); err != nil {
+			return err
+		}
+	}
+	return s.backfillGallerySlugs()
+}
+
+// backfillGallerySlugs gives a slug to galleries created before they had
+// one
+func (s *Services) backfillGallerySlugs() error {
+	var galleries []Gallery
+	db := s.db.Unscoped().Where("slug IS NULL OR slug = ''")
+	if err := all(db, &galleries); err != nil {
+		return err
+	}
+	for _, gallery := range galleries {
+		slug, err := newGallerySlug()
+		if err != nil {
+			return err
+		}
+		err = s.db.Unscoped().Model(&Gallery{ID: gallery.ID}).Update("slug", slug).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drops and rebuilds every table.
+func (s *Services) DestructiveReset() error {
+	if err := s.db.Migrator().DropTable(
+		&ResumableUpload{}, &DownloadEvent{}, &Selection{}, &ShareLink{}, &ImageMetadata{}, &Derivative{}, &Image{}, &Gallery{}, &LoginAttempt{}, &TwoFactorChallenge{}, &RecoveryCode{},
+		&EmailVerification{}, &PasswordReset{}, &Session{}, &User{},
+	); err != nil {
+		return err
+	}
+	return s.AutoMigrate()
+}
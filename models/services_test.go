@@ -0,0 +1,52 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pranav244872/lenslocked.com/hash"
+)
+
+func TestFindHashed(t *testing.T) {
+	legacy := hash.NewHMAC("legacy secret")
+	old := hash.NewKeyedHMAC(hash.Key{ID: "k1", Secret: "first secret"})
+	h := hash.NewKeyedHMAC(hash.Key{ID: "k2", Secret: "second secret"},
+		hash.Key{ID: "k1", Secret: "first secret"}, hash.Key{Secret: "legacy secret"})
+	errBroken := errors.New("broken")
+
+	tests := []struct {
+		name     string
+		stored   string
+		findErr  error
+		wantHash string
+		wantErr  error
+		wantRuns int
+	}{
+		{"current key", h.Hash("token"), nil, h.Hash("token"), nil, 1},
+		{"previous key", old.Hash("token"), nil, old.Hash("token"), nil, 2},
+		{"unnamed key", legacy.Hash("token"), nil, legacy.Hash("token"), nil, 3},
+		{"unknown token", legacy.Hash("other"), nil, "", ErrorNotFound, 3},
+		{"lookup error", h.Hash("token"), errBroken, h.Hash("token"), errBroken, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			got, err := findHashed(h, "token", func(tokenHash string) error {
+				runs++
+				if tt.findErr != nil {
+					return tt.findErr
+				}
+				if tokenHash != tt.stored {
+					return ErrorNotFound
+				}
+				return nil
+			})
+			if got != tt.wantHash || err != tt.wantErr {
+				t.Errorf("findHashed = %q, %v, want %q, %v", got, err, tt.wantHash, tt.wantErr)
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("find ran %d times, want %d", runs, tt.wantRuns)
+			}
+		})
+	}
+}
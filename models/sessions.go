@@ -0,0 +1,380 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/hash"
+	"github.com/pranav244872/lenslocked.com/rand"
+	"gorm.io/gorm"
+)
+
+// sessionTouchInterval limits how often LastSeenAt is written back
+const sessionTouchInterval = time.Minute
+
+///////////////////////////////////////////////////////////////////////////////
+// Session Model
+///////////////////////////////////////////////////////////////////////////////
+
+// Session is a single signed-in device. A user can hold any number of
+// them, each with its own remember token.
+type Session struct {
+	ID         int64  `gorm:"primaryKey;autoIncrement"`
+	UserID     int64  `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;uniqueIndex"`
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null;index"`
+}
+
+// AbsoluteExpiresAt is the point past which the session can no longer be
+// renewed. ExpiresAt slides forward on use but never beyond it.
+func (s *Session) AbsoluteExpiresAt() time.Time {
+	return s.CreatedAt.Add(config.SessionAbsoluteTimeout)
+}
+
+// expired reports whether the session has run out at the given time
+func (s *Session) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || !now.Before(s.AbsoluteExpiresAt())
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type SessionDB interface {
+	// Create
+	Create(session *Session) error
+
+	// Read
+	ByToken(token string) (*Session, error)
+
+	// Update
+	Update(session *Session) error
+	Rotate(session *Session) error
+
+	// Delete
+	Delete(id int64) error
+	DeleteByUserID(userID int64) error
+	DeleteOthers(userID, keepID int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type SessionService struct {
+	DB SessionDB
+}
+
+func newSessionService(db *gorm.DB, hmac hash.HMAC) *SessionService {
+	// Create db layer implementation
+	sg := newSessionGorm(db)
+
+	// create validation layer
+	sv := newSessionValidator(sg, hmac)
+
+	// Create service layer
+	return &SessionService{
+		DB: sv,
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+func newSessionValidator(nextLayer SessionDB, hmac hash.HMAC) *sessionValidator {
+	return &sessionValidator{
+		SessionDB: nextLayer,
+		hmac:      hmac,
+	}
+}
+
+// Create
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFns(session,
+		sv.userIDRequired,
+		sv.setToken,
+		sv.tokenMinBytes,
+		sv.hashToken,
+		sv.tokenHashRequired,
+		sv.setExpiry,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+// Read By Token. Expired sessions are deleted and reported as not found,
+// and sessions past half of their idle timeout are renewed. Tokens
+// hashed with a previous key are rehashed with the current one.
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	var session *Session
+	tokenHash, err := findHashed(sv.hmac, token, func(tokenHash string) (err error) {
+		session, err = sv.SessionDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if session.expired(now) {
+		if err := sv.SessionDB.Delete(session.ID); err != nil && err != ErrorNotFound {
+			return nil, err
+		}
+		return nil, ErrorSessionExpired
+	}
+
+	renew := session.ExpiresAt.Sub(now) < config.SessionIdleTimeout/2
+	if renew {
+		session.ExpiresAt = idleExpiry(session, now)
+	}
+	rehash := !sv.hmac.IsCurrent(tokenHash)
+	if rehash {
+		session.TokenHash = sv.hmac.Hash(token)
+	}
+	if renew || rehash || now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		session.LastSeenAt = now
+		if err := sv.SessionDB.Update(session); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Update
+func (sv *sessionValidator) Update(session *Session) error {
+	err := runSessionValFns(session,
+		sv.userIDRequired,
+		sv.hashToken, // Will be skipped if token is ""
+		sv.tokenHashRequired,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+// Rotate replaces the token of an existing session, leaving the new raw
+// token in session.Token. Callers use it after privilege-sensitive actions
+// so a token captured earlier stops working.
+func (sv *sessionValidator) Rotate(session *Session) error {
+	session.Token = ""
+	err := runSessionValFns(session,
+		sv.idGreaterThan(0),
+		sv.userIDRequired,
+		sv.setToken,
+		sv.tokenMinBytes,
+		sv.hashToken,
+		sv.tokenHashRequired,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+// Delete
+func (sv *sessionValidator) Delete(id int64) error {
+	var session Session
+	session.ID = id
+	err := runSessionValFns(&session, sv.idGreaterThan(0))
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+// Delete every session that belongs to the given user
+func (sv *sessionValidator) DeleteByUserID(userID int64) error {
+	var session Session
+	session.UserID = userID
+	err := runSessionValFns(&session, sv.userIDRequired)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.DeleteByUserID(userID)
+}
+
+// Delete every session of the given user but one
+func (sv *sessionValidator) DeleteOthers(userID, keepID int64) error {
+	var session Session
+	session.UserID = userID
+	err := runSessionValFns(&session, sv.userIDRequired)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.DeleteOthers(userID, keepID)
+}
+
+// --- Validation Helpers ---
+
+type sessionValFn func(*Session) error
+
+func runSessionValFns(session *Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *sessionValidator) idGreaterThan(n int64) sessionValFn {
+	return func(session *Session) error {
+		if session.ID <= n {
+			return ErrorInvalidId
+		}
+		return nil
+	}
+}
+
+func (sv *sessionValidator) userIDRequired(session *Session) error {
+	if session.UserID <= 0 {
+		return ErrorInvalidId
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setToken(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(session *Session) error {
+	l, err := rand.NBytes(session.Token)
+
+	if err != nil {
+		return err
+	}
+
+	if l != rand.RememberTokenBytes {
+		return errors.New("remember token length is not 32")
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hashToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+func (sv *sessionValidator) tokenHashRequired(session *Session) error {
+	if session.TokenHash == "" {
+		return errors.New("remember hashing failed")
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setExpiry(session *Session) error {
+	now := time.Now()
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = now
+	}
+	session.LastSeenAt = now
+	session.ExpiresAt = idleExpiry(session, now)
+	return nil
+}
+
+// idleExpiry is when the session ends if it is not used again after now
+func idleExpiry(session *Session, now time.Time) time.Time {
+	expiresAt := now.Add(config.SessionIdleTimeout)
+	if absolute := session.AbsoluteExpiresAt(); absolute.Before(expiresAt) {
+		return absolute
+	}
+	return expiresAt
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of SessionDB interface
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of sessionGorm
+func newSessionGorm(db *gorm.DB) *sessionGorm {
+	return &sessionGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create session
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+// Retrieve by the hash of a remember token
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+
+	db := sg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Update
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+// Rotate stores the new token hash of a session
+func (sg *sessionGorm) Rotate(session *Session) error {
+	return sg.Update(session)
+}
+
+// Delete
+func (sg *sessionGorm) Delete(id int64) error {
+	session := Session{ID: id}
+	result := sg.db.Delete(&session)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
+
+// Delete every session for a user, signing them out on all devices
+func (sg *sessionGorm) DeleteByUserID(userID int64) error {
+	return sg.db.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+
+// Delete every session for a user except keepID, signing them out on all
+// other devices
+func (sg *sessionGorm) DeleteOthers(userID, keepID int64) error {
+	return sg.db.Where("user_id = ? AND id <> ?", userID, keepID).Delete(&Session{}).Error
+}
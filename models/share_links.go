@@ -0,0 +1,417 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/hash"
+	"github.com/pranav244872/lenslocked.com/rand"
+	"gorm.io/gorm"
+)
+
+const maxShareLinkLabelLength = 200
+
+///////////////////////////////////////////////////////////////////////////////
+// Share Link Model
+///////////////////////////////////////////////////////////////////////////////
+
+// ShareLink gives anyone holding its token access to a gallery, whatever
+// the gallery's visibility. Only the HMAC of the token is stored; the raw
+// token is handed to the owner once, when the link is created.
+type ShareLink struct {
+	ID        int64  `gorm:"primaryKey;autoIncrement"`
+	GalleryID int64  `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+	// Label lets the owner tell their links apart, e.g. the client's name
+	Label string
+	// ExpiresAt is nil for links that never expire
+	ExpiresAt     *time.Time
+	AllowDownload bool `gorm:"not null;default:false"`
+	// Password is only set when creating a link; PasswordHash is empty
+	// for links without one
+	Password        string `gorm:"-"`
+	PasswordHash    string
+	PasswordVersion int `gorm:"not null;default:1"`
+	// MaxPicks caps how many images the client may pick; 0 is no limit
+	MaxPicks int `gorm:"not null;default:0"`
+	// SubmittedAt is set once the client submits their selection, which
+	// locks it
+	SubmittedAt  *time.Time
+	Views        int64 `gorm:"not null;default:0"`
+	LastViewedAt *time.Time
+	CreatedAt    time.Time
+}
+
+// HasPassword reports whether the link asks for a password
+func (sl *ShareLink) HasPassword() bool {
+	return sl.PasswordHash != ""
+}
+
+// Submitted reports whether the client has submitted their selection
+func (sl *ShareLink) Submitted() bool {
+	return sl.SubmittedAt != nil
+}
+
+// Expired reports whether the link has run out at the given time
+func (sl *ShareLink) Expired(now time.Time) bool {
+	return sl.ExpiresAt != nil && !now.Before(*sl.ExpiresAt)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type ShareLinkDB interface {
+	// Create
+	Create(link *ShareLink) error
+
+	// Read
+	ByID(id int64) (*ShareLink, error)
+	ByToken(token string) (*ShareLink, error)
+	ByGalleryID(galleryID int64) ([]ShareLink, error)
+
+	// Update
+	RecordView(id int64) error
+	Submit(link *ShareLink) error
+	Reopen(link *ShareLink) error
+	Rehash(link *ShareLink) error
+	RehashPassword(link *ShareLink) error
+
+	// Delete
+	Delete(id int64) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type ShareLinkService struct {
+	DB ShareLinkDB
+
+	// selections holds what clients picked through the links
+	selections SelectionDB
+	images     ImageDB
+}
+
+func newShareLinkService(db *gorm.DB, hmac hash.HMAC) *ShareLinkService {
+	// Create db layer implementation
+	slg := newShareLinkGorm(db)
+
+	// create validation layer
+	slv := newShareLinkValidator(slg, hmac)
+
+	// Create service layer
+	return &ShareLinkService{
+		DB:         slv,
+		selections: newSelectionValidator(newSelectionGorm(db)),
+		images:     newImageValidator(newImageGorm(db)),
+	}
+}
+
+// Open resolves a share link token, checking the link's password when it
+// has one. Unknown and expired links are reported as ErrorNotFound, a
+// missing password as ErrorPasswordRequired and a wrong one as
+// ErrorIncorrectPassword.
+func (sls *ShareLinkService) Open(token, password string) (*ShareLink, error) {
+	link, err := sls.DB.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if !link.HasPassword() {
+		return link, nil
+	}
+	if password == "" {
+		return nil, ErrorPasswordRequired
+	}
+
+	rehash, err := comparePassword(link.PasswordHash, link.PasswordVersion, password)
+	if err != nil {
+		return nil, err
+	}
+	if rehash {
+		pwHash, version, err := hashPassword(password)
+		if err == nil {
+			link.PasswordHash, link.PasswordVersion = pwHash, version
+			err = sls.DB.RehashPassword(link)
+		}
+		if err != nil {
+			log.Printf("share links: rehashing the password of link %d: %v", link.ID, err)
+		}
+	}
+	return link, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type shareLinkValidator struct {
+	ShareLinkDB
+	hmac hash.HMAC
+}
+
+func newShareLinkValidator(nextLayer ShareLinkDB, hmac hash.HMAC) *shareLinkValidator {
+	return &shareLinkValidator{
+		ShareLinkDB: nextLayer,
+		hmac:        hmac,
+	}
+}
+
+// Create
+func (slv *shareLinkValidator) Create(link *ShareLink) error {
+	err := runShareLinkValFns(link,
+		slv.galleryIDRequired,
+		slv.normalizeLabel,
+		slv.expiryInFuture,
+		slv.maxPicksValid,
+		slv.hashPassword,
+		slv.setToken,
+		slv.hashToken,
+	)
+	if err != nil {
+		return err
+	}
+	return slv.ShareLinkDB.Create(link)
+}
+
+// Read By ID
+func (slv *shareLinkValidator) ByID(id int64) (*ShareLink, error) {
+	if id <= 0 {
+		return nil, ErrorNotFound
+	}
+	return slv.ShareLinkDB.ByID(id)
+}
+
+// Read By Token. Expired links are reported as not found. Links live
+// long, so tokens hashed with a previous key are rehashed with the
+// current one.
+func (slv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	if token == "" {
+		return nil, ErrorNotFound
+	}
+	var link *ShareLink
+	tokenHash, err := findHashed(slv.hmac, token, func(tokenHash string) (err error) {
+		link, err = slv.ShareLinkDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if link.Expired(time.Now()) {
+		return nil, ErrorNotFound
+	}
+	if !slv.hmac.IsCurrent(tokenHash) {
+		link.TokenHash = slv.hmac.Hash(token)
+		if err := slv.ShareLinkDB.Rehash(link); err != nil {
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+// Delete
+func (slv *shareLinkValidator) Delete(id int64) error {
+	if id <= 0 {
+		return ErrorInvalidId
+	}
+	return slv.ShareLinkDB.Delete(id)
+}
+
+// --- Validation Helpers ---
+
+type shareLinkValFn func(*ShareLink) error
+
+func runShareLinkValFns(link *ShareLink, fns ...shareLinkValFn) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) galleryIDRequired(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrorInvalidId
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) normalizeLabel(link *ShareLink) error {
+	link.Label = strings.TrimSpace(link.Label)
+	if len(link.Label) > maxShareLinkLabelLength {
+		return &ValidationError{"label must be at most 200 characters long"}
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) expiryInFuture(link *ShareLink) error {
+	if link.ExpiresAt != nil && link.Expired(time.Now()) {
+		return &ValidationError{"expiry must be in the future"}
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) maxPicksValid(link *ShareLink) error {
+	if link.MaxPicks < 0 {
+		return &ValidationError{"max picks cannot be negative"}
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) hashPassword(link *ShareLink) error {
+	if link.Password == "" {
+		return nil
+	}
+	pwHash, version, err := hashPassword(link.Password)
+	if err != nil {
+		return err
+	}
+	link.PasswordHash = pwHash
+	link.PasswordVersion = version
+	link.Password = ""
+	return nil
+}
+
+func (slv *shareLinkValidator) setToken(link *ShareLink) error {
+	if link.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
+
+func (slv *shareLinkValidator) hashToken(link *ShareLink) error {
+	if link.Token == "" {
+		return errors.New("share link token is required")
+	}
+	link.TokenHash = slv.hmac.Hash(link.Token)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of ShareLinkDB interface
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of shareLinkGorm
+func newShareLinkGorm(db *gorm.DB) *shareLinkGorm {
+	return &shareLinkGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create share link
+func (slg *shareLinkGorm) Create(link *ShareLink) error {
+	return slg.db.Create(link).Error
+}
+
+// Retrieve by ID
+func (slg *shareLinkGorm) ByID(id int64) (*ShareLink, error) {
+	var link ShareLink
+	db := slg.db.Where("id = ?", id)
+	err := first(db, &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Retrieve by the hash of a share link token
+func (slg *shareLinkGorm) ByToken(tokenHash string) (*ShareLink, error) {
+	var link ShareLink
+	db := slg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Retrieve every share link of a gallery, newest first
+func (slg *shareLinkGorm) ByGalleryID(galleryID int64) ([]ShareLink, error) {
+	var links []ShareLink
+	db := slg.db.Where("gallery_id = ?", galleryID).Order("created_at DESC")
+	if err := all(db, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// RecordView counts a visit through the link. The counter is incremented
+// in the database so concurrent visits are not lost.
+func (slg *shareLinkGorm) RecordView(id int64) error {
+	return slg.db.Model(&ShareLink{ID: id}).Updates(map[string]any{
+		"views":          gorm.Expr("views + 1"),
+		"last_viewed_at": time.Now(),
+	}).Error
+}
+
+// Submit locks the selection of a link. The check for an earlier
+// submission is part of the update, so a selection is only submitted
+// once.
+func (slg *shareLinkGorm) Submit(link *ShareLink) error {
+	now := time.Now()
+	result := slg.db.Model(&ShareLink{}).
+		Where("id = ? AND submitted_at IS NULL", link.ID).
+		Update("submitted_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrorSelectionSubmitted
+	}
+	link.SubmittedAt = &now
+	return nil
+}
+
+// Reopen lifts the submission lock of a link
+func (slg *shareLinkGorm) Reopen(link *ShareLink) error {
+	err := slg.db.Model(&ShareLink{ID: link.ID}).Update("submitted_at", nil).Error
+	if err != nil {
+		return err
+	}
+	link.SubmittedAt = nil
+	return nil
+}
+
+// Rehash stores a new token hash for a link
+func (slg *shareLinkGorm) Rehash(link *ShareLink) error {
+	return slg.db.Model(&ShareLink{ID: link.ID}).Update("token_hash", link.TokenHash).Error
+}
+
+// RehashPassword stores a new password hash for a link
+func (slg *shareLinkGorm) RehashPassword(link *ShareLink) error {
+	return slg.db.Model(&ShareLink{ID: link.ID}).Updates(map[string]any{
+		"password_hash":    link.PasswordHash,
+		"password_version": link.PasswordVersion,
+	}).Error
+}
+
+// Delete
+func (slg *shareLinkGorm) Delete(id int64) error {
+	result := slg.db.Delete(&ShareLink{ID: id})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
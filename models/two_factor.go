@@ -0,0 +1,463 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/hash"
+	"github.com/pranav244872/lenslocked.com/rand"
+	"github.com/pranav244872/lenslocked.com/totp"
+	"gorm.io/gorm"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+
+	// maxTwoFactorAttempts is how many wrong codes a pending login allows
+	maxTwoFactorAttempts = 5
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Two-Factor Models
+///////////////////////////////////////////////////////////////////////////////
+
+// RecoveryCode is a single-use code that can stand in for a TOTP code
+// when the user has lost their authenticator. Only its HMAC is stored.
+type RecoveryCode struct {
+	ID        int64  `gorm:"primaryKey;autoIncrement"`
+	UserID    int64  `gorm:"not null;index"`
+	Code      string `gorm:"-"`
+	CodeHash  string `gorm:"not null;uniqueIndex"`
+	CreatedAt time.Time
+}
+
+// TwoFactorChallenge is a login that passed the password check and is
+// waiting for the second factor. Its token is only good for finishing that
+// login, never as a remember token.
+type TwoFactorChallenge struct {
+	ID        int64  `gorm:"primaryKey;autoIncrement"`
+	UserID    int64  `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+	Attempts  int    `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// SetupTOTP generates a new TOTP secret for the user and stores it
+// unconfirmed. Two-factor login stays off until ConfirmTOTP succeeds.
+func (us *UserService) SetupTOTP(user *User) (string, error) {
+	if user.TOTPEnabled {
+		return "", ErrorTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	user.TOTPSecret = secret
+	user.TOTPLastCounter = 0
+	if err := us.DB.Update(user); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTP turns on two-factor login once the user proves their
+// authenticator produces valid codes. It returns a fresh set of recovery
+// codes, which are only ever shown this once.
+func (us *UserService) ConfirmTOTP(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrorTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrorTwoFactorNotSetUp
+	}
+	if err := us.checkTOTP(user, code); err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabled = true
+	if err := us.DB.Update(user); err != nil {
+		return nil, err
+	}
+	return us.newRecoveryCodes(user)
+}
+
+// DisableTOTP turns two-factor login off. It asks for the password and a
+// current TOTP or recovery code so a stolen session alone cannot do it.
+func (us *UserService) DisableTOTP(user *User, password, code string) error {
+	if !user.TOTPEnabled {
+		return ErrorTwoFactorNotSetUp
+	}
+	if err := us.checkPassword(user, password); err != nil {
+		return err
+	}
+	if err := us.checkSecondFactor(user, code); err != nil {
+		return err
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastCounter = 0
+	if err := us.DB.Update(user); err != nil {
+		return err
+	}
+	return us.recoveryCodes.DeleteByUserID(user.ID)
+}
+
+// StartTwoFactor is the first half of a two-factor login. Call it after
+// Authenticate succeeds for a user with TOTPEnabled; it returns the
+// short-lived token that CompleteTwoFactor expects.
+func (us *UserService) StartTwoFactor(user *User) (string, error) {
+	challenge := TwoFactorChallenge{
+		UserID: user.ID,
+	}
+	if err := us.challenges.Create(&challenge); err != nil {
+		return "", err
+	}
+	return challenge.Token, nil
+}
+
+// TwoFactorUser returns the user a pending two-factor login belongs to, so
+// the login can be checked against lockouts before a code is tried.
+// Unknown or expired tokens return ErrorNotFound.
+func (us *UserService) TwoFactorUser(token string) (*User, error) {
+	challenge, err := us.challenges.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return us.DB.ByID(challenge.UserID)
+}
+
+// CompleteTwoFactor is the second half of a two-factor login. code may be
+// a TOTP code or a recovery code; wrong ones return ErrorIncorrectCode.
+// The pending token is used up on success and after too many wrong codes;
+// unknown or expired tokens return ErrorNotFound.
+func (us *UserService) CompleteTwoFactor(token, code string) (*User, error) {
+	challenge, err := us.challenges.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := us.DB.ByID(challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := us.checkSecondFactor(user, code); err != nil {
+		if err != ErrorIncorrectCode {
+			return nil, err
+		}
+		challenge.Attempts++
+		if challenge.Attempts >= maxTwoFactorAttempts {
+			if err := us.challenges.Delete(challenge.ID); err != nil && err != ErrorNotFound {
+				return nil, err
+			}
+			return nil, ErrorIncorrectCode
+		}
+		if err := us.challenges.Update(challenge); err != nil {
+			return nil, err
+		}
+		return nil, ErrorIncorrectCode
+	}
+
+	if err := us.challenges.Delete(challenge.ID); err != nil {
+		// Lost a race with another request finishing the same login
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkSecondFactor accepts either a TOTP code or a recovery code
+func (us *UserService) checkSecondFactor(user *User, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return us.checkTOTP(user, code)
+	}
+	err := us.recoveryCodes.Consume(user.ID, code)
+	if err == ErrorNotFound {
+		return ErrorIncorrectCode
+	}
+	return err
+}
+
+// checkTOTP validates a TOTP code and refuses to accept the same time step
+// twice, so an observed code cannot be replayed. The step is checked
+// against the database rather than user, which may be out of date.
+func (us *UserService) checkTOTP(user *User, code string) error {
+	counter, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return ErrorIncorrectCode
+	}
+	if err := us.DB.UseTOTPCounter(user.ID, counter); err != nil {
+		return err
+	}
+	user.TOTPLastCounter = counter
+	return nil
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones in plain text
+func (us *UserService) newRecoveryCodes(user *User) ([]string, error) {
+	if err := us.recoveryCodes.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		rc := RecoveryCode{
+			UserID: user.ID,
+		}
+		if err := us.recoveryCodes.Create(&rc); err != nil {
+			return nil, err
+		}
+		codes = append(codes, rc.Code)
+	}
+	return codes, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interfaces
+///////////////////////////////////////////////////////////////////////////////
+
+type RecoveryCodeDB interface {
+	// Create
+	Create(rc *RecoveryCode) error
+
+	// Consume deletes the matching code, failing with ErrorNotFound if the
+	// user has no such unused code
+	Consume(userID int64, code string) error
+
+	// Delete
+	DeleteByUserID(userID int64) error
+}
+
+type TwoFactorChallengeDB interface {
+	// Create
+	Create(challenge *TwoFactorChallenge) error
+
+	// Read
+	ByToken(token string) (*TwoFactorChallenge, error)
+
+	// Update
+	Update(challenge *TwoFactorChallenge) error
+
+	// Delete
+	Delete(id int64) error
+	DeleteByUserID(userID int64) error
+}
+
+func newRecoveryCodeDB(db *gorm.DB, hmac hash.HMAC) RecoveryCodeDB {
+	return newRecoveryCodeValidator(newRecoveryCodeGorm(db), hmac)
+}
+
+func newTwoFactorChallengeDB(db *gorm.DB, hmac hash.HMAC) TwoFactorChallengeDB {
+	return newTwoFactorChallengeValidator(newTwoFactorChallengeGorm(db), hmac)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type recoveryCodeValidator struct {
+	RecoveryCodeDB
+	hmac hash.HMAC
+}
+
+func newRecoveryCodeValidator(nextLayer RecoveryCodeDB, hmac hash.HMAC) *recoveryCodeValidator {
+	return &recoveryCodeValidator{
+		RecoveryCodeDB: nextLayer,
+		hmac:           hmac,
+	}
+}
+
+// Create generates the code when none is set and stores its hash
+func (rcv *recoveryCodeValidator) Create(rc *RecoveryCode) error {
+	if rc.UserID <= 0 {
+		return ErrorInvalidId
+	}
+	if rc.Code == "" {
+		code, err := rand.RecoveryCode()
+		if err != nil {
+			return err
+		}
+		rc.Code = code
+	}
+	rc.CodeHash = rcv.hmac.Hash(normalizeRecoveryCode(rc.Code))
+	return rcv.RecoveryCodeDB.Create(rc)
+}
+
+// Consume
+func (rcv *recoveryCodeValidator) Consume(userID int64, code string) error {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return ErrorNotFound
+	}
+	_, err := findHashed(rcv.hmac, code, func(codeHash string) error {
+		return rcv.RecoveryCodeDB.Consume(userID, codeHash)
+	})
+	return err
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes so codes can be
+// typed however the user likes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+type twoFactorChallengeValidator struct {
+	TwoFactorChallengeDB
+	hmac hash.HMAC
+}
+
+func newTwoFactorChallengeValidator(nextLayer TwoFactorChallengeDB, hmac hash.HMAC) *twoFactorChallengeValidator {
+	return &twoFactorChallengeValidator{
+		TwoFactorChallengeDB: nextLayer,
+		hmac:                 hmac,
+	}
+}
+
+// Create
+func (tfcv *twoFactorChallengeValidator) Create(challenge *TwoFactorChallenge) error {
+	if challenge.UserID <= 0 {
+		return ErrorInvalidId
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	challenge.Token = token
+	challenge.TokenHash = tfcv.hmac.Hash(token)
+	challenge.ExpiresAt = time.Now().Add(config.TwoFactorPendingTimeout)
+	return tfcv.TwoFactorChallengeDB.Create(challenge)
+}
+
+// Read By Token. Expired challenges are reported as not found.
+func (tfcv *twoFactorChallengeValidator) ByToken(token string) (*TwoFactorChallenge, error) {
+	if token == "" {
+		return nil, ErrorNotFound
+	}
+	var challenge *TwoFactorChallenge
+	_, err := findHashed(tfcv.hmac, token, func(tokenHash string) (err error) {
+		challenge, err = tfcv.TwoFactorChallengeDB.ByToken(tokenHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(challenge.ExpiresAt) {
+		return nil, ErrorNotFound
+	}
+	return challenge, nil
+}
+
+// Delete
+func (tfcv *twoFactorChallengeValidator) Delete(id int64) error {
+	if id <= 0 {
+		return ErrorInvalidId
+	}
+	return tfcv.TwoFactorChallengeDB.Delete(id)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of RecoveryCodeDB interface
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of recoveryCodeGorm
+func newRecoveryCodeGorm(db *gorm.DB) *recoveryCodeGorm {
+	return &recoveryCodeGorm{
+		db: db,
+	}
+}
+
+// Create recovery code
+func (rcg *recoveryCodeGorm) Create(rc *RecoveryCode) error {
+	return rcg.db.Create(rc).Error
+}
+
+// Consume deletes the code in a single statement so it can only be used once
+func (rcg *recoveryCodeGorm) Consume(userID int64, codeHash string) error {
+	result := rcg.db.Where("user_id = ? AND code_hash = ?", userID, codeHash).Delete(&RecoveryCode{})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
+
+// Delete every recovery code of a user
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID int64) error {
+	return rcg.db.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
+
+// this is implementation of TwoFactorChallengeDB interface
+type twoFactorChallengeGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of twoFactorChallengeGorm
+func newTwoFactorChallengeGorm(db *gorm.DB) *twoFactorChallengeGorm {
+	return &twoFactorChallengeGorm{
+		db: db,
+	}
+}
+
+// Create challenge
+func (tfcg *twoFactorChallengeGorm) Create(challenge *TwoFactorChallenge) error {
+	return tfcg.db.Create(challenge).Error
+}
+
+// Retrieve by the hash of a pending login token
+func (tfcg *twoFactorChallengeGorm) ByToken(tokenHash string) (*TwoFactorChallenge, error) {
+	var challenge TwoFactorChallenge
+
+	db := tfcg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &challenge)
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// Update
+func (tfcg *twoFactorChallengeGorm) Update(challenge *TwoFactorChallenge) error {
+	return tfcg.db.Save(challenge).Error
+}
+
+// Delete
+func (tfcg *twoFactorChallengeGorm) Delete(id int64) error {
+	result := tfcg.db.Delete(&TwoFactorChallenge{ID: id})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
+
+// Delete every challenge for a user
+func (tfcg *twoFactorChallengeGorm) DeleteByUserID(userID int64) error {
+	return tfcg.db.Where("user_id = ?", userID).Delete(&TwoFactorChallenge{}).Error
+}
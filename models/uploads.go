@@ -0,0 +1,511 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+	"github.com/pranav244872/lenslocked.com/rand"
+	"gorm.io/gorm"
+)
+
+// resumableUploadIDBytes is the randomness in a resumable upload ID. The
+// ID is all a client needs to continue the upload, so it must not be
+// guessable.
+const resumableUploadIDBytes = 16
+
+///////////////////////////////////////////////////////////////////////////////
+// Resumable Upload Model
+///////////////////////////////////////////////////////////////////////////////
+
+// ResumableUpload is an image upload sent in any number of requests, so a
+// dropped connection only loses the request in flight. The data received
+// so far is kept in config.ResumableUploadDir; once all of it is there,
+// it is uploaded like any other image.
+type ResumableUpload struct {
+	ID        string `gorm:"primaryKey"`
+	GalleryID int64  `gorm:"not null;index"`
+	UserID    int64  `gorm:"not null"`
+	Filename  string `gorm:"not null"`
+	// Length is the size of the whole file and Received how much of it
+	// has arrived
+	Length   int64 `gorm:"not null"`
+	Received int64 `gorm:"not null;default:0"`
+	// ImageID is set once the upload is complete and the image stored
+	ImageID   *int64
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Complete reports whether the whole file has arrived
+func (u *ResumableUpload) Complete() bool {
+	return u.Received == u.Length
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database layer interface
+///////////////////////////////////////////////////////////////////////////////
+
+type ResumableUploadDB interface {
+	// Create
+	Create(upload *ResumableUpload) error
+
+	// Read
+	ByID(id string) (*ResumableUpload, error)
+	Expired(now time.Time) ([]ResumableUpload, error)
+	ByUserID(userID int64) ([]ResumableUpload, error)
+
+	// Update
+	Update(upload *ResumableUpload) error
+
+	// Delete
+	Delete(id string) error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Service Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// UploadService runs resumable uploads and feeds the finished files into
+// the ImageService. Uploads that stop coming are deleted once they
+// expire.
+type UploadService struct {
+	DB ResumableUploadDB
+
+	images *ImageService
+	dir    string
+
+	mu sync.Mutex
+	// writing holds the IDs of uploads a request is writing to
+	writing map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newUploadService(db *gorm.DB, images *ImageService) *UploadService {
+	// Create db layer implementation
+	ug := newResumableUploadGorm(db)
+
+	// create validation layer
+	uv := newResumableUploadValidator(ug)
+
+	// Create service layer
+	return &UploadService{
+		DB:      uv,
+		images:  images,
+		dir:     config.ResumableUploadDir,
+		writing: map[string]bool{},
+	}
+}
+
+// Create starts a resumable upload with no data received yet
+func (us *UploadService) Create(upload *ResumableUpload) error {
+	if err := os.MkdirAll(us.dir, 0o755); err != nil {
+		return err
+	}
+	if err := us.DB.Create(upload); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(us.path(upload), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		us.DB.Delete(upload.ID)
+		return err
+	}
+	return f.Close()
+}
+
+// Write appends the data of r to an upload. offset is where the client
+// believes the data goes and must match what was received so far, or
+// ErrorUploadOffset is returned. Data beyond the upload's length is
+// ignored. Whatever arrives is kept even when r fails, so the client can
+// resume from there. Once the upload is complete, the file is stored as
+// an image of the gallery.
+func (us *UploadService) Write(ctx context.Context, upload *ResumableUpload, offset int64, r io.Reader) error {
+	if !us.lock(upload.ID) {
+		return ErrorUploadBusy
+	}
+	defer us.unlock(upload.ID)
+
+	// Reload now that no other request can change the upload
+	current, err := us.DB.ByID(upload.ID)
+	if err != nil {
+		return err
+	}
+	*upload = *current
+	if offset != upload.Received {
+		return ErrorUploadOffset
+	}
+
+	if !upload.Complete() {
+		n, werr := us.append(upload, io.LimitReader(r, upload.Length-upload.Received))
+		upload.Received += n
+		upload.ExpiresAt = time.Now().Add(config.ResumableUploadExpiry)
+		if err := us.DB.Update(upload); err != nil {
+			return err
+		}
+		if werr != nil {
+			return werr
+		}
+	}
+
+	if upload.Complete() && upload.ImageID == nil {
+		return us.finish(ctx, upload)
+	}
+	return nil
+}
+
+// Terminate stops an upload and deletes the data received for it
+func (us *UploadService) Terminate(upload *ResumableUpload) error {
+	if !us.lock(upload.ID) {
+		return ErrorUploadBusy
+	}
+	defer us.unlock(upload.ID)
+	return us.delete(upload)
+}
+
+// TerminateAll stops and deletes every upload a user started. It returns
+// ErrorUploadBusy, after deleting the others, if one is being written.
+func (us *UploadService) TerminateAll(userID int64) error {
+	uploads, err := us.DB.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+	var busy bool
+	for i := range uploads {
+		err := us.Terminate(&uploads[i])
+		if err == ErrorUploadBusy {
+			busy = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if busy {
+		return ErrorUploadBusy
+	}
+	return nil
+}
+
+// StartExpiring deletes expired uploads every interval until Close is
+// called
+func (us *UploadService) StartExpiring(interval time.Duration) {
+	us.stop = make(chan struct{})
+	us.done = make(chan struct{})
+	go func() {
+		defer close(us.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := us.deleteExpired(); err != nil {
+				log.Printf("uploads: deleting expired uploads: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-us.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops deleting expired uploads
+func (us *UploadService) Close() {
+	if us.stop == nil {
+		return
+	}
+	close(us.stop)
+	<-us.done
+}
+
+// append writes r to the end of the data received for an upload and
+// returns how many bytes it wrote
+func (us *UploadService) append(upload *ResumableUpload, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(us.path(upload), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// A write cut short may have left bytes that were never recorded
+	if err := f.Truncate(upload.Received); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(upload.Received, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+// finish stores a complete upload as an image. Files that are not
+// acceptable images end the upload; on other errors the data is kept so
+// finishing can be retried.
+func (us *UploadService) finish(ctx context.Context, upload *ResumableUpload) error {
+	f, err := os.Open(us.path(upload))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The upload is done once the data is here, even if the client hangs
+	// up while it is processed
+	image, err := us.images.Upload(context.WithoutCancel(ctx), upload.GalleryID, upload.Filename, f)
+	if errors.Is(err, ErrorNotAnImage) || errors.Is(err, ErrorImageTooLarge) {
+		if derr := us.delete(upload); derr != nil {
+			log.Printf("uploads: deleting rejected upload %s: %v", upload.ID, derr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// The upload is kept until it expires, so clients can still ask for
+	// its status
+	upload.ImageID = &image.ID
+	if err := us.DB.Update(upload); err != nil {
+		return err
+	}
+	return us.removeData(upload)
+}
+
+// deleteExpired deletes every upload past its expiry
+func (us *UploadService) deleteExpired() error {
+	uploads, err := us.DB.Expired(time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range uploads {
+		if !us.lock(uploads[i].ID) {
+			continue
+		}
+		err := us.delete(&uploads[i])
+		us.unlock(uploads[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete removes an upload and its data
+func (us *UploadService) delete(upload *ResumableUpload) error {
+	if err := us.removeData(upload); err != nil {
+		return err
+	}
+	if err := us.DB.Delete(upload.ID); err != nil && err != ErrorNotFound {
+		return err
+	}
+	return nil
+}
+
+// removeData deletes the data received for an upload, if any is left
+func (us *UploadService) removeData(upload *ResumableUpload) error {
+	err := os.Remove(us.path(upload))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// path is where the data of an upload is kept
+func (us *UploadService) path(upload *ResumableUpload) string {
+	return filepath.Join(us.dir, upload.ID)
+}
+
+// lock claims an upload for writing and reports false when another
+// request already has it
+func (us *UploadService) lock(id string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.writing[id] {
+		return false
+	}
+	us.writing[id] = true
+	return true
+}
+
+func (us *UploadService) unlock(id string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.writing, id)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Validation Layer
+///////////////////////////////////////////////////////////////////////////////
+
+type resumableUploadValidator struct {
+	ResumableUploadDB
+}
+
+func newResumableUploadValidator(nextLayer ResumableUploadDB) *resumableUploadValidator {
+	return &resumableUploadValidator{
+		ResumableUploadDB: nextLayer,
+	}
+}
+
+// Create
+func (uv *resumableUploadValidator) Create(upload *ResumableUpload) error {
+	err := runResumableUploadValFns(upload,
+		uv.idsRequired,
+		uv.lengthValid,
+		uv.cleanFilename,
+		uv.setID,
+		uv.setExpiry,
+	)
+	if err != nil {
+		return err
+	}
+	return uv.ResumableUploadDB.Create(upload)
+}
+
+// Read By ID. Expired uploads are reported as not found.
+func (uv *resumableUploadValidator) ByID(id string) (*ResumableUpload, error) {
+	if id == "" {
+		return nil, ErrorNotFound
+	}
+	upload, err := uv.ResumableUploadDB.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(upload.ExpiresAt) {
+		return nil, ErrorNotFound
+	}
+	return upload, nil
+}
+
+// --- Validation Helpers ---
+
+type resumableUploadValFn func(*ResumableUpload) error
+
+func runResumableUploadValFns(upload *ResumableUpload, fns ...resumableUploadValFn) error {
+	for _, fn := range fns {
+		if err := fn(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (uv *resumableUploadValidator) idsRequired(upload *ResumableUpload) error {
+	if upload.GalleryID <= 0 || upload.UserID <= 0 {
+		return ErrorInvalidId
+	}
+	return nil
+}
+
+func (uv *resumableUploadValidator) lengthValid(upload *ResumableUpload) error {
+	if upload.Length <= 0 {
+		return errors.New("upload length must be positive")
+	}
+	if upload.Length > config.MaxImageBytes {
+		return ErrorImageTooLarge
+	}
+	return nil
+}
+
+func (uv *resumableUploadValidator) cleanFilename(upload *ResumableUpload) error {
+	upload.Filename = cleanFilename(upload.Filename)
+	return nil
+}
+
+func (uv *resumableUploadValidator) setID(upload *ResumableUpload) error {
+	id, err := rand.String(resumableUploadIDBytes)
+	if err != nil {
+		return err
+	}
+	upload.ID = id
+	return nil
+}
+
+func (uv *resumableUploadValidator) setExpiry(upload *ResumableUpload) error {
+	upload.ExpiresAt = time.Now().Add(config.ResumableUploadExpiry)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Database Layer
+///////////////////////////////////////////////////////////////////////////////
+
+// this is implementation of ResumableUploadDB interface
+type resumableUploadGorm struct {
+	db *gorm.DB
+}
+
+// constructor which returns an instance of resumableUploadGorm
+func newResumableUploadGorm(db *gorm.DB) *resumableUploadGorm {
+	return &resumableUploadGorm{
+		db: db,
+	}
+}
+
+// --- CRUD operations ---
+
+// Create resumable upload
+func (ug *resumableUploadGorm) Create(upload *ResumableUpload) error {
+	return ug.db.Create(upload).Error
+}
+
+// Retrieve by ID
+func (ug *resumableUploadGorm) ByID(id string) (*ResumableUpload, error) {
+	var upload ResumableUpload
+	db := ug.db.Where("id = ?", id)
+	err := first(db, &upload)
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// Retrieve every upload that has expired
+func (ug *resumableUploadGorm) Expired(now time.Time) ([]ResumableUpload, error) {
+	var uploads []ResumableUpload
+	db := ug.db.Where("expires_at <= ?", now)
+	if err := all(db, &uploads); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// Retrieve every upload a user started, expired ones included
+func (ug *resumableUploadGorm) ByUserID(userID int64) ([]ResumableUpload, error) {
+	var uploads []ResumableUpload
+	db := ug.db.Where("user_id = ?", userID)
+	if err := all(db, &uploads); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// Update resumable upload
+func (ug *resumableUploadGorm) Update(upload *ResumableUpload) error {
+	return ug.db.Save(upload).Error
+}
+
+// Delete
+func (ug *resumableUploadGorm) Delete(id string) error {
+	result := ug.db.Delete(&ResumableUpload{ID: id})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
+	}
+
+	return nil
+}
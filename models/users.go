@@ -2,17 +2,16 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"net/mail"
 	"strings"
 	"time"
 
+	"github.com/pranav244872/lenslocked.com/breach"
 	"github.com/pranav244872/lenslocked.com/config"
 	"github.com/pranav244872/lenslocked.com/hash"
-	"github.com/pranav244872/lenslocked.com/rand"
-	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -20,27 +19,87 @@ import (
 ///////////////////////////////////////////////////////////////////////////////
 
 var (
-	ErrorNotFound          = errors.New("models: resource not found")
-	ErrorInvalidId         = errors.New("models: ID provided was invalid")
-	ErrorIncorrectPassword = errors.New("models: incorrect password provided")
-	ErrorEmailTaken        = errors.New("models: email address is already in use")
+	ErrorNotFound           = errors.New("models: resource not found")
+	ErrorInvalidId          = errors.New("models: ID provided was invalid")
+	ErrorIncorrectPassword  = errors.New("models: incorrect password provided")
+	ErrorEmailTaken         = errors.New("models: email address is already in use")
+	ErrorSessionExpired     = errors.New("models: session has expired")
+	ErrorEmailVerified      = errors.New("models: email address is already verified")
+	ErrorEmailNotVerified   = errors.New("models: email address is not verified")
+	ErrorIncorrectCode      = errors.New("models: incorrect two-factor code provided")
+	ErrorCodeRequired       = errors.New("models: two-factor code is required")
+	ErrorTwoFactorEnabled   = errors.New("models: two-factor authentication is already enabled")
+	ErrorTwoFactorNotSetUp  = errors.New("models: two-factor authentication is not set up")
+	ErrorNotAnImage         = errors.New("models: file is not a supported image")
+	ErrorImageTooLarge      = errors.New("models: image is too large")
+	ErrorImageProcessing    = errors.New("models: image is still being processed")
+	ErrorForbidden          = errors.New("models: not allowed")
+	ErrorPasswordRequired   = errors.New("models: password is required")
+	ErrorSelectionSubmitted = errors.New("models: selection has already been submitted")
+	ErrorTooManyPicks       = errors.New("models: too many images picked")
+	ErrorDownloadSize       = errors.New("models: size must be original or a derivative size")
+	ErrorUploadOffset       = errors.New("models: upload offset does not match")
+	ErrorUploadBusy         = errors.New("models: upload is being written by another request")
+	ErrorDeletionNotPending = errors.New("models: account deletion is not scheduled")
+	ErrorPasswordBreached   = errors.New("models: password is too common or has appeared in a data breach")
 )
 
+// ThrottledError is returned when an action was repeated too soon
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return "models: too many requests, retry after " + e.RetryAfter.Round(time.Second).String()
+}
+
+// ValidationError is returned when input is rejected, with a message that
+// can be shown to the user
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // User Model
 ///////////////////////////////////////////////////////////////////////////////
 
 type User struct {
-	ID           int64 `gorm:"primaryKey;autoIncrement"`
-	Name         string
-	Email        string `gorm:"not null;uniqueIndex"`
-	Password     string `gorm:"-"`
-	PasswordHash string `gorm:"not null"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
-	DeletedAt    gorm.DeletedAt `gorm:"index"`
-	Remember     string         `gorm:"-"`
-	RememberHash string         `gorm:"not null;uniqueIndex"`
+	ID              int64 `gorm:"primaryKey;autoIncrement"`
+	Name            string
+	Email           string `gorm:"not null;uniqueIndex"`
+	EmailVerified   bool   `gorm:"not null;default:false"`
+	EmailVerifiedAt *time.Time
+	Password        string `gorm:"-"`
+	PasswordHash    string `gorm:"not null"`
+	PasswordVersion int    `gorm:"not null;default:1"`
+	TOTPSecret      string
+	TOTPEnabled     bool  `gorm:"not null;default:false"`
+	TOTPLastCounter int64 `gorm:"not null;default:0"`
+	// DeleteAfter is set while a deletion the user asked for is pending.
+	// Once it has passed, the account is purged.
+	DeleteAfter *time.Time `gorm:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+}
+
+// DueForPurge reports whether the user asked for their account to be
+// deleted and the grace period is over at now
+func (u *User) DueForPurge(now time.Time) bool {
+	return u.DeleteAfter != nil && !now.Before(*u.DeleteAfter)
+}
+
+// RequireVerifiedEmail is the policy check for actions, such as
+// publishing galleries, that only owners of a confirmed address may take.
+func (u *User) RequireVerifiedEmail() error {
+	if !u.EmailVerified {
+		return ErrorEmailNotVerified
+	}
+	return nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -54,18 +113,21 @@ type UserDB interface {
 	// Read
 	ByID(id int64) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRememberToken(token string) (*User, error)
+	// DueForPurge returns the users whose scheduled deletion is due at
+	// now. Users soft-deleted without a schedule are left alone.
+	DueForPurge(now time.Time) ([]User, error)
 
 	// Update
 	Update(user *User) error
+	// UseTOTPCounter records counter as the last TOTP time step the user
+	// logged in with, failing with ErrorIncorrectCode unless it is later
+	// than the one already recorded
+	UseTOTPCounter(id, counter int64) error
 
 	// Delete
 	Delete(id int64) error
-
-	// Lifecycle Methods
-	Close() error
-	AutoMigrate() error
-	DestructiveReset() error
+	// Purge deletes the user row for good, freeing its email
+	Purge(id int64) error
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -73,52 +135,351 @@ type UserDB interface {
 ///////////////////////////////////////////////////////////////////////////////
 
 type UserService struct {
-	DB UserDB
+	DB            UserDB
+	sessions      SessionDB
+	pwResets      PasswordResetDB
+	verifications EmailVerificationDB
+	recoveryCodes RecoveryCodeDB
+	challenges    TwoFactorChallengeDB
+
+	// db, hmac and breached build the copy of the service that
+	// transaction hands out
+	db       *gorm.DB
+	hmac     hash.HMAC
+	breached *breach.List
 }
 
-func NewUserService(connectionInfo string) (*UserService, error) {
+func newUserService(db *gorm.DB, hmac hash.HMAC, sessions SessionDB, breached *breach.List) *UserService {
+	// Create db layer implementation
+	ug := newUserGorm(db)
+
+	// create validation layer
+	uv := newUserValidator(ug, breached)
 
-	// Create shared tools first
-	hmac := hash.NewHMAC(config.HMACKey)
+	// Create service layer
+	return &UserService{
+		DB:            uv,
+		sessions:      sessions,
+		pwResets:      newPasswordResetDB(db, hmac),
+		verifications: newEmailVerificationDB(db, hmac),
+		recoveryCodes: newRecoveryCodeDB(db, hmac),
+		challenges:    newTwoFactorChallengeDB(db, hmac),
+		db:            db,
+		hmac:          hmac,
+		breached:      breached,
+	}
+}
+
+// transaction calls fn with a copy of the service that reads and writes
+// every table inside one database transaction. It commits if fn returns
+// nil and rolls back otherwise.
+func (us *UserService) transaction(fn func(tx *UserService) error) error {
+	return us.db.Transaction(func(tx *gorm.DB) error {
+		sessions := newSessionValidator(newSessionGorm(tx), us.hmac)
+		return fn(newUserService(tx, us.hmac, sessions, us.breached))
+	})
+}
 
-	// Create db layer implementation
-	ug, err := newUserGorm(connectionInfo)
+// Authenticate checks the password for an email. For users with
+// TOTPEnabled this is only the first step of logging in; see
+// StartTwoFactor.
+func (us *UserService) Authenticate(email, password string) (*User, error) {
+	foundUser, err := us.DB.ByEmail(email)
 	if err != nil {
+		// Includes ErrorNotFound
 		return nil, err
 	}
 
-	// create validation layer
-	uv := newUserValidator(ug, hmac)
+	if err := us.checkPassword(foundUser, password); err != nil {
+		return nil, err
+	}
+	return foundUser, nil
+}
 
-	// Create service layer
-	us := &UserService{
-		DB: uv,
+// checkPassword compares password against the user's stored hash. A
+// hash made with an old pepper or cost is replaced while the password is
+// at hand; failing to do so does not fail the check.
+func (us *UserService) checkPassword(user *User, password string) error {
+	rehash, err := comparePassword(user.PasswordHash, user.PasswordVersion, password)
+	if err != nil {
+		return err
+	}
+	if rehash {
+		if err := us.rehashPassword(user, password); err != nil {
+			log.Printf("users: rehashing the password of user %d: %v", user.ID, err)
+		}
 	}
+	return nil
+}
 
-	return us, nil
+// rehashPassword stores a hash of password made with the current scheme
+func (us *UserService) rehashPassword(user *User, password string) error {
+	pwHash, version, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = pwHash
+	user.PasswordVersion = version
+	return us.DB.Update(user)
 }
 
-// Authenticate
-func (us *UserService) Authenticate(email, password string) (*User, error) {
-	foundUser, err := us.DB.ByEmail(email)
+// InitiateReset creates a password reset for the account with the given
+// email and returns that account with the raw token to send to it. It
+// returns ErrorNotFound for unknown emails; callers must not reveal that.
+func (us *UserService) InitiateReset(email string) (*User, string, error) {
+	user, err := us.DB.ByEmail(strings.TrimSpace(strings.ToLower(email)))
+	if err != nil {
+		return nil, "", err
+	}
+
+	pwr := PasswordReset{
+		UserID: user.ID,
+	}
+	if err := us.pwResets.Create(&pwr); err != nil {
+		return nil, "", err
+	}
+	return user, pwr.Token, nil
+}
+
+// ResetUser returns the user a password reset token belongs to, so the
+// reset can be checked against lockouts before a two-factor code is tried.
+// Unknown or expired tokens return ErrorNotFound.
+func (us *UserService) ResetUser(token string) (*User, error) {
+	pwr, err := us.pwResets.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return us.DB.ByID(pwr.UserID)
+}
+
+// CompleteReset sets a new password for the owner of a reset token. A
+// reset only proves access to the inbox, so users with TOTPEnabled must
+// also give a TOTP or recovery code: without one it returns
+// ErrorCodeRequired and wrong ones return ErrorIncorrectCode, leaving the
+// token and the account untouched.
+//
+// The token and every other outstanding reset for the user are used up,
+// all of the user's sessions are revoked and any pending email change is
+// cancelled, all in one transaction so a token cannot be used twice.
+// Unknown, expired or already used tokens return ErrorNotFound.
+func (us *UserService) CompleteReset(token, newPassword, code string) (*User, error) {
+	user, err := us.ResetUser(token)
 	if err != nil {
-		// Includes ErrorNotFound
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword(
-		[]byte(foundUser.PasswordHash),
-		[]byte(password+config.PassPepper),
-	)
+	if newPassword == "" {
+		return nil, &ValidationError{"password is required"}
+	}
+	if user.TOTPEnabled && strings.TrimSpace(code) == "" {
+		return nil, ErrorCodeRequired
+	}
+
+	err = us.transaction(func(tx *UserService) error {
+		// Another request may have used the token since it was read
+		if err := tx.pwResets.Consume(token); err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			if err := tx.checkSecondFactor(user, code); err != nil {
+				return err
+			}
+		}
+
+		user.Password = newPassword
+		if err := tx.DB.Update(user); err != nil {
+			return err
+		}
+
+		if err := tx.pwResets.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+		if err := tx.sessions.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+		return tx.verifications.DeleteByUserID(user.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
 
+// StartEmailVerification issues a verification token for the user's
+// current email and returns it. A new token can only be issued once
+// config.VerificationResendInterval has passed since the last one;
+// earlier calls return a *ThrottledError.
+func (us *UserService) StartEmailVerification(user *User) (string, error) {
+	if user.EmailVerified {
+		return "", ErrorEmailVerified
+	}
+	return us.issueVerification(&EmailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	})
+}
+
+// issueVerification replaces the user's outstanding verification with ev
+// and returns its token, throttled like StartEmailVerification
+func (us *UserService) issueVerification(ev *EmailVerification) (string, error) {
+	existing, err := us.verifications.ByUserID(ev.UserID)
 	switch err {
 	case nil:
-		return foundUser, nil
-	case bcrypt.ErrMismatchedHashAndPassword:
-		return nil, ErrorIncorrectPassword
+		if wait := time.Until(existing.SentAt.Add(config.VerificationResendInterval)); wait > 0 {
+			return "", &ThrottledError{RetryAfter: wait}
+		}
+		if err := us.verifications.DeleteByUserID(ev.UserID); err != nil {
+			return "", err
+		}
+	case ErrorNotFound:
 	default:
+		return "", err
+	}
+
+	if err := us.verifications.Create(ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+// VerifyEmail marks the address a verification token was issued for as
+// verified. For an email change, that address also becomes the user's
+// email, unless another account has taken it since (ErrorEmailTaken).
+// Unknown or expired tokens, and tokens for an address the user no longer
+// has, return ErrorNotFound.
+func (us *UserService) VerifyEmail(token string) (*User, error) {
+	ev, err := us.verifications.ByToken(token)
+	if err != nil {
 		return nil, err
 	}
+
+	user, err := us.DB.ByID(ev.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if ev.Change {
+		user.Email = ev.Email
+	} else if user.Email != ev.Email {
+		return nil, ErrorNotFound
+	}
+
+	now := time.Now()
+	user.EmailVerified = true
+	user.EmailVerifiedAt = &now
+	if err := us.DB.Update(user); err != nil {
+		return nil, err
+	}
+
+	if err := us.verifications.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ChangePassword sets a new password after checking the current one. The
+// user's other sessions and outstanding password resets are revoked;
+// keepSessionID, the session making the change, stays signed in.
+func (us *UserService) ChangePassword(user *User, current, newPassword string, keepSessionID int64) error {
+	if err := us.checkPassword(user, current); err != nil {
+		return err
+	}
+	if newPassword == "" {
+		return &ValidationError{"password is required"}
+	}
+
+	user.Password = newPassword
+	if err := us.DB.Update(user); err != nil {
+		return err
+	}
+
+	if err := us.pwResets.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	return us.sessions.DeleteOthers(user.ID, keepSessionID)
+}
+
+// StartEmailChange checks the password and issues a token confirming
+// newEmail, which is returned normalized along with the token. The account
+// keeps its current address until VerifyEmail is called with the token.
+// Requests are throttled like StartEmailVerification.
+func (us *UserService) StartEmailChange(user *User, password, newEmail string) (string, string, error) {
+	if err := us.checkPassword(user, password); err != nil {
+		return "", "", err
+	}
+
+	// Run the email stages of userValidator.Update on the new address
+	// without saving it
+	candidate := User{ID: user.ID, Email: newEmail}
+	uv := newUserValidator(us.DB, nil)
+	err := runUserValFns(&candidate,
+		uv.normalizeEmail,
+		uv.requireEmail,
+		uv.emailFormat,
+		uv.emailIsAvail,
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if candidate.Email == user.Email {
+		return "", "", &ValidationError{"email is unchanged"}
+	}
+
+	token, err := us.issueVerification(&EmailVerification{
+		UserID: user.ID,
+		Email:  candidate.Email,
+		Change: true,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return candidate.Email, token, nil
+}
+
+// ScheduleDeletion checks the password and schedules the user's account
+// for deletion once config.AccountDeletionGracePeriod has passed. Asking
+// again keeps the date of the first request.
+func (us *UserService) ScheduleDeletion(user *User, password string) error {
+	if err := us.checkPassword(user, password); err != nil {
+		return err
+	}
+	if user.DeleteAfter != nil {
+		return nil
+	}
+
+	deleteAfter := time.Now().Add(config.AccountDeletionGracePeriod)
+	user.DeleteAfter = &deleteAfter
+	return us.DB.Update(user)
+}
+
+// CancelDeletion keeps an account that was scheduled for deletion. It
+// returns ErrorDeletionNotPending if it was not.
+func (us *UserService) CancelDeletion(user *User) error {
+	if user.DeleteAfter == nil {
+		return ErrorDeletionNotPending
+	}
+	user.DeleteAfter = nil
+	return us.DB.Update(user)
+}
+
+// purge deletes the user and everything tied to their login. Their
+// galleries must be purged first.
+func (us *UserService) purge(user *User) error {
+	if err := us.sessions.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	if err := us.pwResets.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	if err := us.verifications.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	if err := us.recoveryCodes.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	if err := us.challenges.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	return us.DB.Purge(user.ID)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -127,13 +488,13 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 
 type userValidator struct {
 	UserDB
-	hmac hash.HMAC
+	breached *breach.List
 }
 
-func newUserValidator(nextLayer UserDB, hmac hash.HMAC) *userValidator {
+func newUserValidator(nextLayer UserDB, breached *breach.List) *userValidator {
 	return &userValidator{
-		UserDB: nextLayer,
-		hmac:   hmac,
+		UserDB:   nextLayer,
+		breached: breached,
 	}
 }
 
@@ -142,12 +503,10 @@ func (uv *userValidator) Create(user *User) error {
 	err := runUserValFns(user,
 		uv.passwordRequired,
 		uv.passwordLength,
+		uv.passwordNotBreached,
+		uv.passwordNotPersonal,
 		uv.hashPassword,
 		uv.passwordHashRequired,
-		uv.setRemember,
-		uv.rememberMinBytes,
-		uv.hashRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -159,19 +518,13 @@ func (uv *userValidator) Create(user *User) error {
 	return uv.UserDB.Create(user)
 }
 
-// Read By RememberToken
-func (uv *userValidator) ByRememberToken(token string) (*User, error) {
-	rememberHash := uv.hmac.Hash(token)
-	return uv.UserDB.ByRememberToken(rememberHash)
-}
-
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValFns(user,
 		uv.passwordLength,
+		uv.passwordNotBreached,
+		uv.passwordNotPersonal,
 		uv.hashPassword, // Will be skipped if password is ""
 		uv.passwordHashRequired,
-		uv.hashRemember, // Will be skipped if remember is ""
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -183,6 +536,14 @@ func (uv *userValidator) Update(user *User) error {
 	return uv.UserDB.Update(user)
 }
 
+// UseTOTPCounter
+func (uv *userValidator) UseTOTPCounter(id, counter int64) error {
+	if id <= 0 {
+		return ErrorInvalidId
+	}
+	return uv.UserDB.UseTOTPCounter(id, counter)
+}
+
 // Delete
 func (uv *userValidator) Delete(id int64) error {
 	var user User
@@ -194,6 +555,17 @@ func (uv *userValidator) Delete(id int64) error {
 	return uv.UserDB.Delete(id)
 }
 
+// Purge
+func (uv *userValidator) Purge(id int64) error {
+	var user User
+	user.ID = id
+	err := runUserValFns(&user, uv.idGreaterThan(0))
+	if err != nil {
+		return err
+	}
+	return uv.UserDB.Purge(id)
+}
+
 // --- Validation Helpers ---
 
 type userValFn func(*User) error
@@ -218,7 +590,7 @@ func (uv *userValidator) idGreaterThan(n int64) userValFn {
 
 func (uv *userValidator) passwordRequired(user *User) error {
 	if user.Password == "" {
-		return errors.New("password is required")
+		return &ValidationError{"password is required"}
 	}
 	return nil
 }
@@ -227,69 +599,49 @@ func (uv *userValidator) passwordLength(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-	if len(user.Password) < 8 {
-		return errors.New("password must be at least 8 characters long")
+	if len(user.Password) < minPasswordLength {
+		return &ValidationError{fmt.Sprintf("password must be at least %d characters long", minPasswordLength)}
 	}
 	return nil
 }
 
-func (uv *userValidator) hashPassword(user *User) error {
+func (uv *userValidator) passwordNotBreached(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-	pwBytes := []byte(user.Password + config.PassPepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	user.PasswordHash = string(hashedBytes)
-	user.Password = ""
-	return nil
-}
-
-func (uv *userValidator) passwordHashRequired(user *User) error {
-	if user.PasswordHash == "" {
-		return errors.New("password hashing failed")
+	if uv.breached.Contains(user.Password) {
+		return ErrorPasswordBreached
 	}
 	return nil
 }
 
-func (uv *userValidator) setRemember(user *User) error {
-	if user.Remember != "" {
+func (uv *userValidator) passwordNotPersonal(user *User) error {
+	if user.Password == "" {
 		return nil
 	}
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
+	if basedOnPersonalInfo(user.Password, user.Name, user.Email) {
+		return &ValidationError{"password must not be based on your name or email"}
 	}
-	user.Remember = token
 	return nil
 }
 
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	l, err := rand.NBytes(user.Remember)
-
+func (uv *userValidator) hashPassword(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	pwHash, version, err := hashPassword(user.Password)
 	if err != nil {
 		return err
 	}
-
-	if l != 32 {
-		return errors.New("remember token length is not 32")
-	}
-	return nil
-}
-
-func (uv *userValidator) hashRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
+	user.PasswordHash = pwHash
+	user.PasswordVersion = version
+	user.Password = ""
 	return nil
 }
 
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return errors.New("remember hashing failed")
+func (uv *userValidator) passwordHashRequired(user *User) error {
+	if user.PasswordHash == "" {
+		return errors.New("password hashing failed")
 	}
 	return nil
 }
@@ -302,7 +654,7 @@ func (uv *userValidator) normalizeEmail(user *User) error {
 
 func (uv *userValidator) requireEmail(user *User) error {
 	if user.Email == "" {
-		return errors.New("email is required")
+		return &ValidationError{"email is required"}
 	}
 	return nil
 }
@@ -313,7 +665,7 @@ func (uv *userValidator) emailFormat(user *User) error {
 	}
 	_, err := mail.ParseAddress(user.Email)
 	if err != nil {
-		return errors.New("email is not a valid format")
+		return &ValidationError{"email is not a valid format"}
 	}
 	return nil
 }
@@ -342,19 +694,10 @@ type userGorm struct {
 }
 
 // constructor which returns an instance of userGorm
-func newUserGorm(connectionInfo string) (*userGorm, error) {
-	// initialize db connection
-	db, err := gorm.Open(postgres.Open(connectionInfo), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
+func newUserGorm(db *gorm.DB) *userGorm {
 	return &userGorm{
 		db: db,
-	}, nil
+	}
 }
 
 // --- CRUD operations ---
@@ -388,16 +731,15 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-// Retrive by given remember token
-func (ug *userGorm) ByRememberToken(rememberHash string) (*User, error) {
-	var user User
-
-	// Look for that hash in our database
-	err := ug.db.Where("remember_hash = ?", rememberHash).First(&user).Error
-	if err != nil {
+// Retrieve the users due for purging, soft-deleted ones included as long
+// as they were scheduled
+func (ug *userGorm) DueForPurge(now time.Time) ([]User, error) {
+	var users []User
+	db := ug.db.Unscoped().Where("delete_after <= ?", now)
+	if err := all(db, &users); err != nil {
 		return nil, err
 	}
-	return &user, nil
+	return users, nil
 }
 
 // Update
@@ -405,6 +747,25 @@ func (ug *userGorm) Update(user *User) error {
 	return ug.db.Save(user).Error
 }
 
+// UseTOTPCounter compares and sets the counter in one statement, so of
+// two requests with the same code only one succeeds. Only the counter is
+// written, leaving the rest of the row as it is.
+func (ug *userGorm) UseTOTPCounter(id, counter int64) error {
+	result := ug.db.Model(&User{}).
+		Where("id = ? AND totp_last_counter < ?", id, counter).
+		Update("totp_last_counter", counter)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrorIncorrectCode
+	}
+
+	return nil
+}
+
 // Delete
 func (ug *userGorm) Delete(id int64) error {
 	user := User{ID: id}
@@ -421,26 +782,19 @@ func (ug *userGorm) Delete(id int64) error {
 	return nil
 }
 
-// closes the database connection.
-func (ug *userGorm) Close() error {
-	sqlDB, err := ug.db.DB()
-	if err != nil {
-		return err
-	}
-	return sqlDB.Close()
-}
+// Purge deletes the row itself rather than marking it deleted
+func (ug *userGorm) Purge(id int64) error {
+	result := ug.db.Unscoped().Delete(&User{ID: id})
 
-// runs the GORM auto-migration.
-func (ug *userGorm) AutoMigrate() error {
-	return ug.db.AutoMigrate(&User{})
-}
+	if result.Error != nil {
+		return result.Error
+	}
 
-// drops and rebuilds the user table.
-func (ug *userGorm) DestructiveReset() error {
-	if err := ug.db.Migrator().DropTable(&User{}); err != nil {
-		return err
+	if result.RowsAffected == 0 {
+		return ErrorNotFound
 	}
-	return ug.AutoMigrate()
+
+	return nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
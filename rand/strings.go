@@ -2,11 +2,14 @@ package rand
 
 import (
 	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
+	"strings"
 )
 
 const (
 	RememberTokenBytes = 32
+	RecoveryCodeBytes  = 10
 )
 
 // returns n random bytes
@@ -42,3 +45,14 @@ func NBytes(base64String string) (int, error) {
 	}
 	return len(b), nil
 }
+
+// RecoveryCode returns a single-use code such as "k3m9-q2xa-7bwe-pd4r"
+// that is easy to read and type
+func RecoveryCode() (string, error) {
+	b, err := Bytes(RecoveryCodeBytes)
+	if err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
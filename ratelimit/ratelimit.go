@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/realip"
+)
+
+// sweepEvery is how many requests pass between sweeps for idle buckets
+const sweepEvery = 4096
+
+///////////////////////////////////////////////////////////////////////////////
+// Token Bucket Limiter
+///////////////////////////////////////////////////////////////////////////////
+
+// Limiter is a token bucket per key. Each bucket holds up to Requests
+// tokens and refills at Requests per Per, so short bursts are allowed
+// while the long-run rate stays bounded.
+type Limiter struct {
+	Requests int
+	Per      time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Decision is the outcome of a single Allow call
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request would be allowed
+	RetryAfter time.Duration
+}
+
+// New returns a Limiter allowing requests per the given duration per key
+func New(requests int, per time.Duration) *Limiter {
+	return &Limiter{
+		Requests: requests,
+		Per:      per,
+		buckets:  map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the bucket for key if one is available
+func (l *Limiter) Allow(key string) Decision {
+	now := time.Now()
+	capacity := float64(l.Requests)
+	rate := capacity / l.Per.Seconds() // tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls++
+	if l.calls%sweepEvery == 0 {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	d := Decision{Limit: l.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = seconds((capacity - b.tokens) / rate)
+	return d
+}
+
+// sweep drops buckets that have refilled completely, since a fresh bucket
+// behaves the same. The caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Middleware
+///////////////////////////////////////////////////////////////////////////////
+
+// KeyFunc picks the bucket a request is counted against
+type KeyFunc func(r *http.Request) string
+
+// ByIP counts requests per client IP
+func ByIP(r *http.Request) string {
+	return "ip:" + realip.FromRequest(r)
+}
+
+// ByUser counts requests per signed-in user, falling back to the client
+// IP for anonymous requests. The user must already be in the request
+// context, so wrap it inside MaybeUser or RequireUser.
+func ByUser(r *http.Request) string {
+	if user := appctx.User(r.Context()); user != nil {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	return ByIP(r)
+}
+
+// Middleware limits requests per key and reports the quota in the
+// RateLimit-* headers. Rejected requests get a 429 JSON error with
+// Retry-After. It has the shape of a mux.MiddlewareFunc.
+func (l *Limiter) Middleware(key KeyFunc) func(http.Handler) http.Handler {
+	policy := fmt.Sprintf("%d;w=%d", l.Requests, int(l.Per.Seconds()))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := l.Allow(key(r))
+
+			h := w.Header()
+			h.Set("RateLimit-Policy", policy)
+			h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+
+			if !d.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+				h.Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprintln(w, `{"error":"Too many requests, please slow down"}`)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
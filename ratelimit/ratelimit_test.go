@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	appctx "github.com/pranav244872/lenslocked.com/context"
+	"github.com/pranav244872/lenslocked.com/models"
+)
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests int
+		keys     []string
+		allowed  []bool
+	}{
+		{"within burst", 3, []string{"a", "a", "a"}, []bool{true, true, true}},
+		{"over burst", 2, []string{"a", "a", "a", "a"}, []bool{true, true, false, false}},
+		{"keys are separate", 1, []string{"a", "b", "a", "b"}, []bool{true, true, false, false}},
+	}
+	for _, tt := range tests {
+		l := New(tt.requests, time.Hour)
+		for i, key := range tt.keys {
+			d := l.Allow(key)
+			if d.Allowed != tt.allowed[i] {
+				t.Errorf("%s: request %d: Allowed = %v, want %v", tt.name, i+1, d.Allowed, tt.allowed[i])
+			}
+			if d.Limit != tt.requests {
+				t.Errorf("%s: request %d: Limit = %d, want %d", tt.name, i+1, d.Limit, tt.requests)
+			}
+			if d.Allowed && d.RetryAfter != 0 {
+				t.Errorf("%s: request %d: allowed with RetryAfter %v", tt.name, i+1, d.RetryAfter)
+			}
+			if !d.Allowed && d.RetryAfter <= 0 {
+				t.Errorf("%s: request %d: rejected without RetryAfter", tt.name, i+1)
+			}
+		}
+	}
+}
+
+func TestAllowRemainingAndReset(t *testing.T) {
+	l := New(60, time.Minute)
+	for want := 59; want >= 0; want-- {
+		if d := l.Allow("k"); d.Remaining != want {
+			t.Fatalf("Remaining = %d, want %d", d.Remaining, want)
+		}
+	}
+	d := l.Allow("k")
+	if d.Allowed {
+		t.Fatal("allowed past the limit")
+	}
+	// One token comes back per second and the bucket is full again after
+	// a minute
+	if d.RetryAfter <= 0 || d.RetryAfter > time.Second {
+		t.Errorf("RetryAfter = %v, want at most 1s", d.RetryAfter)
+	}
+	if d.Reset < 59*time.Second || d.Reset > time.Minute {
+		t.Errorf("Reset = %v, want about 1m", d.Reset)
+	}
+}
+
+func TestAllowRefills(t *testing.T) {
+	l := New(1, 20*time.Millisecond)
+	if !l.Allow("k").Allowed {
+		t.Fatal("first request rejected")
+	}
+	if l.Allow("k").Allowed {
+		t.Fatal("second request allowed before refill")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !l.Allow("k").Allowed {
+		t.Error("request rejected after refill")
+	}
+}
+
+func TestSweepDropsFullBuckets(t *testing.T) {
+	l := New(1, time.Minute)
+	l.Allow("idle")
+	l.Allow("busy")
+	now := time.Now()
+	l.buckets["idle"].last = now.Add(-2 * time.Minute)
+
+	l.mu.Lock()
+	l.sweep(now)
+	l.mu.Unlock()
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("busy bucket was swept")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := New(2, time.Minute)
+	handler := l.Middleware(ByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		remote     string
+		status     int
+		remaining  string
+		retryAfter string
+	}{
+		{"203.0.113.7:1000", http.StatusNoContent, "1", ""},
+		{"203.0.113.7:1001", http.StatusNoContent, "0", ""},
+		{"203.0.113.7:1002", http.StatusTooManyRequests, "0", "30"},
+		{"198.51.100.1:1000", http.StatusNoContent, "1", ""},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/login", nil)
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("request %d: status = %d, want %d", i+1, w.Code, tt.status)
+		}
+		h := w.Header()
+		if got := h.Get("RateLimit-Policy"); got != "2;w=60" {
+			t.Errorf("request %d: RateLimit-Policy = %q", i+1, got)
+		}
+		if got := h.Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: RateLimit-Limit = %q", i+1, got)
+		}
+		if got := h.Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: RateLimit-Remaining = %q, want %q", i+1, got, tt.remaining)
+		}
+		if got := h.Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("request %d: Retry-After = %q, want %q", i+1, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestByUser(t *testing.T) {
+	tests := []struct {
+		user *models.User
+		want string
+	}{
+		{nil, "ip:203.0.113.7"},
+		{&models.User{ID: 42}, "user:42"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "203.0.113.7:1000"
+		if tt.user != nil {
+			r = r.WithContext(appctx.WithUser(r.Context(), tt.user))
+		}
+		if got := ByUser(r); got != tt.want {
+			t.Errorf("ByUser = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pranav244872/lenslocked.com/config"
+)
+
+// FromRequest returns the IP address of the client that made r. Requests
+// relayed by a proxy in config.TrustedProxies are traced back through
+// X-Forwarded-For; the header is ignored for everyone else, since any
+// client can set it.
+func FromRequest(r *http.Request) string {
+	remote := hostOnly(r.RemoteAddr)
+	if !trusted(remote) {
+		return remote
+	}
+
+	// Walk the chain from the nearest hop back, stopping at the first
+	// address we do not control
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !trusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return remote
+}
+
+// forwardedFor returns every valid address in the X-Forwarded-For headers
+// in the order they were added
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hop = hostOnly(strings.TrimSpace(hop))
+			if net.ParseIP(hop) != nil {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// trusted reports whether ip belongs to one of our proxies
+func trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range config.TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOnly strips the port from addresses such as "1.2.3.4:5678" or
+// "[::1]:80"
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,89 @@
+package realip
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pranav244872/lenslocked.com/config"
+)
+
+func mustNetworks(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func TestFromRequest(t *testing.T) {
+	saved := config.TrustedProxies
+	defer func() { config.TrustedProxies = saved }()
+	config.TrustedProxies = mustNetworks(t, "10.0.0.0/8", "::1/128")
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer cannot spoof", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.2:443", nil, "10.0.0.2"},
+		{"client spoofs start of chain", "10.0.0.2:443", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:443", []string{"198.51.100.1, 10.0.0.9, 10.1.2.3"}, "198.51.100.1"},
+		{"every hop trusted", "10.0.0.2:443", []string{"10.0.0.5, 10.0.0.9"}, "10.0.0.5"},
+		{"repeated headers", "10.0.0.2:443", []string{"1.1.1.1", "198.51.100.1, 10.0.0.9"}, "198.51.100.1"},
+		{"invalid hops skipped", "10.0.0.2:443", []string{"198.51.100.1, garbage, "}, "198.51.100.1"},
+		{"hop with port", "10.0.0.2:443", []string{"198.51.100.1:1234"}, "198.51.100.1"},
+		{"ipv6 proxy", "[::1]:443", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"ipv6 client", "[2001:db8::2]:443", []string{"198.51.100.1"}, "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, header := range tt.xff {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := FromRequest(r); got != tt.want {
+			t.Errorf("%s: FromRequest = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFromRequestNoTrustedProxies(t *testing.T) {
+	saved := config.TrustedProxies
+	defer func() { config.TrustedProxies = saved }()
+	config.TrustedProxies = nil
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:443"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := FromRequest(r); got != "10.0.0.2" {
+		t.Errorf("FromRequest = %q, want %q", got, "10.0.0.2")
+	}
+}
+
+func TestHostOnly(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"1.2.3.4:5678", "1.2.3.4"},
+		{"1.2.3.4", "1.2.3.4"},
+		{"[::1]:80", "::1"},
+		{"[::1]", "::1"},
+		{"::1", "::1"},
+	}
+	for _, tt := range tests {
+		if got := hostOnly(tt.addr); got != tt.want {
+			t.Errorf("hostOnly(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is how much of an upload is buffered at a time. Smaller
+	// objects go up in one PUT; larger ones use a multipart upload.
+	s3PartSize = 8 << 20
+
+	// s3MaxPresign is the longest validity S3 accepts for a signed URL
+	s3MaxPresign = 7 * 24 * time.Hour
+)
+
+// S3Config locates a bucket on AWS S3 or any S3-compatible server such as
+// MinIO
+type S3Config struct {
+	// Endpoint is the base URL, e.g. "https://s3.eu-west-1.amazonaws.com"
+	// or "http://localhost:9000"
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as <endpoint>/<bucket> instead of
+	// <bucket>.<endpoint>; most self-hosted servers need it
+	PathStyle bool
+}
+
+// S3 stores objects in an S3 bucket using the plain REST API
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	signer    signer
+	client    *http.Client
+}
+
+// NewS3 returns an S3 store for the bucket described by cfg
+func NewS3(cfg S3Config) (*S3, error) {
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("storage: S3 bucket is required")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &S3{
+		endpoint:  endpoint,
+		bucket:    cfg.Bucket,
+		pathStyle: cfg.PathStyle,
+		signer: signer{
+			accessKey: cfg.AccessKey,
+			secretKey: cfg.SecretKey,
+			region:    region,
+		},
+		client: &http.Client{},
+	}, nil
+}
+
+// Put uploads small objects with a single PUT and streams larger ones as
+// a multipart upload, buffering one part at a time
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, contentType string) (*ObjectInfo, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	contentType = contentTypeOf(key, contentType)
+
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		if err := s.putObject(ctx, key, buf[:n], contentType); err != nil {
+			return nil, err
+		}
+		return &ObjectInfo{Key: key, Size: int64(n), ContentType: contentType, ModTime: time.Now()}, nil
+	case nil:
+	default:
+		return nil, err
+	}
+
+	size, err := s.putMultipart(ctx, key, buf, r, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: size, ContentType: contentType, ModTime: time.Now()}, nil
+}
+
+func (s *S3) putObject(ctx context.Context, key string, body []byte, contentType string) error {
+	header := http.Header{"Content-Type": {contentType}}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart uploads first and then the rest of r in s3PartSize parts.
+// The upload is aborted if anything fails so no parts are left behind.
+func (s *S3) putMultipart(ctx context.Context, key string, first []byte, r io.Reader, contentType string) (int64, error) {
+	header := http.Header{"Content-Type": {contentType}}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = decodeXML(resp, &initiated)
+	if err != nil {
+		return 0, err
+	}
+	uploadID := initiated.UploadID
+
+	abort := func(cause error) (int64, error) {
+		q := url.Values{"uploadId": {uploadID}}
+		if resp, err := s.do(context.Background(), http.MethodDelete, key, q, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+		return 0, cause
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	var size int64
+
+	buf := first
+	for number := 1; ; number++ {
+		q := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := s.do(ctx, http.MethodPut, key, q, nil, buf)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		size += int64(len(buf))
+
+		buf = buf[:cap(buf)]
+		n, err := io.ReadFull(r, buf)
+		buf = buf[:n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return abort(err)
+	}
+	// S3 can report a failed completion inside a 200 response
+	var completed struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := decodeXML(resp, &completed); err != nil {
+		return abort(err)
+	}
+	if completed.XMLName.Local == "Error" {
+		return abort(fmt.Errorf("storage: S3 %s: %s", completed.Code, completed.Message))
+	}
+	return size, nil
+}
+
+// Get
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	if err := checkKey(key); err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, objectInfo(key, resp), nil
+}
+
+// Delete
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List pages through ListObjectsV2
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := decodeXML(resp, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:         c.Key,
+				Size:        c.Size,
+				ContentType: contentTypeOf(c.Key, ""),
+				ModTime:     c.LastModified,
+			})
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Stat
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp), nil
+}
+
+// SignedURL presigns a GET for the object
+func (s *S3) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	if expires > s3MaxPresign {
+		expires = s3MaxPresign
+	}
+	return s.signer.presign(s.objectURL(key, nil), expires, time.Now()), nil
+}
+
+// objectURL addresses key in the bucket, or the bucket itself for ""
+func (s *S3) objectURL(key string, q url.Values) *url.URL {
+	u := *s.endpoint
+	p := "/" + key
+	if s.pathStyle {
+		p = "/" + s.bucket + p
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = u.Path + p
+	u.RawPath = uriEncode(u.Path, false)
+	if q != nil {
+		u.RawQuery = canonicalQuery(q)
+	}
+	return &u
+}
+
+// do sends a signed request. Non-2xx responses are turned into errors,
+// with 404 reported as ErrNotFound.
+func (s *S3) do(ctx context.Context, method, key string, q url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.objectURL(key, q)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.signer.signRequest(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("storage: S3 %s %s: %s: %s", method, key, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("storage: S3 %s %s: %s", method, key, resp.Status)
+}
+
+func decodeXML(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+func objectInfo(key string, resp *http.Response) *ObjectInfo {
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: contentTypeOf(key, resp.Header.Get("Content-Type")),
+		ModTime:     modTime,
+	}
+}
+
+// checkKey rejects keys that the local store would also refuse, so both
+// backends accept the same keys
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains("/"+key+"/", "/../") {
+		return ErrInvalidKey
+	}
+	return nil
+}
@@ -0,0 +1,561 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// S3 stand-in
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+	fakeBucket    = "photos"
+	fakeAccessKey = "minioadmin"
+	fakeSecretKey = "minio-secret-key"
+	fakeRegion    = "eu-west-1"
+	// fakePageSize is small so listing has to page
+	fakePageSize = 2
+)
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+	modTime     time.Time
+}
+
+// fakeS3 serves the part of the S3 API the S3 store uses, like a MinIO
+// server holding one bucket in memory. Every request must carry a valid
+// SigV4 signature, checked against the request exactly as it arrived.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	uploads  map[string]map[int][]byte
+	nextID   int
+	aborted  int
+	failNext string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3) {
+	f := &fakeS3{
+		objects: map[string]fakeObject{},
+		uploads: map[string]map[int][]byte{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	s, err := NewS3(S3Config{
+		Endpoint:  server.URL,
+		Region:    fakeRegion,
+		Bucket:    fakeBucket,
+		AccessKey: fakeAccessKey,
+		SecretKey: fakeSecretKey,
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := f.verify(r, body); err != nil {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	bucketPath := "/" + fakeBucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket", r.URL.Path)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failNext != "" && r.Method == f.failNext {
+		f.failNext = ""
+		f.fail(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2":
+		f.list(w, q)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchUpload", q.Get("uploadId"))
+			return
+		}
+		number, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		f.complete(w, key, q.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = fakeObject{body, r.Header.Get("Content-Type"), time.Now()}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(obj.body)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+// verify checks the signature of a signed or presigned request, and that
+// a signed body hash matches the body
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	s := signer{accessKey: fakeAccessKey, secretKey: fakeSecretKey, region: fakeRegion}
+	path, rawQuery, _ := strings.Cut(r.RequestURI, "?")
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return err
+	}
+
+	if sig := q.Get("X-Amz-Signature"); sig != "" {
+		amzDate := q.Get("X-Amz-Date")
+		now, err := time.Parse(amzDateFormat, amzDate)
+		if err != nil {
+			return err
+		}
+		if q.Get("X-Amz-Credential") != fakeAccessKey+"/"+s.scope(now) {
+			return errors.New("wrong credential")
+		}
+		q.Del("X-Amz-Signature")
+		canonical := strings.Join([]string{
+			r.Method, path, canonicalQuery(q),
+			"host:" + r.Host + "\n", "host", unsignedPayload,
+		}, "\n")
+		if sig != s.signature(now, stringToSign(amzDate, s.scope(now), canonical)) {
+			return errors.New("presigned signature does not match")
+		}
+		return nil
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	now, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return err
+	}
+	var credential, signedHeaders, signature string
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigAlgorithm+" ")
+	if !ok {
+		return errors.New("missing Authorization")
+	}
+	for _, part := range strings.Split(auth, ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	if credential != fakeAccessKey+"/"+s.scope(now) {
+		return errors.New("wrong credential")
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := strings.TrimSpace(strings.Join(r.Header.Values(name), ","))
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	canonical := strings.Join([]string{
+		r.Method, path, canonicalQuery(q), headers.String(), signedHeaders, payloadHash,
+	}, "\n")
+	if signature != s.signature(now, stringToSign(amzDate, s.scope(now), canonical)) {
+		return errors.New("signature does not match")
+	}
+
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return errors.New("body does not match X-Amz-Content-Sha256")
+	}
+	return nil
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, q.Get("prefix")) && key > q.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string    `xml:"Key"`
+		Size         int       `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+	if len(keys) > fakePageSize {
+		keys = keys[:fakePageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := f.objects[key]
+		result.Contents = append(result.Contents, content{key, len(obj.body), obj.modTime.UTC()})
+	}
+	writeXML(w, result)
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, id string, body []byte) {
+	parts, ok := f.uploads[id]
+	if !ok {
+		f.fail(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		f.fail(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var whole []byte
+	for i, p := range req.Parts {
+		data, ok := parts[p.PartNumber]
+		if p.PartNumber != i+1 || !ok || p.ETag != etag(data) {
+			// S3 reports this in a 200 response
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"Error"`
+				Code    string   `xml:"Code"`
+				Message string   `xml:"Message"`
+			}{Code: "InvalidPart", Message: fmt.Sprintf("part %d", p.PartNumber)})
+			return
+		}
+		whole = append(whole, data...)
+	}
+	delete(f.uploads, id)
+	f.objects[key] = fakeObject{whole, "", time.Now()}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string   `xml:"Key"`
+	}{Key: key})
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Tests
+///////////////////////////////////////////////////////////////////////////////
+
+func TestS3PutGetStatDelete(t *testing.T) {
+	_, s := newFakeS3(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"galleries/1/abc.jpg", "galleries/1/my photo+1 (é).jpg"} {
+		t.Run(key, func(t *testing.T) {
+			body := []byte("not really a jpeg")
+			info, err := s.Put(ctx, key, bytes.NewReader(body), "image/jpeg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Key != key || info.Size != int64(len(body)) || info.ContentType != "image/jpeg" {
+				t.Errorf("Put = %+v", info)
+			}
+
+			rc, info, err := s.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(rc)
+			rc.Close()
+			if !bytes.Equal(got, body) || info.ContentType != "image/jpeg" {
+				t.Errorf("Get = %q, %+v", got, info)
+			}
+
+			info, err = s.Stat(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != int64(len(body)) || info.ModTime.IsZero() {
+				t.Errorf("Stat = %+v", info)
+			}
+
+			if err := s.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.Get(ctx, key); err != ErrNotFound {
+				t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+			}
+			if _, err := s.Stat(ctx, key); err != ErrNotFound {
+				t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+			}
+			if err := s.Delete(ctx, key); err != nil {
+				t.Errorf("Delete of a missing object = %v", err)
+			}
+		})
+	}
+}
+
+func TestS3List(t *testing.T) {
+	f, s := newFakeS3(t)
+	ctx := context.Background()
+
+	keys := []string{
+		"galleries/1/a.jpg", "galleries/1/b.jpg", "galleries/1/c.png",
+		"galleries/1/derived/a_320.jpg", "galleries/12/a.jpg",
+	}
+	for _, key := range keys {
+		if _, err := s.Put(ctx, key, strings.NewReader(key), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects, err := s.List(ctx, "galleries/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, obj := range objects {
+		got = append(got, obj.Key)
+		if obj.Size != int64(len(obj.Key)) {
+			t.Errorf("%s: Size = %d", obj.Key, obj.Size)
+		}
+	}
+	want := keys[:4]
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+	if f.objects["galleries/1/c.png"].contentType != "image/png" {
+		t.Errorf("content type from the key = %q", f.objects["galleries/1/c.png"].contentType)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	f, s := newFakeS3(t)
+	ctx := context.Background()
+
+	body := make([]byte, 2*s3PartSize+12345)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+	info, err := s.Put(ctx, "galleries/1/big.jpg", bytes.NewReader(body), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(body)) {
+		t.Errorf("Size = %d, want %d", info.Size, len(body))
+	}
+	if !bytes.Equal(f.objects["galleries/1/big.jpg"].body, body) {
+		t.Error("stored object differs from the upload")
+	}
+	if len(f.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open", len(f.uploads))
+	}
+}
+
+func TestS3MultipartAbort(t *testing.T) {
+	f, s := newFakeS3(t)
+	ctx := context.Background()
+
+	readErr := errors.New("connection reset")
+	r := io.MultiReader(bytes.NewReader(make([]byte, s3PartSize+1)), &errReader{readErr})
+	if _, err := s.Put(ctx, "galleries/1/big.jpg", r, "image/jpeg"); err != readErr {
+		t.Fatalf("Put = %v, want %v", err, readErr)
+	}
+	if f.aborted != 1 || len(f.uploads) != 0 {
+		t.Errorf("aborted %d uploads, %d left open", f.aborted, len(f.uploads))
+	}
+	if _, ok := f.objects["galleries/1/big.jpg"]; ok {
+		t.Error("a failed upload was stored")
+	}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestS3SignedURL(t *testing.T) {
+	_, s := newFakeS3(t)
+	ctx := context.Background()
+
+	key := "galleries/1/my photo.jpg"
+	if _, err := s.Put(ctx, key, strings.NewReader("photo"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := s.SignedURL(ctx, key, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("X-Amz-Expires"); got != "604800" {
+		t.Errorf("X-Amz-Expires = %s, want the 7 day maximum", got)
+	}
+
+	resp, err := http.Get(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(got) != "photo" {
+		t.Errorf("GET signed URL = %d %q", resp.StatusCode, got)
+	}
+
+	// A tampered URL is refused
+	q := u.Query()
+	q.Set("X-Amz-Expires", "604801")
+	u.RawQuery = canonicalQuery(q)
+	resp, err = http.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET tampered URL = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	f, s := newFakeS3(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"", "/abs.jpg", "galleries/../secret"} {
+		if _, err := s.Put(ctx, key, strings.NewReader("x"), ""); err != ErrInvalidKey {
+			t.Errorf("Put(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+
+	f.failNext = http.MethodPut
+	_, err := s.Put(ctx, "galleries/1/a.jpg", strings.NewReader("x"), "")
+	if err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Errorf("Put on a server error = %v, want the S3 error code", err)
+	}
+
+	bad, err := NewS3(S3Config{
+		Endpoint:  s.endpoint.String(),
+		Bucket:    fakeBucket,
+		Region:    fakeRegion,
+		AccessKey: fakeAccessKey,
+		SecretKey: "wrong",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bad.Put(ctx, "galleries/1/a.jpg", strings.NewReader("x"), "")
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Put with the wrong secret = %v, want SignatureDoesNotMatch", err)
+	}
+}
+
+func TestS3ObjectURL(t *testing.T) {
+	tests := []struct {
+		pathStyle bool
+		key       string
+		want      string
+	}{
+		{true, "galleries/1/a b.jpg", "https://s3.example.com/photos/galleries/1/a%20b.jpg"},
+		{false, "galleries/1/a b.jpg", "https://photos.s3.example.com/galleries/1/a%20b.jpg"},
+		{true, "", "https://s3.example.com/photos/"},
+	}
+	for _, tt := range tests {
+		s, err := NewS3(S3Config{Endpoint: "https://s3.example.com/", Bucket: "photos", PathStyle: tt.pathStyle})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.objectURL(tt.key, nil).String(); got != tt.want {
+			t.Errorf("objectURL(%q) with path style %t = %s, want %s", tt.key, tt.pathStyle, got, tt.want)
+		}
+	}
+}
+
+func TestNewS3Invalid(t *testing.T) {
+	tests := []S3Config{
+		{Endpoint: "not a url", Bucket: "photos"},
+		{Endpoint: "https://s3.example.com"},
+	}
+	for _, cfg := range tests {
+		if _, err := NewS3(cfg); err == nil {
+			t.Errorf("NewS3(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pranav244872/lenslocked.com/config"
+)
+
+var (
+	ErrNotFound   = errors.New("storage: object not found")
+	ErrInvalidKey = errors.New("storage: invalid object key")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// ImageStore keeps image files under slash separated keys such as
+// "galleries/12/abc.jpg". Implementations must be safe for concurrent use.
+type ImageStore interface {
+	// Put stores everything read from r under key, replacing any object
+	// already there. Nothing is stored if reading r fails.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (*ObjectInfo, error)
+
+	// Get opens the object for reading. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// Stat returns the object's metadata without reading it
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// SignedURL returns a URL that lets anyone holding it download the
+	// object until it expires
+	SignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// New returns the ImageStore selected by config.StorageBackend
+func New() (ImageStore, error) {
+	switch config.StorageBackend {
+	case "local":
+		return NewLocal(config.ImageDir, config.LocalStorageURL, config.StorageSigningKey), nil
+	case "s3":
+		return NewS3(S3Config{
+			Endpoint:  config.S3Endpoint,
+			Region:    config.S3Region,
+			Bucket:    config.S3Bucket,
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+			PathStyle: config.S3PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("storage: unknown STORAGE_BACKEND %q", config.StorageBackend)
+	}
+}